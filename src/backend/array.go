@@ -0,0 +1,202 @@
+package backend
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+	"github.com/google/uuid"
+)
+
+const (
+	maxArraySize          = 1000 // jobs created by a single job array request
+	arrayIndexPlaceholder = "{{index}}"
+)
+
+// statuses of a job array, rolled up from its jobs
+const (
+	arrayActive = "ACTIVE" // some of the jobs haven't ended
+	arrayEnded  = "ENDED"
+)
+
+var ErrArrayNotFound = errors.New("invalid job array ID")
+
+// ArraySpec is a validated job array request, a job is created for each of its indexes
+type ArraySpec struct {
+	Args    [][]string // arguments appended to the command of each job, nil for a range
+	Indexes []int      // index of each job, replaces the placeholder in its command and env values
+}
+
+// returns the spec of the job with the array index 'i'
+func (a *ArraySpec) jobSpec(spec *JobSpec, i int) *JobSpec {
+	index := strconv.Itoa(a.Indexes[i])
+	job := *spec
+	job.Array = nil
+
+	job.Command = make([]string, 0, len(spec.Command))
+	for _, arg := range spec.Command {
+		job.Command = append(job.Command, strings.ReplaceAll(arg, arrayIndexPlaceholder, index))
+	}
+	if a.Args != nil {
+		job.Command = append(job.Command, a.Args[i]...)
+	}
+
+	job.Env = make(map[string]string, len(spec.Env))
+	for key, value := range spec.Env {
+		job.Env[key] = strings.ReplaceAll(value, arrayIndexPlaceholder, index)
+	}
+
+	return &job
+}
+
+// SubmitJobArray submits a job for each index of the spec's array, which are added to the user. If a job fails to be
+// submitted the ones submitted before it are stopped, they're kept to be inspected. Returns the ID of the array.
+func SubmitJobArray(state *State, user *User, spec *JobSpec) (string, error) {
+	// the jobs only differ by their command and env, and the whole array is rejected rather than submitting the jobs
+	// that fit
+	if err := checkJobAllowed(state, user, spec); err != nil {
+		return "", err
+	}
+
+	if err := user.reserveQuota(len(spec.Array.Indexes), time.Now()); err != nil {
+		return "", err
+	}
+
+	arrayID := uuid.NewString()
+
+	// the jobs are only added to the user once they were all submitted, the array isn't visible before
+	jobs := make([]*Job, 0, len(spec.Array.Indexes))
+	for i, index := range spec.Array.Indexes {
+		job, err := createJob(state, user, spec.Array.jobSpec(spec, i), jobOrigin{arrayID: arrayID, arrayIndex: index})
+		if err != nil {
+			user.releaseQuota(len(spec.Array.Indexes))
+			rollbackJobArray(state, arrayID, jobs)
+			return "", err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	user.addReservedJobs(jobs...)
+
+	return arrayID, nil
+}
+
+// kills the jobs of an array that couldn't be submitted entirely, and deletes them once they ended
+func rollbackJobArray(state *State, arrayID string, jobs []*Job) {
+	for _, job := range jobs {
+		if err := state.StopJob(job, true); err != nil {
+			log.Printf("Failed to stop job %s of array %s: %s", job.GetID(), arrayID, err)
+		}
+
+		go func(job *Job) {
+			<-job.done
+			if err := job.delete(); err != nil {
+				log.Printf("Failed to delete job %s of array %s: %s", job.GetID(), arrayID, err)
+			}
+		}(job)
+	}
+}
+
+func (j *Job) getArrayID() string {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.arrayID
+}
+
+// returns the summary of the job shown by its array, and when it was created
+func (j *Job) arrayJobView() (view.JobArrayViewJob, time.Time) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return view.JobArrayViewJob{Index: j.arrayIndex, ID: j.id, Status: string(j.status), ExitCode: j.exitCode}, j.createdAt
+}
+
+// returns the jobs of the array that weren't purged
+func (u *User) getArrayJobs(arrayID string) []*Job {
+	jobs := []*Job{}
+	for _, job := range u.GetAllJobs() {
+		if job.getArrayID() == arrayID {
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs
+}
+
+func arrayView(id string, jobs []*Job) *view.JobArrayViewFull {
+	array := &view.JobArrayViewFull{
+		JobArrayViewPartial: view.JobArrayViewPartial{ID: id, Status: arrayEnded, Size: len(jobs), Counts: map[string]int{}},
+		Jobs:                make([]view.JobArrayViewJob, 0, len(jobs)),
+	}
+
+	for _, job := range jobs {
+		jobView, createdAt := job.arrayJobView()
+		if _, ended := job.getEndedAt(); !ended {
+			array.Status = arrayActive
+		}
+		if array.CreatedAt.IsZero() || createdAt.Before(array.CreatedAt) {
+			array.CreatedAt = createdAt
+		}
+
+		array.Counts[jobView.Status]++
+		array.Jobs = append(array.Jobs, jobView)
+	}
+
+	sort.Slice(array.Jobs, func(i, k int) bool { return array.Jobs[i].Index < array.Jobs[k].Index })
+	return array
+}
+
+// GetJobArray returns the array rolled up from its jobs, it's gone once all of them are purged
+func (u *User) GetJobArray(arrayID string) (*view.JobArrayViewFull, error) {
+	jobs := u.getArrayJobs(arrayID)
+	if len(jobs) == 0 {
+		return nil, ErrArrayNotFound
+	}
+
+	return arrayView(arrayID, jobs), nil
+}
+
+func (u *User) GetAllJobArrays() []view.JobArrayViewPartial {
+	arrays := map[string][]*Job{}
+	for _, job := range u.GetAllJobs() {
+		if arrayID := job.getArrayID(); arrayID != "" {
+			arrays[arrayID] = append(arrays[arrayID], job)
+		}
+	}
+
+	views := make([]view.JobArrayViewPartial, 0, len(arrays))
+	for id, jobs := range arrays {
+		views = append(views, arrayView(id, jobs).JobArrayViewPartial)
+	}
+
+	return views
+}
+
+// StopJobArray stops every job of the array that hasn't ended. The ones that haven't started are stopped first,
+// so that they aren't started in the slots released by the others.
+func (s *State) StopJobArray(user *User, arrayID string, force bool) error {
+	jobs := user.getArrayJobs(arrayID)
+	if len(jobs) == 0 {
+		return ErrArrayNotFound
+	}
+
+	for _, job := range jobs {
+		if s.scheduler.cancel(job, force) {
+			s.wheel.remove(job)
+		}
+	}
+
+	for _, job := range jobs {
+		if err := s.StopJob(job, force); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{}
+
+var attachFrameTypes = map[OutputStream]byte{
+	StdoutStream: view.AttachStdout,
+	StderrStream: view.AttachStderr,
+}
+
+// attachJob streams the job's output over a WebSocket, any number of sessions can watch a job.
+// With 'stdin=true' the session also writes the job's stdin, which only one session can do at a time.
+func (s *Server) attachJob(w http.ResponseWriter, r *http.Request, job *Job) {
+	writeStdin := r.URL.Query().Get("stdin") == "true"
+	if writeStdin {
+		if err := job.AcquireStdin(); err != nil {
+			WriteJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		defer job.ReleaseStdin()
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to start attach session: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	closed := make(chan struct{})
+	go readAttachFrames(conn, job, writeStdin, closed)
+
+	if err := writeAttachOutput(conn, job, closed); err != nil {
+		log.Printf("Attach session of job %s ended with error: %s", job.GetID(), err)
+	}
+}
+
+// reads frames from the client until the connection is closed, control messages are also processed here
+func readAttachFrames(conn *websocket.Conn, job *Job, writeStdin bool, closed chan<- struct{}) {
+	defer close(closed)
+
+	for {
+		messageType, frame, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if !writeStdin || messageType != websocket.BinaryMessage || len(frame) == 0 || frame[0] != view.AttachStdin {
+			continue
+		}
+
+		if len(frame) == 1 {
+			err = job.CloseStdin()
+		} else {
+			err = job.WriteStdin(frame[1:])
+		}
+
+		if err != nil {
+			log.Printf("Failed to write stdin of job %s: %s", job.GetID(), err)
+		}
+	}
+}
+
+// sends the output of the job as it arrives, and closes the session with the job status when the job ends
+func writeAttachOutput(conn *websocket.Conn, job *Job, closed <-chan struct{}) error {
+	offsets := map[OutputStream]int{}
+
+	for {
+		// output only stops arriving once the job ends, so if it wasn't executing for the first read
+		// then the reads return the final output, until they return nothing
+		executing, updated, sent := false, (<-chan struct{})(nil), false
+		for i, stream := range []OutputStream{StdoutStream, StderrStream} {
+			output, next, streamExecuting, streamUpdated := job.ReadOutput(stream, offsets[stream])
+			if i == 0 {
+				executing, updated = streamExecuting, streamUpdated
+			}
+
+			// dropped output is skipped
+			offsets[stream] = next
+			if len(output) == 0 {
+				continue
+			}
+
+			sent = true
+			if err := conn.WriteMessage(websocket.BinaryMessage, append([]byte{attachFrameTypes[stream]}, output...)); err != nil {
+				return err
+			}
+		}
+
+		// reads of the log files are limited in size, more output can be available
+		if sent {
+			continue
+		}
+
+		if !executing {
+			break
+		}
+
+		select {
+		case <-updated:
+		case <-closed:
+			return nil
+		}
+	}
+
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, string(job.GetStatus()))
+	return conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+}
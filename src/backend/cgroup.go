@@ -0,0 +1,183 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+)
+
+const (
+	cpuPeriod   = 100000 // cpu.max period in microseconds
+	minCPUQuota = 1000   // smallest cpu.max quota in microseconds accepted by the kernel
+)
+
+var cgroupControllers = []string{"cpu", "memory", "io"}
+
+// CgroupManager manages a parent cgroup v2 directory, each job gets a leaf cgroup under it
+type CgroupManager struct {
+	root        string          // path to the parent cgroup, NOT EMPTY
+	controllers map[string]bool // controllers enabled for the leaf cgroups
+}
+
+type jobCgroup struct {
+	path string   // path to the leaf cgroup of the job
+	dir  *os.File // open handle to the cgroup directory, used to place the process in it before exec
+}
+
+func NewCgroupManager(root string) (*CgroupManager, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	available, err := ioutil.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a cgroup v2 directory: %s", root, err)
+	}
+
+	m := &CgroupManager{root: root, controllers: map[string]bool{}}
+	for _, controller := range strings.Fields(string(available)) {
+		m.controllers[controller] = true
+	}
+
+	for _, controller := range cgroupControllers {
+		if !m.controllers[controller] {
+			log.Printf("cgroup controller '%s' isn't available in %s", controller, root)
+			continue
+		}
+
+		// controllers must be enabled in the parent for the leaf cgroups to have the interface files
+		if err := writeCgroupFile(root, "cgroup.subtree_control", "+"+controller); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+}
+
+func (m *CgroupManager) requireController(controller string) error {
+	if !m.controllers[controller] {
+		return fmt.Errorf("cgroup controller '%s' isn't available", controller)
+	}
+
+	return nil
+}
+
+func (m *CgroupManager) createJobCgroup(name string, limits view.JobViewLimits) (*jobCgroup, error) {
+	path := filepath.Join(m.root, name)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, err
+	}
+
+	cgroup := &jobCgroup{path: path}
+	if err := cgroup.applyLimits(m, limits); err != nil {
+		cgroup.remove()
+		return nil, err
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		cgroup.remove()
+		return nil, err
+	}
+	cgroup.dir = dir
+
+	return cgroup, nil
+}
+
+// returns the existing cgroup of a job that was created before the server restarted, nil if it doesn't exist
+func (m *CgroupManager) openJobCgroup(name string) *jobCgroup {
+	path := filepath.Join(m.root, name)
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+
+	return &jobCgroup{path: path}
+}
+
+func (c *jobCgroup) applyLimits(m *CgroupManager, limits view.JobViewLimits) error {
+	if limits.CPU != 0 {
+		if err := m.requireController("cpu"); err != nil {
+			return err
+		}
+
+		quota := int64(limits.CPU * cpuPeriod)
+		if err := writeCgroupFile(c.path, "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			return err
+		}
+	}
+
+	if limits.MemoryMax != 0 {
+		if err := m.requireController("memory"); err != nil {
+			return err
+		}
+
+		if err := writeCgroupFile(c.path, "memory.max", fmt.Sprintf("%d", limits.MemoryMax)); err != nil {
+			return err
+		}
+	}
+
+	if limits.IOWeight != 0 {
+		if err := m.requireController("io"); err != nil {
+			return err
+		}
+
+		if err := writeCgroupFile(c.path, "io.weight", fmt.Sprintf("default %d", limits.IOWeight)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *jobCgroup) fd() int {
+	return int(c.dir.Fd())
+}
+
+// sends SIGKILL to every process in the cgroup
+func (c *jobCgroup) kill() error {
+	return writeCgroupFile(c.path, "cgroup.kill", "1")
+}
+
+// CPU time used so far by every process in the cgroup, cpu.stat has it even without the cpu controller
+func (c *jobCgroup) cpuUsage() (time.Duration, error) {
+	content, err := ioutil.ReadFile(filepath.Join(c.path, "cpu.stat"))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "usage_usec" {
+			continue
+		}
+
+		usec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return time.Duration(usec) * time.Microsecond, nil
+	}
+
+	return 0, errors.New("cpu.stat doesn't have usage_usec")
+}
+
+func (c *jobCgroup) remove() error {
+	if c.dir != nil {
+		c.dir.Close()
+	}
+
+	return os.Remove(c.path)
+}
@@ -0,0 +1,184 @@
+package backend
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// range of values of a field of a cron expression, with the names that can be used instead of numbers
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	secondsField  = cronField{name: "second", min: 0, max: 59}
+	minutesField  = cronField{name: "minute", min: 0, max: 59}
+	hoursField    = cronField{name: "hour", min: 0, max: 23}
+	daysField     = cronField{name: "day of month", min: 1, max: 31}
+	monthsField   = cronField{name: "month", min: 1, max: 12, names: map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}}
+	weekdaysField = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronSchedule is a parsed cron expression. Each field is a set of bits, bit 'i' is set if the value 'i' matches.
+type cronSchedule struct {
+	seconds, minutes, hours, days, months, weekdays uint64
+	anyDay, anyWeekday                              bool // whether the day of month or day of week is '*'
+}
+
+// parseCron parses a standard cron expression: 'minute hour day-of-month month day-of-week', with an optional
+// leading seconds field. Fields can be '*', numbers or names, ranges 'a-b', steps '*/n' or 'a-b/n' and lists of these.
+// The macros '@yearly', '@monthly', '@weekly', '@daily' and '@hourly' are also supported.
+func parseCron(expression string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[strings.TrimSpace(expression)]; ok {
+		expression = macro
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) == 5 {
+		fields = append([]string{"0"}, fields...)
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("expected 5 fields, or 6 with seconds, got %d", len(fields))
+	}
+
+	schedule := &cronSchedule{anyDay: fields[3] == "*", anyWeekday: fields[5] == "*"}
+	for i, field := range []struct {
+		target *uint64
+		field  cronField
+	}{
+		{&schedule.seconds, secondsField},
+		{&schedule.minutes, minutesField},
+		{&schedule.hours, hoursField},
+		{&schedule.days, daysField},
+		{&schedule.months, monthsField},
+		{&schedule.weekdays, weekdaysField},
+	} {
+		bits, err := parseCronField(fields[i], &field.field)
+		if err != nil {
+			return nil, err
+		}
+		*field.target = bits
+	}
+
+	// 7 is also sunday
+	if schedule.weekdays&(1<<7) != 0 {
+		schedule.weekdays |= 1
+	}
+
+	return schedule, nil
+}
+
+func parseCronValue(value string, field *cronField) (int, error) {
+	if number, ok := field.names[strings.ToLower(value)]; ok {
+		return number, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < field.min || number > field.max {
+		return 0, fmt.Errorf("invalid %s '%s', must be between %d and %d", field.name, value, field.min, field.max)
+	}
+
+	return number, nil
+}
+
+func parseCronField(value string, field *cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(value, ",") {
+		rangeAndStep := strings.SplitN(part, "/", 2)
+		step := 1
+		if len(rangeAndStep) == 2 {
+			var err error
+			if step, err = strconv.Atoi(rangeAndStep[1]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step '%s' of %s", rangeAndStep[1], field.name)
+			}
+		}
+
+		from, to := field.min, field.max
+		if bounds := rangeAndStep[0]; bounds != "*" {
+			fromAndTo := strings.SplitN(bounds, "-", 2)
+			var err error
+			if from, err = parseCronValue(fromAndTo[0], field); err != nil {
+				return 0, err
+			}
+
+			to = from
+			if len(fromAndTo) == 2 {
+				if to, err = parseCronValue(fromAndTo[1], field); err != nil {
+					return 0, err
+				}
+			} else if len(rangeAndStep) == 2 {
+				to = field.max // 'a/n' starts at 'a'
+			}
+
+			if from > to {
+				return 0, fmt.Errorf("invalid range '%s' of %s", bounds, field.name)
+			}
+		}
+
+		for i := from; i <= to; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, nil
+}
+
+func hasBit(bits uint64, value int) bool {
+	return bits&(1<<uint(value)) != 0
+}
+
+// like cron, if both the day of month and day of week are restricted either can match
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	day, weekday := hasBit(c.days, t.Day()), hasBit(c.weekdays, int(t.Weekday()))
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+
+	return day || weekday
+}
+
+// next returns the first time after 'after' that matches the expression, in the location of 'after'.
+// Returns the zero time if nothing matches in the next 5 years, like for February 30th.
+// Times are matched on the wall clock: a time skipped when the clocks go forward doesn't match that day, and a time
+// repeated when they go back only matches once, in its second occurrence.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	location := after.Location()
+	t := after.Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		year, month, day := t.Date()
+		hour, minute, second := t.Clock()
+		switch {
+		case !hasBit(c.months, int(month)):
+			t = time.Date(year, month+1, 1, 0, 0, 0, 0, location)
+		case !c.matchesDay(t):
+			t = time.Date(year, month, day+1, 0, 0, 0, 0, location)
+		case !hasBit(c.hours, hour):
+			t = time.Date(year, month, day, hour+1, 0, 0, 0, location)
+		case !hasBit(c.minutes, minute):
+			t = time.Date(year, month, day, hour, minute+1, 0, 0, location)
+		case !hasBit(c.seconds, second):
+			t = time.Date(year, month, day, hour, minute, second+1, 0, location)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
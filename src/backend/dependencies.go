@@ -0,0 +1,241 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+)
+
+// DependencyCondition is what the jobs a job depends on must end as for it to run
+type DependencyCondition string
+
+const (
+	DependOnSuccess DependencyCondition = "success" // all of them finished with exit code 0
+	DependOnFailure DependencyCondition = "failure" // at least one of them didn't succeed
+	DependOnAny     DependencyCondition = "any"     // all of them ended, however they ended
+)
+
+const eventCancelled = "cancelled" // the job's dependencies can't meet their condition anymore
+
+var ErrDependencyNotFound = errors.New("a job in depends_on doesn't exist")
+
+// Dependencies are the jobs of the same user a job waits for, with the condition they must meet
+type Dependencies struct {
+	Jobs      []string            `json:"jobs,omitempty"` // IDs of the jobs, empty if the job doesn't depend on any
+	Condition DependencyCondition `json:"condition,omitempty"`
+}
+
+// returns whether the condition is met, and whether it can still be met, given the jobs that ended so far.
+// 'succeeded' has an entry for each job that ended, whether it succeeded.
+func (d *Dependencies) evaluate(succeeded map[*Job]bool) (met, possible bool) {
+	failed := false
+	for _, ok := range succeeded {
+		failed = failed || !ok
+	}
+
+	if d.Condition == DependOnSuccess && failed {
+		return false, false
+	}
+
+	if len(succeeded) < len(d.Jobs) {
+		return false, true
+	}
+
+	if d.Condition == DependOnFailure {
+		return failed, failed
+	}
+
+	return true, true
+}
+
+// whether the job ended successfully, as needed by the 'success' condition
+func (j *Job) hasSucceeded() bool {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.status == JobFinished && j.exitCode != nil && *j.exitCode == 0
+}
+
+// stopWaiting is called once the dependencies of a waiting job meet their condition, the job is then scheduled if
+// it has a start time in the future or queued otherwise. Returns false if the job isn't waiting anymore.
+func (j *Job) stopWaiting() (JobStatus, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status != JobWaiting {
+		return "", false
+	}
+
+	j.status = JobQueued
+	if j.startAt.After(time.Now()) {
+		j.status = JobScheduled
+	}
+
+	j.saveLocked()
+	return j.status, true
+}
+
+// cancelWaiting ends a waiting job whose dependencies can't meet their condition anymore
+func (j *Job) cancelWaiting(reason string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status != JobWaiting {
+		return
+	}
+
+	j.addEventLocked(eventCancelled, reason)
+	j.endJobLocked(JobCancelled)
+}
+
+// returns the jobs of the user with the IDs
+func (u *User) getDependencies(ids []string) ([]*Job, error) {
+	jobs := make([]*Job, 0, len(ids))
+	for _, id := range ids {
+		job := u.GetJob(id)
+		if job == nil {
+			return nil, fmt.Errorf("%w: %s", ErrDependencyNotFound, id)
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// waits in the background for the dependencies of a waiting job to end, and then queues or cancels it
+func (s *State) waitForDependencies(user *User, job *Job, dependencies []*Job) {
+	ended := make(chan *Job, len(dependencies))
+	for _, dependency := range dependencies {
+		go func(dependency *Job) {
+			select {
+			case <-dependency.done:
+				ended <- dependency
+			case <-job.done: // stopped by the user
+			}
+		}(dependency)
+	}
+
+	go func() {
+		succeeded := map[*Job]bool{}
+		for {
+			met, possible := job.spec.DependsOn.evaluate(succeeded)
+			if !possible {
+				job.cancelWaiting(cancelReason(&job.spec.DependsOn, succeeded))
+				return
+			}
+
+			if met {
+				break
+			}
+
+			select {
+			case dependency := <-ended:
+				succeeded[dependency] = dependency.hasSucceeded()
+			case <-job.done:
+				return
+			}
+		}
+
+		status, ok := job.stopWaiting()
+		if !ok {
+			return
+		}
+
+		if status == JobScheduled {
+			s.wheel.add(user, job, job.getStartAt())
+		} else {
+			s.submitQueued(user, job)
+		}
+	}()
+}
+
+func cancelReason(dependencies *Dependencies, succeeded map[*Job]bool) string {
+	if dependencies.Condition == DependOnFailure {
+		return "all the dependencies succeeded"
+	}
+
+	for dependency, ok := range succeeded {
+		if !ok {
+			return fmt.Sprintf("dependency %s ended as %s", dependency.GetID(), dependency.GetStatus())
+		}
+	}
+
+	return ""
+}
+
+// GetJobGraph returns the jobs connected to the job through dependencies, in both directions, ordered by creation
+// which puts every job after the jobs it depends on
+func (u *User) GetJobGraph(jobID string) (*view.JobViewGraph, error) {
+	jobs := u.GetAllJobs()
+	neighbours := map[string][]string{}
+	for _, job := range jobs {
+		for _, dependency := range job.spec.DependsOn.Jobs {
+			neighbours[job.id] = append(neighbours[job.id], dependency)
+			neighbours[dependency] = append(neighbours[dependency], job.id)
+		}
+	}
+
+	if u.GetJob(jobID) == nil {
+		return nil, ErrJobNotFound
+	}
+
+	connected := map[string]bool{jobID: true}
+	pending := []string{jobID}
+	for len(pending) != 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for _, neighbour := range neighbours[id] {
+			if !connected[neighbour] {
+				connected[neighbour] = true
+				pending = append(pending, neighbour)
+			}
+		}
+	}
+
+	graph := &view.JobViewGraph{Nodes: []view.JobViewGraphNode{}, Edges: []view.JobViewGraphEdge{}}
+	for _, job := range jobs {
+		if !connected[job.id] {
+			continue
+		}
+
+		jobView := job.AsPartialView()
+		graph.Nodes = append(graph.Nodes, view.JobViewGraphNode{
+			ID:        jobView.ID,
+			Status:    jobView.Status,
+			Command:   jobView.Command,
+			CreatedAt: jobView.CreatedAt,
+			DependsOn: jobView.DependsOn,
+		})
+
+		for _, dependency := range job.spec.DependsOn.Jobs {
+			// purged jobs aren't in the graph anymore
+			if u.GetJob(dependency) != nil {
+				graph.Edges = append(graph.Edges, view.JobViewGraphEdge{From: dependency, To: job.id})
+			}
+		}
+	}
+
+	sort.Slice(graph.Nodes, func(i, k int) bool { return graph.Nodes[i].CreatedAt.Before(graph.Nodes[k].CreatedAt) })
+	sort.Slice(graph.Edges, func(i, k int) bool {
+		return graph.Edges[i].From < graph.Edges[k].From || (graph.Edges[i].From == graph.Edges[k].From && graph.Edges[i].To < graph.Edges[k].To)
+	})
+
+	return graph, nil
+}
+
+// restores the waiting of a job loaded from the store, it's cancelled if any of its dependencies was removed
+func (s *State) restoreDependencies(user *User, job *Job) {
+	dependencies, err := user.getDependencies(job.spec.DependsOn.Jobs)
+	if err != nil {
+		log.Printf("Cancelling job %s, because: %s", job.GetID(), err)
+		job.cancelWaiting(err.Error())
+		return
+	}
+
+	s.waitForDependencies(user, job, dependencies)
+}
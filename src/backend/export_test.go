@@ -0,0 +1,13 @@
+package backend
+
+import "time"
+
+// NextCronRun returns the first time after 'after' that matches the cron expression, see 'cronSchedule.next'
+func NextCronRun(expression string, after time.Time) (time.Time, error) {
+	cron, err := parseCron(expression)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return cron.next(after), nil
+}
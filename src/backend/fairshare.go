@@ -0,0 +1,148 @@
+package backend
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+)
+
+// SchedulingPolicy is the order in which the queued jobs of the same priority are started
+type SchedulingPolicy string
+
+const (
+	PolicyFIFO      SchedulingPolicy = "fifo"      // in the order they were submitted
+	PolicyFairShare SchedulingPolicy = "fairshare" // the jobs of the user using the least of their share first
+)
+
+// queuePolicy picks the queued job started next, it's plugged into the scheduler
+type queuePolicy interface {
+	// returns the index of the job started next among 'candidates', which can all start, have the same priority
+	// and are in submission order
+	pick(s *scheduler, candidates []*queuedJob) int
+}
+
+type fifoPolicy struct{}
+
+func (fifoPolicy) pick(s *scheduler, candidates []*queuedJob) int {
+	return 0
+}
+
+// fairSharePolicy starts the jobs of the user with the lowest load first, see 'scheduler.loadLocked'. Starting a job
+// raises the load of its user, so the slots are spread across the users with queued jobs in proportion to their shares.
+type fairSharePolicy struct{}
+
+func (fairSharePolicy) pick(s *scheduler, candidates []*queuedJob) int {
+	now := time.Now()
+	loads := map[*User]float64{}
+
+	next := 0
+	for i, queued := range candidates {
+		load, ok := loads[queued.user]
+		if !ok {
+			load = s.loadLocked(queued.user, now)
+			loads[queued.user] = load
+		}
+
+		// the first job of the user with the lowest load
+		if load < loads[candidates[next].user] {
+			next = i
+		}
+	}
+
+	return next
+}
+
+func newQueuePolicy(policy SchedulingPolicy) queuePolicy {
+	if policy == PolicyFairShare {
+		return fairSharePolicy{}
+	}
+
+	return fifoPolicy{}
+}
+
+// cpuUsage is the CPU time used by the jobs of a user, decayed exponentially so that recent usage weighs the most
+type cpuUsage struct {
+	seconds float64   // decayed CPU seconds at 'at'
+	at      time.Time // when the usage was last charged
+}
+
+func decay(seconds float64, elapsed, halfLife time.Duration) float64 {
+	return seconds * math.Exp2(-elapsed.Seconds()/halfLife.Seconds())
+}
+
+// charge records the CPU time used by a job of the user once it ends
+func (s *scheduler) charge(username string, cpu time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	usage := s.usage[username]
+	s.usage[username] = cpuUsage{seconds: decay(usage.seconds, now.Sub(usage.at), s.halfLife) + cpu.Seconds(), at: now}
+}
+
+func (s *scheduler) recentCPULocked(username string, now time.Time) float64 {
+	usage, ok := s.usage[username]
+	if !ok {
+		return 0
+	}
+
+	return decay(usage.seconds, now.Sub(usage.at), s.halfLife)
+}
+
+// returns the load of the user relative to their shares: the slots they're using plus the CPUs they used on average
+// over the last half-life, divided by their shares
+func (s *scheduler) loadLocked(user *User, now time.Time) float64 {
+	used := float64(s.runningPerUser[user.username]) + s.recentCPULocked(user.username, now)/s.halfLife.Seconds()
+	return used / float64(user.getShares())
+}
+
+// view returns the scheduler's state with the share, usage and queue depth of each of the users
+func (s *scheduler) view(users []*User) view.SchedulerView {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	queuedPerUser := map[string]int{}
+	queued := 0
+	for _, job := range s.queue {
+		if status := job.job.GetStatus(); status == JobQueued || status == JobSuspended {
+			queuedPerUser[job.user.username]++
+			queued++
+		}
+	}
+
+	totalShares := 0
+	for _, user := range users {
+		totalShares += user.getShares()
+	}
+
+	now := time.Now()
+	schedulerView := view.SchedulerView{
+		Policy:            string(s.policyName),
+		MaxRunning:        s.maxRunning,
+		MaxRunningPerUser: s.maxRunningPerUser,
+		Running:           len(s.running),
+		Queued:            queued,
+		Users:             make([]view.SchedulerViewUser, 0, len(users)),
+	}
+
+	for _, user := range users {
+		schedulerView.Users = append(schedulerView.Users, view.SchedulerViewUser{
+			Username:   user.username,
+			Shares:     user.getShares(),
+			Share:      float64(user.getShares()) / float64(totalShares),
+			Running:    s.runningPerUser[user.username],
+			Queued:     queuedPerUser[user.username],
+			CPUSeconds: s.recentCPULocked(user.username, now),
+			Load:       s.loadLocked(user, now),
+			Removed:    user.IsRemoved(),
+		})
+	}
+
+	sort.Slice(schedulerView.Users, func(i, k int) bool {
+		return schedulerView.Users[i].Username < schedulerView.Users[k].Username
+	})
+
+	return schedulerView
+}
@@ -1,46 +1,241 @@
 package backend
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"os"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/Ross65536/job-scheduler/src/core/view"
-	"github.com/google/uuid"
+	"github.com/creack/pty"
 )
 
 type JobStatus string
 
 const (
-	JobRunning  JobStatus = "RUNNING"
-	JobFinished JobStatus = "FINISHED"
-	JobStopped  JobStatus = "STOPPED"
-	JobStopping JobStatus = "STOPPING"
-	JobKilled   JobStatus = "KILLED"
+	JobWaiting   JobStatus = "WAITING"   // waiting for the jobs it depends on to end, see 'Dependencies'
+	JobScheduled JobStatus = "SCHEDULED" // waiting for its start time to be queued, see 'timerWheel'
+	JobQueued    JobStatus = "QUEUED"    // waiting for a free slot to start, see 'scheduler'
+	JobRunning   JobStatus = "RUNNING"
+	JobSuspended JobStatus = "SUSPENDED" // paused with SIGSTOP to give its slot to a job with a higher priority
+	JobFinished  JobStatus = "FINISHED"
+	JobStopped   JobStatus = "STOPPED"
+	JobStopping  JobStatus = "STOPPING"
+	JobKilled    JobStatus = "KILLED"
+	JobTimedOut  JobStatus = "TIMED_OUT"
+	JobLost      JobStatus = "LOST"      // the server stopped while the job was running, and its process wasn't found after the restart
+	JobCancelled JobStatus = "CANCELLED" // ended while waiting, because the condition on the jobs it depends on can't be met anymore
 )
 
+// events of the job's history
+const (
+	eventSuspended = "suspended" // preempted by suspending the job
+	eventResumed   = "resumed"
+	eventPreempted = "preempted" // preempted by stopping the job, it's requeued once it ends
+	eventRequeued  = "requeued"
+)
+
+// JobEvent is an entry of the job's history, a scheduling decision that affected the job
+type JobEvent struct {
+	At      time.Time `json:"at"`
+	Event   string    `json:"event"`
+	Message string    `json:"message,omitempty"`
+}
+
+var (
+	ErrStdinClosed = errors.New("job doesn't have an open stdin")
+	ErrStdinInUse  = errors.New("another session is writing the job's stdin")
+	ErrNoTerminal  = errors.New("job doesn't have a terminal")
+	ErrJobRunning  = errors.New("job is still running")
+)
+
+const eofCharacter = 4 // ^D, ends the input of a terminal
+
+// names of the signals that can be used to stop a job
+var stopSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// JobSpec is a validated job creation request, with the server defaults applied
+type JobSpec struct {
+	Command         []string           `json:"command"`               // command name + argv, NOT EMPTY
+	Limits          view.JobViewLimits `json:"limits"`                // resource limits to apply to the job
+	StopSignal      string             `json:"stop_signal"`           // name of the signal sent first when stopping the job, key of 'stopSignals'
+	StopGracePeriod time.Duration      `json:"stop_grace_period"`     // time to wait after the stop signal before sending SIGKILL
+	Interactive     bool               `json:"interactive,omitempty"` // stdin is kept open to be written by an attach session
+	TTY             bool               `json:"tty,omitempty"`         // the job runs in a pseudo-terminal, its combined output is in stdout
+	Stdin           []byte             `json:"stdin,omitempty"`       // written to the process' stdin when it starts, which is then closed unless interactive
+	Env             map[string]string  `json:"env,omitempty"`         // complete environment of the process, NOT EMPTY
+	WorkingDir      string             `json:"working_dir"`           // absolute path the process runs in, NOT EMPTY
+	Timeout         time.Duration      `json:"timeout,omitempty"`     // the job is stopped if it runs for longer than this, no timeout if 0
+	Priority        int                `json:"priority,omitempty"`    // jobs with a higher priority are started first, and can preempt lower ones
+	StartAt         time.Time          `json:"start_at,omitempty"`    // the job is only queued once this time is reached, right away if zero
+	Retry           RetryPolicy        `json:"retry"`                 // runs the job again when it fails
+	DependsOn       Dependencies       `json:"depends_on"`            // the job waits for these jobs to end, and only runs if they meet the condition
+	Array           *ArraySpec         `json:"-"`                     // creates a job for each index instead, nil for a single job. Only used on creation
+}
+
+// the durations are persisted as strings such as "1m30s", see 'time.ParseDuration'
+func (s JobSpec) MarshalJSON() ([]byte, error) {
+	type plain JobSpec
+	return json.Marshal(struct {
+		plain
+		StopGracePeriod string `json:"stop_grace_period"`
+		Timeout         string `json:"timeout,omitempty"`
+	}{plain(s), s.StopGracePeriod.String(), formatOptionalDuration(s.Timeout)})
+}
+
+func (s *JobSpec) UnmarshalJSON(data []byte) error {
+	type plain JobSpec
+	decoded := struct {
+		*plain
+		StopGracePeriod string `json:"stop_grace_period"`
+		Timeout         string `json:"timeout,omitempty"`
+	}{plain: (*plain)(s)}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	var err error
+	if s.StopGracePeriod, err = parseOptionalDuration(decoded.StopGracePeriod); err != nil {
+		return err
+	}
+
+	s.Timeout, err = parseOptionalDuration(decoded.Timeout)
+	return err
+}
+
+// formats a duration to be persisted, empty if 0
+func formatOptionalDuration(duration time.Duration) string {
+	if duration == 0 {
+		return ""
+	}
+
+	return duration.String()
+}
+
+// parses a duration persisted as a string, 0 if empty
+func parseOptionalDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
 type Job struct {
-	lock      sync.RWMutex // synchronizes access to all of the fields of the struct
-	id        string       // ID exposed to the client (UUID), NOT EMPTY, UNIQUE
-	proc      *os.Process
-	command   []string  // command name + argv, NOT EMPTY
-	status    JobStatus // status of job, NOT EMPTY
-	stdout    []byte    // process stdout
-	stderr    []byte    // process stderr
-	exitCode  *int      // process exit code
-	createdAt time.Time // time when job started, NOT EMPTY
-	stoppedAt time.Time // time when job is stopped, killed or has finished
-}
-
-func CreateJob(command []string, proc *os.Process) *Job {
-	return &Job{
-		id:        uuid.NewString(),
-		proc:      proc,
-		command:   command,
-		status:    JobRunning,
+	lock         sync.RWMutex   // synchronizes access to all of the fields of the struct
+	id           string         // ID exposed to the client (UUID), NOT EMPTY, UNIQUE
+	owner        string         // username of the user the job belongs to
+	store        JobStore       // where the job's record is saved, nil if it isn't persisted
+	proc         *os.Process    // nil while the job is queued
+	processStart uint64         // start time of the process, see JobRecord
+	spec         *JobSpec       // how the job was requested, not modified after creation, NOT EMPTY
+	cgroup       *jobCgroup     // cgroup of the job, nil if no limits are applied
+	killTimer    *time.Timer    // sends SIGKILL when the stop grace period runs out, nil if not stopping
+	timer        *time.Timer    // stops the job when the timeout runs out, nil if the job has no timeout or ended
+	timedOut     bool           // whether the job is being stopped because it ran out of time
+	requeue      bool           // whether the job is being stopped to be queued again, after being preempted
+	status       JobStatus      // status of job, NOT EMPTY
+	output       jobOutput      // process stdout and stderr
+	stdin        io.WriteCloser // process stdin, nil if the job isn't interactive or stdin was closed
+	stdinUsed    bool           // whether an attach session is writing stdin, only one can at a time
+	terminal     *os.File       // master side of the job's pseudo-terminal, nil if not a TTY job or the job ended
+	exitCode     *int           // process exit code
+	createdAt    time.Time      // time when job was submitted, NOT EMPTY
+	startedAt    time.Time      // time when the process started, zero while queued
+	stoppedAt    time.Time      // time when job is stopped, killed or has finished
+	history      []JobEvent     // scheduling events, like preemptions
+	scheduleID   string         // schedule that started the job, empty if started by the user
+	arrayID      string         // job array the job belongs to, empty if created on its own
+	arrayIndex   int            // index of the job in its array
+	startAt      time.Time      // when a scheduled job is queued, the spec's start time or the time of the next attempt
+	attempts     []JobAttempt   // previous attempts of a retried job, the current one isn't included
+	done         chan struct{}  // closed once the job ended
+}
+
+// CreateJob creates a job of the 'owner' user that is queued until its process is started, scheduled until its
+// start time if it's in the future, or waiting if it depends on other jobs
+func CreateJob(id, owner string, spec *JobSpec, limits outputLimits) *Job {
+	job := &Job{
+		id:        id,
+		owner:     owner,
+		spec:      spec,
+		output:    emptyJobOutput(limits),
+		status:    JobQueued,
 		createdAt: time.Now(),
+		startAt:   spec.StartAt,
+		done:      make(chan struct{}),
+	}
+
+	if len(spec.DependsOn.Jobs) != 0 {
+		job.status = JobWaiting
+	} else if spec.StartAt.After(job.createdAt) {
+		job.status = JobScheduled
+	}
+
+	return job
+}
+
+// start marks a queued job as running with its started process, the timeout counts from now
+func (j *Job) start(proc *os.Process, processStart uint64, cgroup *jobCgroup, stdin io.WriteCloser, terminal *os.File, output jobOutput) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.proc, j.processStart, j.cgroup = proc, processStart, cgroup
+	j.stdin, j.terminal = stdin, terminal
+	// the spec's stdin is written to an open stdin first, attach sessions can only write it once that's done
+	j.stdinUsed = stdin != nil && len(j.spec.Stdin) != 0
+
+	// readers following the empty output of the queued job continue with the process' output
+	queuedOutput := j.output
+	j.output = output
+	queuedOutput.notify()
+
+	j.status = JobRunning
+	j.startedAt = time.Now()
+	if j.spec.Timeout != 0 {
+		j.timer = time.AfterFunc(j.spec.Timeout, j.stopAfterTimeout)
+	}
+
+	j.saveLocked()
+}
+
+// cancel ends a waiting, scheduled or queued job without starting it, returns false if the job is none of them
+func (j *Job) cancel() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if !j.isWaitingLocked() {
+		return false
+	}
+
+	j.endJobLocked(JobStopped)
+	return true
+}
+
+// promote queues a scheduled job once its start time is reached, returns false if it isn't scheduled anymore
+func (j *Job) promote() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status != JobScheduled {
+		return false
 	}
+
+	j.status = JobQueued
+	j.saveLocked()
+	return true
 }
 
 func (j *Job) GetID() string {
@@ -50,37 +245,303 @@ func (j *Job) GetID() string {
 	return j.id
 }
 
+func (j *Job) GetStatus() JobStatus {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.status
+}
+
+// returns when a scheduled job is queued
+func (j *Job) getStartAt() time.Time {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.startAt
+}
+
+func (j *Job) getStartedAt() time.Time {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.startedAt
+}
+
+// returns when the job ended, and false if it's still executing
+func (j *Job) getEndedAt() (time.Time, bool) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	return j.stoppedAt, j.hasEndedLocked()
+}
+
 func (j *Job) UpdateStdout(bytes []byte) {
 	j.lock.Lock()
 	defer j.lock.Unlock()
 
-	j.stdout = append(j.stdout, bytes...)
+	j.output.write(StdoutStream, bytes)
 }
 
 func (j *Job) UpdateStderr(bytes []byte) {
 	j.lock.Lock()
 	defer j.lock.Unlock()
 
-	j.stderr = append(j.stderr, bytes...)
+	j.output.write(StderrStream, bytes)
+}
+
+func (j *Job) removeCgroup() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.cgroup == nil {
+		return
+	}
+
+	if err := j.cgroup.remove(); err != nil {
+		log.Printf("Failed to remove cgroup of job %s: %s", j.id, err)
+	}
+	j.cgroup = nil
+}
+
+// ReadOutput returns the kept output of 'stream' starting at 'offset', the offset to continue reading from,
+// whether more output can still arrive and a channel that is closed when there is new output to read.
+func (j *Job) ReadOutput(stream OutputStream, offset int) ([]byte, int, bool, <-chan struct{}) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	output, next := j.output.read(stream, offset)
+	return output, next, !j.hasEndedLocked(), j.output.updated
+}
+
+// AcquireStdin gives the caller exclusive access to write the job's stdin, until ReleaseStdin is called
+func (j *Job) AcquireStdin() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.stdin == nil || !j.isExecutingLocked() {
+		return ErrStdinClosed
+	}
+
+	if j.stdinUsed {
+		return ErrStdinInUse
+	}
+
+	j.stdinUsed = true
+	return nil
 }
 
+func (j *Job) ReleaseStdin() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.stdinUsed = false
+}
+
+func (j *Job) WriteStdin(bytes []byte) error {
+	j.lock.RLock()
+	stdin := j.stdin
+	j.lock.RUnlock()
+
+	if stdin == nil {
+		return ErrStdinClosed
+	}
+
+	// not holding the lock, the write blocks until the process reads it
+	_, err := stdin.Write(bytes)
+	return err
+}
+
+func (j *Job) CloseStdin() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.stdin == nil {
+		return nil
+	}
+
+	if j.terminal != nil {
+		// closing the terminal would hang up the job, the EOF character is sent instead
+		_, err := j.terminal.Write([]byte{eofCharacter})
+		return err
+	}
+
+	stdin := j.stdin
+	j.stdin = nil
+	return stdin.Close()
+}
+
+// ResizeTerminal changes the window size of the job's pseudo-terminal
+func (j *Job) ResizeTerminal(rows, cols uint16) error {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	if j.terminal == nil {
+		return ErrNoTerminal
+	}
+
+	return pty.Setsize(j.terminal, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+func (j *Job) closeTerminal() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.terminal == nil {
+		return
+	}
+
+	j.terminal.Close()
+	j.terminal = nil
+	j.stdin = nil
+}
+
+// whether the job's process is running, or suspended
 func (j *Job) isExecutingLocked() bool {
-	return j.status == JobRunning || j.status == JobStopping
+	return j.status == JobRunning || j.status == JobStopping || j.status == JobSuspended
+}
+
+// whether the job is waiting to be started, without a process yet
+func (j *Job) isWaitingLocked() bool {
+	return j.status == JobQueued || j.status == JobScheduled || j.status == JobWaiting
+}
+
+// whether the job has ended, waiting jobs haven't
+func (j *Job) hasEndedLocked() bool {
+	return !j.isWaitingLocked() && !j.isExecutingLocked()
 }
 
 func (j *Job) endJobLocked(status JobStatus) {
 	j.status = status
 	j.stoppedAt = time.Now()
+	select {
+	case <-j.done:
+	default:
+		close(j.done)
+	}
+	j.output.close()
+	j.output.notify()
+
+	if j.killTimer != nil {
+		j.killTimer.Stop()
+		j.killTimer = nil
+	}
+
+	if j.timer != nil {
+		j.timer.Stop()
+		j.timer = nil
+	}
+
+	j.saveLocked()
+}
+
+func (j *Job) addEventLocked(event, message string) {
+	j.history = append(j.history, JobEvent{At: time.Now(), Event: event, Message: message})
+}
+
+// resets the job to wait with 'status' after its process ended, to start from scratch with a new output
+func (j *Job) resetLocked(status JobStatus) {
+	if j.killTimer != nil {
+		j.killTimer.Stop()
+		j.killTimer = nil
+	}
+
+	if j.timer != nil {
+		j.timer.Stop()
+		j.timer = nil
+	}
+
+	if j.stdin != nil && j.terminal == nil {
+		j.stdin.Close()
+	}
+	j.stdin = nil
+
+	previousOutput := j.output
+	previousOutput.close()
+	previousOutput.release()
+	j.output = emptyJobOutput(previousOutput.limits)
+	previousOutput.notify()
+
+	j.proc, j.processStart, j.exitCode = nil, 0, nil
+	j.status, j.startedAt = status, time.Time{}
+}
+
+// queues the job again after its process was stopped by a preemption
+func (j *Job) requeueLocked() {
+	j.resetLocked(JobQueued)
+	j.requeue = false
+	j.addEventLocked(eventRequeued, "")
+	j.saveLocked()
+}
+
+// persistTo saves the job's record in 'store' now and whenever its status changes
+func (j *Job) persistTo(store JobStore) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.store = store
+	j.saveLocked()
+}
+
+func (j *Job) saveLocked() {
+	if j.store == nil {
+		return
+	}
+
+	if err := j.store.Save(j.recordLocked()); err != nil {
+		log.Printf("Failed to save job %s: %s", j.id, err)
+	}
+}
+
+func (j *Job) recordLocked() *JobRecord {
+	record := &JobRecord{
+		ID:           j.id,
+		Username:     j.owner,
+		Spec:         *j.spec,
+		Status:       j.status,
+		TimedOut:     j.timedOut,
+		ExitCode:     j.exitCode,
+		CreatedAt:    j.createdAt,
+		StartedAt:    j.startedAt,
+		StoppedAt:    j.stoppedAt,
+		ProcessStart: j.processStart,
+		Output:       j.output.record(),
+		Requeue:      j.requeue,
+		History:      append([]JobEvent(nil), j.history...),
+		ScheduleID:   j.scheduleID,
+		ArrayID:      j.arrayID,
+		ArrayIndex:   j.arrayIndex,
+		StartAt:      j.startAt,
+		Attempts:     append([]JobAttempt(nil), j.attempts...),
+	}
+
+	if j.proc != nil {
+		record.PID = j.proc.Pid
+	}
+
+	// the stdin is still needed to start a queued job after a restart, and the env to run it again
+	if !j.isWaitingLocked() {
+		record.Spec.Stdin = nil
+	}
+
+	if j.hasEndedLocked() {
+		record.Spec.Env = nil
+	}
+
+	return record
 }
 
 func (j *Job) MarkAsStopped() {
 	j.lock.Lock()
 	defer j.lock.Unlock()
 
-	if j.status == JobStopping {
-		j.endJobLocked(JobStopped)
+	if j.requeue && !j.timedOut {
+		j.requeueLocked()
+	} else if j.timedOut {
+		j.endAttemptLocked(JobTimedOut)
+	} else if j.status == JobStopping {
+		j.endAttemptLocked(JobStopped)
 	} else {
-		j.endJobLocked(JobKilled)
+		j.endAttemptLocked(JobKilled)
 	}
 }
 
@@ -95,53 +556,318 @@ func (j *Job) MarkAsFinished(exitCode int) {
 	j.lock.Lock()
 	defer j.lock.Unlock()
 
-	j.endJobLocked(JobFinished)
+	// a job can handle the stop signal and exit by itself, it still ran out of time or was preempted
+	if j.requeue && !j.timedOut {
+		j.requeueLocked()
+		return
+	}
+
 	j.exitCode = &exitCode
+	if j.timedOut {
+		j.endAttemptLocked(JobTimedOut)
+	} else {
+		j.endAttemptLocked(JobFinished)
+	}
+}
+
+// signals every process of the job, not just the direct child
+func (j *Job) signalLocked(signal syscall.Signal) error {
+	if signal == syscall.SIGKILL && j.cgroup != nil {
+		// also reaches descendants that left the process group
+		if err := j.cgroup.kill(); err == nil {
+			return nil
+		}
+	}
+
+	// the job leads its own process group, a negative PID signals the whole group. The group can exit before the job
+	// is marked as ended, there's nothing left to signal then.
+	if err := syscall.Kill(-j.proc.Pid, signal); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+
+	return nil
 }
 
-func (j *Job) StopJob() error {
+// StopJob sends the stop signal to the job and SIGKILL once the grace period runs out.
+// SIGKILL is sent immediately if 'force' is set or the job is already stopping.
+func (j *Job) StopJob(force bool) error {
 	j.lock.Lock()
 	defer j.lock.Unlock()
 
+	// stopped by the user, it's no longer queued again if it was being preempted
+	j.requeue = false
+	return j.stopLocked(force)
+}
+
+func (j *Job) stopLocked(force bool) error {
 	if !j.isExecutingLocked() {
 		return nil
 	}
 
-	var signal os.Signal = syscall.SIGTERM
-	if j.status == JobStopping {
-		signal = os.Kill
+	if force || j.status == JobStopping {
+		if err := j.signalLocked(syscall.SIGKILL); err != nil {
+			return err
+		}
+
+		// already killed, there's no grace period left to wait for
+		if j.killTimer != nil {
+			j.killTimer.Stop()
+			j.killTimer = nil
+		}
+
+		j.status = JobStopping
+		j.saveLocked()
+		return nil
 	}
 
-	if err := j.proc.Signal(signal); err != nil {
+	if err := j.signalLocked(stopSignals[j.spec.StopSignal]); err != nil {
 		return err
 	}
 
-	if j.status == JobRunning {
-		j.status = JobStopping
+	// a suspended job must be continued to handle the stop signal
+	if j.status == JobSuspended {
+		if err := j.signalLocked(syscall.SIGCONT); err != nil {
+			return err
+		}
 	}
 
+	j.status = JobStopping
+	j.killTimer = time.AfterFunc(j.spec.StopGracePeriod, j.killAfterGracePeriod)
+	j.saveLocked()
+
 	return nil
 }
 
-func (j *Job) AsView() view.JobViewFull {
+func (j *Job) killAfterGracePeriod() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status != JobStopping {
+		return
+	}
+
+	if err := j.signalLocked(syscall.SIGKILL); err != nil {
+		log.Printf("Failed to kill job %s after the grace period: %s", j.id, err)
+	}
+}
+
+// stops the job with the normal stop sequence, unless it's already being stopped by the user
+func (j *Job) stopAfterTimeout() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status != JobRunning && j.status != JobSuspended {
+		return
+	}
+
+	j.timedOut = true
+	if err := j.stopLocked(false); err != nil {
+		log.Printf("Failed to stop job %s after the timeout: %s", j.id, err)
+	}
+}
+
+// suspend pauses the job's processes to free its slot for the job 'by', which has a higher priority
+func (j *Job) suspend(by string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status != JobRunning {
+		return fmt.Errorf("job %s isn't running", j.id)
+	}
+
+	if err := j.signalLocked(syscall.SIGSTOP); err != nil {
+		return err
+	}
+
+	j.status = JobSuspended
+	j.addEventLocked(eventSuspended, "preempted by job "+by)
+	j.saveLocked()
+	return nil
+}
+
+// resume continues a suspended job once it has a slot again
+func (j *Job) resume() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status != JobSuspended {
+		return fmt.Errorf("job %s isn't suspended", j.id)
+	}
+
+	if err := j.signalLocked(syscall.SIGCONT); err != nil {
+		return err
+	}
+
+	j.status = JobRunning
+	j.addEventLocked(eventResumed, "")
+	j.saveLocked()
+	return nil
+}
+
+// preempt stops the job to free its slot for the job 'by', which has a higher priority. The job is queued again
+// once it ends, unless it's stopped by the user or runs out of time in the meantime.
+func (j *Job) preempt(by string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status != JobRunning {
+		return fmt.Errorf("job %s isn't running", j.id)
+	}
+
+	if err := j.stopLocked(false); err != nil {
+		return err
+	}
+
+	j.requeue = true
+	j.addEventLocked(eventPreempted, "stopped to be requeued, for job "+by)
+	j.saveLocked()
+	return nil
+}
+
+func outputSizeView(total, dropped int) view.JobViewOutputSize {
+	return view.JobViewOutputSize{
+		Total:     int64(total),
+		Dropped:   int64(dropped),
+		Truncated: dropped != 0,
+	}
+}
+
+// deletes the record and the output of a job that ended, including its log files
+func (j *Job) delete() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if !j.hasEndedLocked() {
+		return ErrJobRunning
+	}
+
+	if j.store != nil {
+		if err := j.store.Delete(j.id); err != nil {
+			return err
+		}
+	}
+
+	j.output.release()
+	j.output.limits.budget.release(j.attemptsOutputSizeLocked())
+	j.removeAttemptLogsLocked()
+	j.attempts = nil
+	return nil
+}
+
+// view of the spec of a job, without the stdin which is only used on creation
+func jobSpecView(spec *JobSpec) view.JobViewCommand {
+	commandDup := make([]string, len(spec.Command))
+	copy(commandDup, spec.Command)
+
+	envDup := make(map[string]string, len(spec.Env))
+	for key, value := range spec.Env {
+		envDup[key] = value
+	}
+
+	command := view.JobViewCommand{
+		Command:         commandDup,
+		StopSignal:      spec.StopSignal,
+		StopGracePeriod: spec.StopGracePeriod.String(),
+		Interactive:     spec.Interactive,
+		TTY:             spec.TTY,
+		Env:             envDup,
+		WorkingDir:      spec.WorkingDir,
+		Priority:        spec.Priority,
+		JobViewLimits:   spec.Limits,
+	}
+
+	if spec.Timeout != 0 {
+		command.Timeout = spec.Timeout.String()
+	}
+
+	if !spec.StartAt.IsZero() {
+		startAt := spec.StartAt
+		command.StartAt = &startAt
+	}
+
+	if dependencies := spec.DependsOn; len(dependencies.Jobs) != 0 {
+		command.DependsOn = &view.JobViewDependencies{
+			Jobs:      append([]string(nil), dependencies.Jobs...),
+			Condition: string(dependencies.Condition),
+		}
+	}
+
+	if retry := spec.Retry; retry.MaxAttempts != 0 {
+		command.Retry = &view.JobViewRetry{
+			MaxAttempts: retry.MaxAttempts,
+			Backoff:     retry.Backoff.String(),
+			MaxBackoff:  retry.MaxBackoff.String(),
+			ExitCodes:   append([]int(nil), retry.ExitCodes...),
+		}
+
+		for _, status := range retry.Statuses {
+			command.Retry.Statuses = append(command.Retry.Statuses, string(status))
+		}
+	}
+
+	return command
+}
+
+// AsPartialView returns the job without its output, which is read from the log files when there are any
+func (j *Job) AsPartialView() view.JobViewPartial {
 	j.lock.RLock()
 	defer j.lock.RUnlock()
 
-	commandDup := make([]string, len(j.command))
-	copy(commandDup, j.command)
+	return j.partialViewLocked()
+}
+
+func (j *Job) partialViewLocked() view.JobViewPartial {
+	m := view.JobViewPartial{
+		JobViewCommand: jobSpecView(j.spec),
+		ID:             j.id,
+		Status:         string(j.status),
+		CreatedAt:      j.createdAt,
+		ScheduleID:     j.scheduleID,
+		ArrayID:        j.arrayID,
+	}
+
+	if j.arrayID != "" {
+		index := j.arrayIndex
+		m.ArrayIndex = &index
+	}
+
+	if !j.startAt.IsZero() {
+		startAt := j.startAt
+		m.StartAt = &startAt
+	}
+
+	return m
+}
+
+func (j *Job) AsView() view.JobViewFull {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
 
 	m := view.JobViewFull{
-		JobViewPartial: view.JobViewPartial{
-			JobViewCommand: view.JobViewCommand{
-				Command: commandDup,
-			},
-			ID:        j.id,
-			Status:    string(j.status),
-			CreatedAt: j.createdAt,
-		},
-		Stdout:   string(j.stdout),
-		Stderr:   string(j.stderr),
-		ExitCode: j.exitCode,
+		JobViewPartial: j.partialViewLocked(),
+		ExitCode:       j.exitCode,
+	}
+
+	stdout, stdoutDropped := j.output.snapshot(StdoutStream)
+	stderr, stderrDropped := j.output.snapshot(StderrStream)
+	m.Stdout, m.StdoutSize = string(stdout), outputSizeView(j.output.stdout.total, stdoutDropped)
+	m.Stderr, m.StderrSize = string(stderr), outputSizeView(j.output.stderr.total, stderrDropped)
+
+	if j.spec.Retry.MaxAttempts > 1 {
+		m.Attempt = len(j.attempts) + 1
+	}
+
+	for i := range j.attempts {
+		m.Attempts = append(m.Attempts, attemptView(i+1, &j.attempts[i]))
+	}
+
+	for _, event := range j.history {
+		m.History = append(m.History, view.JobViewEvent{At: event.At, Event: event.Event, Message: event.Message})
+	}
+
+	if !j.startedAt.IsZero() {
+		copy := j.startedAt
+		m.StartedAt = &copy
 	}
 
 	if !j.stoppedAt.IsZero() {
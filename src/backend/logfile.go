@@ -0,0 +1,236 @@
+package backend
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	logWindowSize           = 64 << 10 // bytes of each stream kept in memory when the output is written to log files
+	maxLogReadSize          = 1 << 20  // maximum bytes returned by a single read of the log files
+	indexRecordSize         = 9        // stream (1 byte) + length (8 bytes)
+	indexCheckpointInterval = 1024     // records of the index between checkpoints, also how many are read at once
+)
+
+// outputLogs appends the output of a job to files in the log directory: one per stream and an index with the order
+// in which the bytes of the streams were written, to read them interleaved. The files are only open while the job runs,
+// reads open them again so that finished jobs don't hold file descriptors.
+type outputLogs struct {
+	path      string // path of the log files without the extension, '<log dir>/<job id>'
+	stdout    *os.File
+	stderr    *os.File
+	index     *os.File
+	last      outputSegment // last record of the index, extended while the same stream is written
+	lastIndex int64         // offset of the last record in the index, -1 if the index is empty
+
+	checkpointsLock sync.Mutex        // interleaved reads can run at the same time
+	checkpoints     []indexCheckpoint // one every indexCheckpointInterval records, added as the index is read
+}
+
+// where a record of the index starts, in the interleaved output and in the file of each stream. Interleaved reads
+// start from the last checkpoint before their offset, instead of from the first record.
+type indexCheckpoint struct {
+	position int
+	stdout   int
+	stderr   int
+}
+
+func createOutputLogs(dir, id string) (*outputLogs, error) {
+	logs := &outputLogs{path: filepath.Join(dir, id), lastIndex: -1}
+
+	var err error
+	for _, file := range []struct {
+		target    **os.File
+		extension string
+	}{{&logs.stdout, ".stdout"}, {&logs.stderr, ".stderr"}, {&logs.index, ".index"}} {
+		if *file.target, err = os.OpenFile(logs.path+file.extension, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600); err != nil {
+			logs.close()
+			logs.remove()
+			return nil, err
+		}
+	}
+
+	return logs, nil
+}
+
+func (l *outputLogs) streamPath(stream OutputStream) string {
+	return l.path + "." + string(stream)
+}
+
+func (l *outputLogs) write(stream OutputStream, bytes []byte) error {
+	file := l.stdout
+	if stream == StderrStream {
+		file = l.stderr
+	}
+
+	if file == nil {
+		return errors.New("log files are closed")
+	}
+
+	if _, err := file.Write(bytes); err != nil {
+		return err
+	}
+
+	// consecutive writes to the same stream are merged by rewriting the last record, keeps the index small
+	if l.lastIndex < 0 || l.last.stream != stream {
+		l.lastIndex++
+		l.last = outputSegment{stream: stream}
+	}
+	l.last.length += len(bytes)
+
+	record := make([]byte, indexRecordSize)
+	if stream == StderrStream {
+		record[0] = 1
+	}
+	binary.LittleEndian.PutUint64(record[1:], uint64(l.last.length))
+
+	_, err := l.index.WriteAt(record, l.lastIndex*indexRecordSize)
+	return err
+}
+
+// reads the bytes of 'stream' from 'from' to 'to'
+func (l *outputLogs) readStream(stream OutputStream, from, to int) ([]byte, error) {
+	file, err := os.Open(l.streamPath(stream))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readFileRange(file, from, to)
+}
+
+func readFileRange(file *os.File, from, to int) ([]byte, error) {
+	buffer := make([]byte, to-from)
+	n, err := file.ReadAt(buffer, int64(from))
+	if err == io.EOF {
+		err = nil
+	}
+
+	return buffer[:n], err
+}
+
+// reads up to 'size' bytes of the interleaved output starting at 'offset'. Only the records of the index from the last
+// checkpoint before 'offset' are read, so following the output doesn't read the index again and again.
+func (l *outputLogs) readInterleaved(offset, size int) ([]byte, error) {
+	l.checkpointsLock.Lock()
+	defer l.checkpointsLock.Unlock()
+
+	if len(l.checkpoints) == 0 {
+		l.checkpoints = []indexCheckpoint{{}}
+	}
+
+	first := sort.Search(len(l.checkpoints), func(i int) bool { return l.checkpoints[i].position > offset }) - 1
+	checkpoint := l.checkpoints[first]
+	record := int64(first) * indexCheckpointInterval
+
+	index, err := os.Open(l.path + ".index")
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+
+	files := map[OutputStream]*os.File{}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	result := []byte{}
+	position := checkpoint.position // position of the record in the interleaved output
+	streamPositions := map[OutputStream]int{StdoutStream: checkpoint.stdout, StderrStream: checkpoint.stderr}
+	chunk := make([]byte, indexCheckpointInterval*indexRecordSize)
+	for len(result) < size {
+		n, err := index.ReadAt(chunk, record*indexRecordSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		records := chunk[:n-n%indexRecordSize]
+		if len(records) == 0 {
+			break
+		}
+
+		for start := 0; start < len(records) && len(result) < size; start, record = start+indexRecordSize, record+1 {
+			// the records before this one can't change anymore, only the last record is extended
+			if record == int64(len(l.checkpoints))*indexCheckpointInterval {
+				l.checkpoints = append(l.checkpoints, indexCheckpoint{position, streamPositions[StdoutStream], streamPositions[StderrStream]})
+			}
+
+			stream := StdoutStream
+			if records[start] == 1 {
+				stream = StderrStream
+			}
+			length := int(binary.LittleEndian.Uint64(records[start+1 : start+indexRecordSize]))
+
+			streamStart := streamPositions[stream]
+			streamPositions[stream] += length
+
+			if end := position + length; offset < end {
+				if offset > position {
+					streamStart += offset - position
+				}
+
+				file, ok := files[stream]
+				if !ok {
+					if file, err = os.Open(l.streamPath(stream)); err != nil {
+						return nil, err
+					}
+					files[stream] = file
+				}
+
+				to := minInt(streamPositions[stream], streamStart+size-len(result))
+				bytes, err := readFileRange(file, streamStart, to)
+				if err != nil {
+					return nil, err
+				}
+
+				result = append(result, bytes...)
+			}
+
+			position += length
+		}
+	}
+
+	return result, nil
+}
+
+// closes the files once no more output can arrive, the files can still be read
+func (l *outputLogs) close() {
+	for _, file := range []**os.File{&l.stdout, &l.stderr, &l.index} {
+		if *file != nil {
+			(*file).Close()
+			*file = nil
+		}
+	}
+}
+
+// moves the log files to 'path', which must be on the same file system, the files are only found there afterwards
+func (l *outputLogs) rename(path string) error {
+	for _, extension := range []string{".stdout", ".stderr", ".index"} {
+		if err := os.Rename(l.path+extension, path+extension); err != nil {
+			// the files already moved are removed with the rest
+			(&outputLogs{path: path}).remove()
+			return err
+		}
+	}
+
+	l.path = path
+	return nil
+}
+
+func (l *outputLogs) remove() error {
+	var result error
+	for _, extension := range []string{".stdout", ".stderr", ".index"} {
+		if err := os.Remove(l.path + extension); err != nil && !errors.Is(err, os.ErrNotExist) {
+			result = err
+		}
+	}
+
+	return result
+}
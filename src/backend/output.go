@@ -0,0 +1,633 @@
+package backend
+
+import (
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+type OutputStream string
+
+const (
+	StdoutStream OutputStream = "stdout"
+	StderrStream OutputStream = "stderr"
+	BothStreams  OutputStream = "both" // stdout and stderr interleaved in the order they were received
+)
+
+// OutputRetention is which part of a stream is kept in memory once it's larger than the maximum output size
+type OutputRetention string
+
+const (
+	RetainHead OutputRetention = "head" // the first bytes, later output is dropped
+	RetainTail OutputRetention = "tail" // the last bytes, older output is dropped as new output arrives
+	RetainBoth OutputRetention = "both" // half of the maximum for the first bytes and half for the last bytes
+)
+
+// outputBudget limits the output kept in memory by all the jobs of the server, it's shared by the jobs
+type outputBudget struct {
+	lock sync.Mutex
+	used int64
+	max  int64 // no limit if 0
+}
+
+func (b *outputBudget) release(n int) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.used -= int64(n)
+}
+
+// uses 'n' bytes even if over the maximum, for output that was already kept before a restart
+func (b *outputBudget) use(n int) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.used += int64(n)
+}
+
+// reserves up to 'n' bytes, returns how many were reserved
+func (b *outputBudget) reserve(n int) int {
+	if b == nil {
+		return n
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.max != 0 && b.used+int64(n) > b.max {
+		n = int(b.max - b.used)
+		if n < 0 {
+			n = 0 // restored outputs can go over the maximum
+		}
+	}
+
+	b.used += int64(n)
+	return n
+}
+
+// outputLimits bounds the output kept in memory for a job
+type outputLimits struct {
+	retention OutputRetention
+	maxSize   int           // bytes kept of each stream
+	budget    *outputBudget // shared by all the jobs of the server, nil if there's no server wide limit
+	logDir    string        // directory where the output is written, only a window is kept in memory if set
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// ringBuffer keeps the last 'size' bytes written to it, memory is allocated as it fills up
+type ringBuffer struct {
+	buf   []byte // grows up to 'size' bytes, then is overwritten circularly
+	size  int
+	start int // index in 'buf' of the oldest byte
+}
+
+func (r *ringBuffer) len() int {
+	return len(r.buf)
+}
+
+func (r *ringBuffer) write(p []byte) {
+	if len(p) >= r.size {
+		r.buf = append(r.buf[:0], p[len(p)-r.size:]...)
+		r.start = 0
+		return
+	}
+
+	if free := r.size - len(r.buf); free > 0 {
+		n := minInt(free, len(p))
+		r.buf = append(r.buf, p[:n]...)
+		p = p[n:]
+	}
+
+	// the buffer is full, the oldest bytes are overwritten
+	for len(p) > 0 {
+		n := copy(r.buf[r.start:], p)
+		p = p[n:]
+		r.start = (r.start + n) % len(r.buf)
+	}
+}
+
+// appends the bytes from 'from' to 'to' to 'dst', indexes are counted from the oldest byte
+func (r *ringBuffer) appendTo(dst []byte, from, to int) []byte {
+	for from < to {
+		index := (r.start + from) % len(r.buf)
+		n := minInt(to-from, len(r.buf)-index)
+		dst = append(dst, r.buf[index:index+n]...)
+		from += n
+	}
+
+	return dst
+}
+
+// streamBuffer keeps the first and the last bytes of a stream, dropping the ones in between once full
+type streamBuffer struct {
+	head     []byte // first bytes of the stream
+	headSize int    // maximum size of 'head'
+	tail     ringBuffer
+	total    int // bytes written to the stream, including the dropped ones
+}
+
+func newStreamBuffer(limits outputLimits) streamBuffer {
+	headSize, tailSize := limits.maxSize, limits.maxSize
+	switch limits.retention {
+	case RetainHead:
+		tailSize = 0
+	case RetainTail:
+		headSize = 0
+	default:
+		headSize = limits.maxSize / 2
+		tailSize = limits.maxSize - headSize
+	}
+
+	return streamBuffer{headSize: headSize, tail: ringBuffer{size: tailSize}}
+}
+
+// writes 'p' and returns how many of its first bytes were kept in the head and of its last bytes in the tail,
+// the ones in between were dropped. The buffers stop growing once the budget runs out.
+func (b *streamBuffer) write(p []byte, budget *outputBudget) (headBytes, tailBytes int) {
+	b.total += len(p)
+
+	if room := b.headSize - len(b.head); room > 0 && len(p) > 0 {
+		wanted := minInt(room, len(p))
+		headBytes = budget.reserve(wanted)
+		if headBytes < wanted {
+			b.headSize = len(b.head) + headBytes
+		}
+
+		b.head = append(b.head, p[:headBytes]...)
+		p = p[headBytes:]
+	}
+
+	if room := b.tail.size - b.tail.len(); room > 0 && len(p) > 0 {
+		wanted := minInt(room, len(p))
+		if reserved := budget.reserve(wanted); reserved < wanted {
+			b.tail.size = b.tail.len() + reserved
+		}
+	}
+
+	if b.tail.size == 0 || len(p) == 0 {
+		return headBytes, 0
+	}
+
+	b.tail.write(p)
+	return headBytes, minInt(len(p), b.tail.size)
+}
+
+// offset in the stream of the oldest byte in the tail
+func (b *streamBuffer) tailStart() int {
+	return b.total - b.tail.len()
+}
+
+// appends the kept bytes from 'from' to 'to' to 'dst', offsets are counted from the start of the stream
+func (b *streamBuffer) appendTo(dst []byte, from, to int) []byte {
+	if from < len(b.head) {
+		dst = append(dst, b.head[from:minInt(to, len(b.head))]...)
+	}
+
+	tailStart := b.tailStart()
+	if from < tailStart {
+		from = tailStart
+	}
+
+	if from < to {
+		dst = b.tail.appendTo(dst, from-tailStart, to-tailStart)
+	}
+
+	return dst
+}
+
+func (b *streamBuffer) kept() int {
+	return len(b.head) + b.tail.len()
+}
+
+func (b *streamBuffer) dropped() int {
+	return b.total - b.kept()
+}
+
+type outputSegment struct {
+	stream   OutputStream // stream the bytes were written to, StdoutStream or StderrStream
+	position int          // offset of the first byte in the interleaved output
+	start    int          // offset of the first byte in its stream
+	length   int          // number of bytes
+}
+
+func (s *outputSegment) end() int {
+	return s.start + s.length
+}
+
+// appends 'segment', merging it with the last one if they are contiguous, keeps the index small
+func appendSegment(segments []outputSegment, segment outputSegment) []outputSegment {
+	if last := len(segments) - 1; last >= 0 {
+		previous := &segments[last]
+		if previous.stream == segment.stream && previous.end() == segment.start && previous.position+previous.length == segment.position {
+			previous.length += segment.length
+			return segments
+		}
+	}
+
+	return append(segments, segment)
+}
+
+// jobOutput stores the output of a process, it's not synchronized and must be guarded by the job lock.
+// Offsets are counted from the start of the output, including the bytes that were dropped.
+// When the output is written to log files nothing is dropped and the buffers only keep a window of the latest output.
+type jobOutput struct {
+	stdout       streamBuffer    // process stdout
+	stderr       streamBuffer    // process stderr
+	headSegments []outputSegment // order in which the bytes kept in the heads of stdout and stderr were received
+	tailSegments []outputSegment // order in which the bytes kept in the tails of stdout and stderr were received
+	compactedAt  int             // length of 'tailSegments' after segments with dropped bytes were last removed
+	limits       outputLimits
+	logs         *outputLogs   // nil if the output is only kept in memory
+	updated      chan struct{} // closed and replaced when new output is available or when no more output can arrive
+}
+
+// output without any bytes, of jobs that haven't started
+func emptyJobOutput(limits outputLimits) jobOutput {
+	return jobOutput{limits: limits, updated: make(chan struct{})}
+}
+
+func newJobOutput(id string, limits outputLimits) (jobOutput, error) {
+	output := emptyJobOutput(limits)
+
+	bufferLimits := limits
+	if limits.logDir != "" {
+		var err error
+		if output.logs, err = createOutputLogs(limits.logDir, id); err != nil {
+			return jobOutput{}, err
+		}
+
+		bufferLimits.retention, bufferLimits.maxSize = RetainTail, logWindowSize
+	}
+
+	output.stdout, output.stderr = newStreamBuffer(bufferLimits), newStreamBuffer(bufferLimits)
+	return output, nil
+}
+
+func (o *jobOutput) write(stream OutputStream, bytes []byte) {
+	if o.logs != nil {
+		if err := o.logs.write(stream, bytes); err != nil {
+			log.Printf("Failed to write to the log file %s: %s", o.logs.streamPath(stream), err)
+		}
+	}
+
+	buffer := o.buffer(stream)
+	position, start := o.total(), buffer.total
+
+	headBytes, tailBytes := buffer.write(bytes, o.limits.budget)
+	if headBytes != 0 {
+		o.headSegments = appendSegment(o.headSegments, outputSegment{stream: stream, position: position, start: start, length: headBytes})
+	}
+
+	if tailBytes != 0 {
+		skipped := len(bytes) - tailBytes
+		o.tailSegments = appendSegment(o.tailSegments, outputSegment{stream: stream, position: position + skipped, start: start + skipped, length: tailBytes})
+		o.compactSegments()
+	}
+
+	o.notify()
+}
+
+// removes the tail segments whose bytes were all dropped, only once the index doubles in size to amortize the cost
+func (o *jobOutput) compactSegments() {
+	if len(o.tailSegments) < 2*o.compactedAt+16 {
+		return
+	}
+
+	kept := o.tailSegments[:0]
+	for _, segment := range o.tailSegments {
+		if segment.end() > o.buffer(segment.stream).tailStart() {
+			kept = append(kept, segment)
+		}
+	}
+
+	o.tailSegments = kept
+	o.compactedAt = len(kept)
+}
+
+// wakes up the readers waiting for new output
+func (o *jobOutput) notify() {
+	close(o.updated)
+	o.updated = make(chan struct{})
+}
+
+func (o *jobOutput) buffer(stream OutputStream) *streamBuffer {
+	if stream == StdoutStream {
+		return &o.stdout
+	}
+
+	return &o.stderr
+}
+
+// total size of the interleaved output
+func (o *jobOutput) total() int {
+	return o.stdout.total + o.stderr.total
+}
+
+// bytes kept by the server, all of them when the output is in log files
+func (o *jobOutput) storedSize() int {
+	if o.logs != nil {
+		return o.total()
+	}
+
+	return o.stdout.kept() + o.stderr.kept()
+}
+
+// returns a copy of the kept bytes of the stream starting at 'offset', and the offset to continue reading from.
+// Reads of the log files are limited in size, the output must be read until no more bytes are returned.
+func (o *jobOutput) read(stream OutputStream, offset int) ([]byte, int) {
+	if o.logs != nil && offset < o.streamTotal(stream) && (stream == BothStreams || offset < o.buffer(stream).tailStart()) {
+		return o.readLogs(stream, offset)
+	}
+
+	if stream != BothStreams {
+		buffer := o.buffer(stream)
+		if offset >= buffer.total {
+			return nil, offset
+		}
+
+		return buffer.appendTo(nil, offset, buffer.total), buffer.total
+	}
+
+	if offset >= o.total() {
+		return nil, offset
+	}
+
+	result := []byte{}
+	result = o.appendSegments(result, o.headSegments, offset, false)
+	result = o.appendSegments(result, o.tailSegments, offset, true)
+
+	return result, o.total()
+}
+
+func (o *jobOutput) appendSegments(dst []byte, segments []outputSegment, offset int, inTail bool) []byte {
+	for _, segment := range segments {
+		buffer := o.buffer(segment.stream)
+		start, end := segment.start, segment.end()
+		if inTail && start < buffer.tailStart() {
+			start = buffer.tailStart() // the first bytes of the segment were dropped
+		}
+
+		position := segment.position + start - segment.start
+		if end <= start || offset >= position+end-start {
+			continue
+		}
+
+		if offset > position {
+			start += offset - position
+		}
+
+		dst = buffer.appendTo(dst, start, end)
+	}
+
+	return dst
+}
+
+func (o *jobOutput) streamTotal(stream OutputStream) int {
+	if stream == BothStreams {
+		return o.total()
+	}
+
+	return o.buffer(stream).total
+}
+
+func (o *jobOutput) readLogs(stream OutputStream, offset int) ([]byte, int) {
+	var output []byte
+	var err error
+	if stream == BothStreams {
+		output, err = o.logs.readInterleaved(offset, maxLogReadSize)
+	} else {
+		output, err = o.logs.readStream(stream, offset, minInt(o.buffer(stream).total, offset+maxLogReadSize))
+	}
+
+	if err != nil {
+		log.Printf("Failed to read the log files %s: %s", o.logs.path, err)
+		return nil, offset
+	}
+
+	return output, offset + len(output)
+}
+
+// returns the output of the stream to show and the number of bytes that were dropped from it. When the output is in
+// log files the parts of the log that would be kept in memory without them are returned.
+func (o *jobOutput) snapshot(stream OutputStream) ([]byte, int) {
+	buffer := o.buffer(stream)
+	if o.logs == nil {
+		return buffer.appendTo(nil, 0, buffer.total), buffer.dropped()
+	}
+
+	kept := newStreamBuffer(o.limits)
+	headSize, tailSize := kept.headSize, kept.tail.size
+	if buffer.total <= headSize+tailSize {
+		headSize, tailSize = buffer.total, 0
+	}
+
+	head, err := o.logs.readStream(stream, 0, headSize)
+	if err != nil {
+		log.Printf("Failed to read the log file %s: %s", o.logs.streamPath(stream), err)
+		return nil, buffer.total
+	}
+
+	tail, err := o.logs.readStream(stream, buffer.total-tailSize, buffer.total)
+	if err != nil {
+		log.Printf("Failed to read the log file %s: %s", o.logs.streamPath(stream), err)
+		return nil, buffer.total
+	}
+
+	return append(head, tail...), buffer.total - headSize - tailSize
+}
+
+// called when no more output can arrive
+func (o *jobOutput) close() {
+	if o.logs != nil {
+		o.logs.close()
+	}
+}
+
+// keeps the log files once the output is released, moving them to their path with 'suffix'. Returns their new path,
+// empty if the output has no log files or they couldn't be moved, and then are removed with the output.
+func (o *jobOutput) keepLogs(suffix string) string {
+	if o.logs == nil {
+		return ""
+	}
+
+	o.logs.close()
+	if err := o.logs.rename(o.logs.path + "." + suffix); err != nil {
+		log.Printf("Failed to keep the log files %s: %s", o.logs.path, err)
+		return ""
+	}
+
+	path := o.logs.path
+	o.logs = nil
+	return path
+}
+
+// frees the memory used by the output and removes its log files, the output can't be read afterwards
+func (o *jobOutput) release() {
+	o.limits.budget.release(o.stdout.kept() + o.stderr.kept())
+	o.stdout, o.stderr = streamBuffer{}, streamBuffer{}
+	o.headSegments, o.tailSegments = nil, nil
+
+	if o.logs != nil {
+		if err := o.logs.remove(); err != nil {
+			log.Printf("Failed to remove the log files %s: %s", o.logs.path, err)
+		}
+		o.logs = nil
+	}
+}
+
+// bytes of each stream saved in the job records when the output isn't in log files, the rest doesn't survive a restart
+const persistedOutputSize = 4 << 10
+
+// OutputRecord is what's persisted of the output of a job, see JobRecord. Only a bounded part of each stream is saved
+// when the output is in memory, the log files are referenced otherwise.
+type OutputRecord struct {
+	Stdout   StreamRecord    `json:"stdout"`
+	Stderr   StreamRecord    `json:"stderr"`
+	Segments []SegmentRecord `json:"segments,omitempty"` // order in which the saved bytes of both streams were received
+	LogPath  string          `json:"log_path,omitempty"` // path of the log files without the extension, empty if there are none
+}
+
+// StreamRecord has the size of a stream and its last bytes, or its first ones when only the head of the stream was kept
+type StreamRecord struct {
+	Head  []byte `json:"head,omitempty"`
+	Tail  []byte `json:"tail,omitempty"`
+	Total int    `json:"total"`
+}
+
+type SegmentRecord struct {
+	Stream   OutputStream `json:"stream"`
+	Position int          `json:"position"`
+	Start    int          `json:"start"`
+	Length   int          `json:"length"`
+}
+
+func (b *streamBuffer) record() StreamRecord {
+	record := StreamRecord{Total: b.total}
+	if b.tail.len() == 0 && b.dropped() != 0 {
+		record.Head = append([]byte{}, b.head[:minInt(len(b.head), persistedOutputSize)]...)
+		return record
+	}
+
+	// the bytes at the end of the stream that are kept without a gap
+	start := b.tailStart()
+	if b.dropped() == 0 {
+		start = 0
+	}
+
+	if start < b.total-persistedOutputSize {
+		start = b.total - persistedOutputSize
+	}
+
+	record.Tail = b.appendTo(nil, start, b.total)
+	return record
+}
+
+// offsets in the stream of the first byte saved in the record and of the byte after the last
+func (r *StreamRecord) savedRange() (int, int) {
+	if len(r.Head) != 0 {
+		return 0, len(r.Head)
+	}
+
+	return r.Total - len(r.Tail), r.Total
+}
+
+func restoreStreamBuffer(record *StreamRecord) streamBuffer {
+	return streamBuffer{
+		head:     record.Head,
+		headSize: len(record.Head),
+		tail:     ringBuffer{buf: record.Tail, size: len(record.Tail)},
+		total:    record.Total,
+	}
+}
+
+func (o *jobOutput) record() *OutputRecord {
+	if o.logs != nil {
+		return &OutputRecord{Stdout: StreamRecord{Total: o.stdout.total}, Stderr: StreamRecord{Total: o.stderr.total}, LogPath: o.logs.path}
+	}
+
+	record := &OutputRecord{Stdout: o.stdout.record(), Stderr: o.stderr.record()}
+	for _, segments := range [][]outputSegment{o.headSegments, o.tailSegments} {
+		for _, segment := range segments {
+			// only the parts of the segments with saved bytes
+			from, to := record.stream(segment.stream).savedRange()
+			start, end := segment.start, segment.end()
+			if start < from {
+				start = from
+			}
+			if end > to {
+				end = to
+			}
+
+			if start < end {
+				record.Segments = append(record.Segments, SegmentRecord{
+					Stream:   segment.stream,
+					Position: segment.position + start - segment.start,
+					Start:    start,
+					Length:   end - start,
+				})
+			}
+		}
+	}
+
+	sort.Slice(record.Segments, func(i, k int) bool { return record.Segments[i].Position < record.Segments[k].Position })
+	return record
+}
+
+func (r *OutputRecord) stream(stream OutputStream) *StreamRecord {
+	if stream == StdoutStream {
+		return &r.Stdout
+	}
+
+	return &r.Stderr
+}
+
+// restores the output of a job that can't receive more output. When the output is in log files these are read instead
+// of the saved window, the files have the output written after the record was saved.
+func restoreJobOutput(record *OutputRecord, limits outputLimits) jobOutput {
+	output := emptyJobOutput(limits)
+	if record == nil {
+		return output
+	}
+
+	if record.LogPath == "" {
+		output.stdout, output.stderr = restoreStreamBuffer(&record.Stdout), restoreStreamBuffer(&record.Stderr)
+		for _, segment := range record.Segments {
+			restored := outputSegment{stream: segment.Stream, position: segment.Position, start: segment.Start, length: segment.Length}
+			if len(record.stream(segment.Stream).Head) != 0 {
+				output.headSegments = append(output.headSegments, restored)
+			} else {
+				output.tailSegments = append(output.tailSegments, restored)
+			}
+		}
+
+		limits.budget.use(output.stdout.kept() + output.stderr.kept())
+		return output
+	}
+
+	output.logs = &outputLogs{path: record.LogPath, lastIndex: -1}
+	for _, stream := range []OutputStream{StdoutStream, StderrStream} {
+		if info, err := os.Stat(output.logs.streamPath(stream)); err == nil {
+			output.buffer(stream).total = int(info.Size())
+		} else {
+			log.Printf("Failed to restore the log file %s: %s", output.logs.streamPath(stream), err)
+		}
+	}
+
+	return output
+}
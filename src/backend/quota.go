@@ -0,0 +1,189 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits what a user's jobs can use, each limit is disabled if 0. The limits are only checked when jobs are
+// submitted, the jobs already submitted aren't stopped once one is reached, so the running jobs can go over the output
+// and CPU time limits.
+type Quota struct {
+	MaxRunningJobs int           // jobs that haven't ended, the queued, scheduled and waiting ones included
+	MaxJobs        int           // job records kept by the server, the ended ones included until they're purged
+	MaxOutputBytes int64         // output kept by the server, of the jobs and their previous attempts
+	MaxCPUPerDay   time.Duration // CPU time of the jobs that ended each day in the server's time zone, and of the running jobs with cgroups
+}
+
+// CPU time used by the jobs of a user that ended on a day
+type dailyCPU struct {
+	day  time.Time // midnight starting the day, in the server's time zone
+	used time.Duration
+}
+
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// what a user's jobs are using of each limit of the quota
+type quotaUsage struct {
+	runningJobs int
+	jobs        int
+	outputBytes int64
+	cpuToday    time.Duration
+}
+
+// charges the CPU time of a job that ended to the day it ended on
+func (u *User) chargeCPU(cpu time.Duration, now time.Time) {
+	u.cpuLock.Lock()
+	defer u.cpuLock.Unlock()
+
+	if day := startOfDay(now); !u.cpu.day.Equal(day) {
+		u.cpu = dailyCPU{day: day}
+	}
+	u.cpu.used += cpu
+}
+
+func (u *User) cpuUsedOn(now time.Time) time.Duration {
+	u.cpuLock.Lock()
+	defer u.cpuLock.Unlock()
+
+	if !u.cpu.day.Equal(startOfDay(now)) {
+		return 0
+	}
+
+	return u.cpu.used
+}
+
+func (u *User) quotaUsage(now time.Time) quotaUsage {
+	u.jobsLock.RLock()
+	defer u.jobsLock.RUnlock()
+
+	return u.quotaUsageLocked(now)
+}
+
+// the reserved jobs count as jobs that haven't ended yet. The CPU time used so far by the running jobs counts as used
+// today, their CPU time is charged to the day they end on once they do.
+func (u *User) quotaUsageLocked(now time.Time) quotaUsage {
+	usage := quotaUsage{cpuToday: u.cpuUsedOn(now), jobs: u.reservedJobs, runningJobs: u.reservedJobs}
+	for _, job := range u.jobs {
+		usage.jobs++
+		if _, ended := job.getEndedAt(); !ended {
+			usage.runningJobs++
+			usage.cpuToday += job.runningCPU()
+		}
+		usage.outputBytes += job.storedOutputSize()
+	}
+
+	return usage
+}
+
+// reserveQuota reserves the quota for 'count' more jobs, so that jobs submitted at the same time can't go over it
+// together. Returns an error wrapping ErrQuotaExceeded if the user can't submit them. The reservation is taken back
+// by 'addReservedJobs' once the jobs are submitted, or by 'releaseQuota' if they aren't.
+func (u *User) reserveQuota(count int, now time.Time) error {
+	quota := u.getQuota()
+
+	u.jobsLock.Lock()
+	defer u.jobsLock.Unlock()
+
+	if err := u.checkQuotaLocked(quota, count, now); err != nil {
+		return err
+	}
+
+	u.reservedJobs += count
+	return nil
+}
+
+func (u *User) releaseQuota(count int) {
+	u.jobsLock.Lock()
+	defer u.jobsLock.Unlock()
+
+	u.reservedJobs -= count
+}
+
+// adds jobs submitted with the quota reserved for them
+func (u *User) addReservedJobs(jobs ...*Job) {
+	u.jobsLock.Lock()
+	defer u.jobsLock.Unlock()
+
+	for _, job := range jobs {
+		u.jobs[job.GetID()] = job
+	}
+	u.reservedJobs -= len(jobs)
+}
+
+func (u *User) checkQuotaLocked(quota Quota, count int, now time.Time) error {
+	if quota == (Quota{}) {
+		return nil
+	}
+
+	usage := u.quotaUsageLocked(now)
+	switch {
+	case quota.MaxRunningJobs != 0 && usage.runningJobs+count > quota.MaxRunningJobs:
+		return fmt.Errorf("%w: %d jobs haven't ended, of a maximum of %d", ErrQuotaExceeded, usage.runningJobs, quota.MaxRunningJobs)
+	case quota.MaxJobs != 0 && usage.jobs+count > quota.MaxJobs:
+		return fmt.Errorf("%w: %d jobs are kept, of a maximum of %d, purge the ones that ended", ErrQuotaExceeded, usage.jobs, quota.MaxJobs)
+	case quota.MaxOutputBytes != 0 && usage.outputBytes >= quota.MaxOutputBytes:
+		return fmt.Errorf("%w: %d bytes of output are kept, of a maximum of %d, purge the jobs that ended", ErrQuotaExceeded, usage.outputBytes, quota.MaxOutputBytes)
+	case quota.MaxCPUPerDay != 0 && usage.cpuToday >= quota.MaxCPUPerDay:
+		return fmt.Errorf("%w: %s of CPU time were used today, of a maximum of %s", ErrQuotaExceeded, usage.cpuToday, quota.MaxCPUPerDay)
+	}
+
+	return nil
+}
+
+// GetQuotaView returns what the user's jobs are using of each limit of their quota
+func (u *User) GetQuotaView(now time.Time) view.QuotaView {
+	usage, quota := u.quotaUsage(now), u.getQuota()
+	return view.QuotaView{
+		RunningJobs:     view.QuotaViewUsage{Used: int64(usage.runningJobs), Limit: int64(quota.MaxRunningJobs)},
+		Jobs:            view.QuotaViewUsage{Used: int64(usage.jobs), Limit: int64(quota.MaxJobs)},
+		OutputBytes:     view.QuotaViewUsage{Used: usage.outputBytes, Limit: quota.MaxOutputBytes},
+		CPUSecondsToday: view.QuotaViewUsage{Used: int64(usage.cpuToday.Seconds()), Limit: int64(quota.MaxCPUPerDay.Seconds())},
+		DayResetsAt:     startOfDay(now).AddDate(0, 0, 1),
+	}
+}
+
+// bytes of output kept by the server, in the logs or in memory, including the previous attempts
+func (j *Job) storedOutputSize() int64 {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	size := j.output.storedSize()
+	for _, attempt := range j.attempts {
+		if attempt.LogPath != "" {
+			size += attempt.StdoutTotal + attempt.StderrTotal
+		} else {
+			size += len(attempt.Stdout) + len(attempt.Stderr)
+		}
+	}
+
+	return int64(size)
+}
+
+// CPU time used so far by the processes of a job that's executing, read from its cgroup. 0 without cgroups, the CPU
+// time of the job is only known once it ends then.
+func (j *Job) runningCPU() time.Duration {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	if !j.isExecutingLocked() || j.cgroup == nil {
+		return 0
+	}
+
+	cpu, err := j.cgroup.cpuUsage()
+	if err != nil {
+		log.Printf("Failed to read the CPU time of job %s: %s", j.id, err)
+		return 0
+	}
+
+	return cpu
+}
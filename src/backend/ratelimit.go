@@ -0,0 +1,144 @@
+package backend
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how often the buckets that refilled are removed
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is a token bucket, requests are allowed at 'Rate' per second on average with bursts of up to 'Burst'
+type RateLimit struct {
+	Rate  float64 // requests per second, no limit if 0
+	Burst int     // requests allowed at once after being idle, the rate rounded up if 0
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// rateLimiter keeps a token bucket for each key, like a username or an IP. Buckets that refilled are the same as new
+// ones, so they're removed from time to time.
+type rateLimiter struct {
+	lock    sync.Mutex
+	rate    float64 // no limit if 0
+	burst   float64
+	buckets map[string]*tokenBucket
+	sweptAt time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	burst := limit.Burst
+	if burst == 0 {
+		burst = int(math.Ceil(limit.Rate))
+	}
+
+	return &rateLimiter{rate: limit.Rate, burst: float64(burst), buckets: map[string]*tokenBucket{}}
+}
+
+// allow takes a token from the key's bucket, when it's empty returns false and how long until a token is available
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	if l.rate == 0 {
+		return true, 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.sweepLocked(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updatedAt: now}
+		l.buckets[key] = bucket
+	} else if now.After(bucket.updatedAt) {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*l.rate)
+		bucket.updatedAt = now
+	}
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+func (l *rateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(l.sweptAt) < rateLimitSweepInterval {
+		return
+	}
+
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.updatedAt) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+	l.sweptAt = now
+}
+
+// requestLimiters are the rate limits of the API, for each user and each client IP, with separate limits for the
+// requests creating jobs and for the others
+type requestLimiters struct {
+	userRead   *rateLimiter
+	userCreate *rateLimiter
+	ipRead     *rateLimiter
+	ipCreate   *rateLimiter
+}
+
+func newRequestLimiters(config *Config) *requestLimiters {
+	return &requestLimiters{
+		userRead:   newRateLimiter(config.UserReadRateLimit),
+		userCreate: newRateLimiter(config.UserCreateRateLimit),
+		ipRead:     newRateLimiter(config.IPReadRateLimit),
+		ipCreate:   newRateLimiter(config.IPCreateRateLimit),
+	}
+}
+
+// whether the request creates jobs, directly or through a schedule
+func isCreateRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && (r.URL.Path == "/api/jobs" || r.URL.Path == "/api/schedules")
+}
+
+// the limiters of the user and of the client IP the request counts against
+func (l *requestLimiters) forRequest(r *http.Request) (user, ip *rateLimiter) {
+	if isCreateRequest(r) {
+		return l.userCreate, l.ipCreate
+	}
+
+	return l.userRead, l.ipRead
+}
+
+// the IP the request comes from, proxies in front of the server aren't looked through
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// takes a token for the key, or answers with a 429 and when to retry if there's none, returns whether it was allowed
+func allowRequest(w http.ResponseWriter, limiter *rateLimiter, key string) bool {
+	allowed, wait := limiter.allow(key, time.Now())
+	if allowed {
+		return true
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	WriteJSONError(w, http.StatusTooManyRequests, "too many requests, retry after "+strconv.Itoa(seconds)+"s")
+	return false
+}
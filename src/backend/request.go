@@ -0,0 +1,516 @@
+package backend
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+)
+
+const maxJobRequestSize = 1 << 20 // maximum size of a job creation request, excluding the stdin
+
+const (
+	maxRetryAttempts  = 100 // the output of each attempt is kept
+	defaultBackoff    = time.Second
+	defaultMaxBackoff = 5 * time.Minute
+)
+
+var errStdinTooLarge = errors.New("stdin is larger than the maximum allowed by the server")
+
+func isCommandValid(command []string) error {
+	if len(command) == 0 {
+		return errors.New("Invalid JSON schema: command must have at least 1 element")
+	}
+
+	if program := command[0]; len(strings.TrimSpace(program)) == 0 {
+		return errors.New("Invalid JSON schema: command must have at least 1 non-empty element")
+	}
+
+	// TODO: add more sanity checks like invalid characters, etc
+
+	return nil
+}
+
+func areLimitsValid(limits *view.JobViewLimits) error {
+	if limits.CPU < 0 {
+		return errors.New("Invalid JSON schema: cpu can't be negative")
+	}
+
+	if limits.CPU != 0 && limits.CPU*cpuPeriod < minCPUQuota {
+		return fmt.Errorf("Invalid JSON schema: cpu must be at least %g", float64(minCPUQuota)/cpuPeriod)
+	}
+
+	if limits.MemoryMax < 0 {
+		return errors.New("Invalid JSON schema: memory_max can't be negative")
+	}
+
+	if limits.IOWeight < 0 || limits.IOWeight > 10000 {
+		return errors.New("Invalid JSON schema: io_weight must be between 1 and 10000 when set")
+	}
+
+	return nil
+}
+
+func parseDuration(field, value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("Invalid JSON schema: %s must be a positive duration like '10s'", field)
+	}
+
+	return duration, nil
+}
+
+func parseTimeout(value string, maxTimeout time.Duration) (time.Duration, error) {
+	timeout, err := parseDuration("timeout", value, maxTimeout)
+	if err != nil {
+		return 0, err
+	}
+
+	if maxTimeout != 0 && (timeout == 0 || timeout > maxTimeout) {
+		return 0, fmt.Errorf("Invalid JSON schema: timeout can be at most %s", maxTimeout)
+	}
+
+	return timeout, nil
+}
+
+func parseStopSignal(value, defaultValue string) (string, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	if _, ok := stopSignals[value]; !ok {
+		return "", fmt.Errorf("Invalid JSON schema: unsupported stop_signal '%s'", value)
+	}
+
+	return value, nil
+}
+
+// validates the job's environment variables and returns them merged with the base environment
+func parseEnv(env map[string]string, baseEnv map[string]string) (map[string]string, error) {
+	merged := make(map[string]string, len(baseEnv)+len(env))
+	for key, value := range baseEnv {
+		merged[key] = value
+	}
+
+	for key, value := range env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return nil, fmt.Errorf("Invalid JSON schema: invalid env variable name '%s'", key)
+		}
+
+		if strings.ContainsRune(value, 0) {
+			return nil, fmt.Errorf("Invalid JSON schema: value of env variable '%s' can't contain NUL characters", key)
+		}
+
+		merged[key] = value
+	}
+
+	return merged, nil
+}
+
+func parseWorkingDir(workingDir, defaultValue string) (string, error) {
+	if workingDir == "" {
+		return defaultValue, nil
+	}
+
+	if !filepath.IsAbs(workingDir) {
+		return "", errors.New("Invalid JSON schema: working_dir must be an absolute path")
+	}
+
+	if info, err := os.Stat(workingDir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("Invalid JSON schema: working_dir '%s' isn't an existing directory", workingDir)
+	}
+
+	return filepath.Clean(workingDir), nil
+}
+
+// returns when the job should be queued, zero to queue it right away
+func parseStartAt(createJob *view.JobViewCommand) (time.Time, error) {
+	if createJob.StartAt != nil && createJob.StartAfter != "" {
+		return time.Time{}, errors.New("Invalid JSON schema: only one of start_at or start_after can be set")
+	}
+
+	if createJob.StartAt != nil {
+		return *createJob.StartAt, nil
+	}
+
+	startAfter, err := parseDuration("start_after", createJob.StartAfter, 0)
+	if err != nil || startAfter == 0 {
+		return time.Time{}, err
+	}
+
+	return time.Now().Add(startAfter), nil
+}
+
+func parseRetry(retry *view.JobViewRetry) (RetryPolicy, error) {
+	if retry == nil {
+		return RetryPolicy{}, nil
+	}
+
+	if retry.MaxAttempts < 1 || retry.MaxAttempts > maxRetryAttempts {
+		return RetryPolicy{}, fmt.Errorf("Invalid JSON schema: retry max_attempts must be between 1 and %d", maxRetryAttempts)
+	}
+
+	policy := RetryPolicy{MaxAttempts: retry.MaxAttempts, ExitCodes: retry.ExitCodes}
+
+	var err error
+	if policy.Backoff, err = parseDuration("retry backoff", retry.Backoff, defaultBackoff); err != nil {
+		return RetryPolicy{}, err
+	}
+
+	if policy.MaxBackoff, err = parseDuration("retry max_backoff", retry.MaxBackoff, defaultMaxBackoff); err != nil {
+		return RetryPolicy{}, err
+	}
+
+	if policy.MaxBackoff < policy.Backoff {
+		return RetryPolicy{}, errors.New("Invalid JSON schema: retry max_backoff can't be shorter than backoff")
+	}
+
+	for _, code := range retry.ExitCodes {
+		if code < 1 || code > 255 {
+			return RetryPolicy{}, fmt.Errorf("Invalid JSON schema: retry exit code %d must be between 1 and 255", code)
+		}
+	}
+
+	for _, status := range retry.Statuses {
+		if status := JobStatus(status); status != JobKilled && status != JobTimedOut {
+			return RetryPolicy{}, fmt.Errorf("Invalid JSON schema: retry status '%s' must be KILLED or TIMED_OUT", status)
+		}
+
+		policy.Statuses = append(policy.Statuses, JobStatus(status))
+	}
+
+	return policy, nil
+}
+
+func parseDependencies(dependencies *view.JobViewDependencies) (Dependencies, error) {
+	if dependencies == nil {
+		return Dependencies{}, nil
+	}
+
+	if len(dependencies.Jobs) == 0 {
+		return Dependencies{}, errors.New("Invalid JSON schema: depends_on must have at least 1 job")
+	}
+
+	// each job is waited for once, a repeated one would never be counted as ended
+	seen := make(map[string]bool, len(dependencies.Jobs))
+	for _, id := range dependencies.Jobs {
+		if seen[id] {
+			return Dependencies{}, fmt.Errorf("Invalid JSON schema: depends_on has the job '%s' more than once", id)
+		}
+		seen[id] = true
+	}
+
+	parsed := Dependencies{Jobs: dependencies.Jobs, Condition: DependencyCondition(dependencies.Condition)}
+	switch parsed.Condition {
+	case "":
+		parsed.Condition = DependOnSuccess
+	case DependOnSuccess, DependOnFailure, DependOnAny:
+	default:
+		return Dependencies{}, fmt.Errorf("Invalid JSON schema: depends_on condition must be one of success, failure or any, got '%s'", dependencies.Condition)
+	}
+
+	return parsed, nil
+}
+
+// the array of a job with 'command' and 'env', which must use the index of a range so that its jobs differ
+func parseArray(array *view.JobViewArray, command []string, env map[string]string) (*ArraySpec, error) {
+	if array == nil {
+		return nil, nil
+	}
+
+	if (array.Args == nil) == (array.Range == nil) {
+		return nil, errors.New("Invalid JSON schema: array must have exactly one of args or range")
+	}
+
+	if array.Args != nil {
+		if len(array.Args) == 0 || len(array.Args) > maxArraySize {
+			return nil, fmt.Errorf("Invalid JSON schema: array args must have between 1 and %d elements", maxArraySize)
+		}
+
+		parsed := &ArraySpec{Args: array.Args, Indexes: make([]int, len(array.Args))}
+		for i := range parsed.Indexes {
+			parsed.Indexes[i] = i
+		}
+
+		return parsed, nil
+	}
+
+	start, end, step := array.Range.Start, array.Range.End, array.Range.Step
+	if step == 0 {
+		step = 1
+	}
+
+	if step < 0 {
+		return nil, errors.New("Invalid JSON schema: array range step must be positive")
+	}
+
+	// the difference overflows for ranges that are far too large
+	if end < start || end-start < 0 || (end-start)/step >= maxArraySize {
+		return nil, fmt.Errorf("Invalid JSON schema: array range must have an end after its start, and at most %d indexes", maxArraySize)
+	}
+
+	if !usesArrayIndex(command, env) {
+		return nil, fmt.Errorf("Invalid JSON schema: array range requires '%s' in the command or an env value", arrayIndexPlaceholder)
+	}
+
+	parsed := &ArraySpec{Indexes: make([]int, (end-start)/step+1)}
+	for i := range parsed.Indexes {
+		parsed.Indexes[i] = start + i*step
+	}
+
+	return parsed, nil
+}
+
+func usesArrayIndex(command []string, env map[string]string) bool {
+	for _, arg := range command {
+		if strings.Contains(arg, arrayIndexPlaceholder) {
+			return true
+		}
+	}
+
+	for _, value := range env {
+		if strings.Contains(value, arrayIndexPlaceholder) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func decodeStdin(createJob *view.JobViewCommand) ([]byte, error) {
+	if createJob.Stdin != "" && createJob.StdinBase64 != "" {
+		return nil, errors.New("Invalid JSON schema: only one of stdin or stdin_base64 can be set")
+	}
+
+	if createJob.StdinBase64 != "" {
+		stdin, err := base64.StdEncoding.DecodeString(createJob.StdinBase64)
+		if err != nil {
+			return nil, errors.New("Invalid JSON schema: stdin_base64 isn't valid base64")
+		}
+
+		return stdin, nil
+	}
+
+	return []byte(createJob.Stdin), nil
+}
+
+func parseJobCreation(reqBody []byte, config *Config) (*JobSpec, error) {
+	createJob := view.JobViewCommand{}
+	if err := json.Unmarshal(reqBody, &createJob); err != nil {
+		return nil, fmt.Errorf("Invalid JSON: %s", err)
+	}
+
+	return parseJobCommand(&createJob, config)
+}
+
+// validates a job spec and applies the server defaults to it
+func parseJobCommand(createJob *view.JobViewCommand, config *Config) (*JobSpec, error) {
+	if err := isCommandValid(createJob.Command); err != nil {
+		return nil, err
+	}
+
+	if err := areLimitsValid(&createJob.JobViewLimits); err != nil {
+		return nil, err
+	}
+
+	if createJob.Priority < 0 {
+		return nil, errors.New("Invalid JSON schema: priority can't be negative")
+	}
+
+	spec := &JobSpec{
+		Command:     createJob.Command,
+		Limits:      createJob.JobViewLimits,
+		Interactive: createJob.Interactive,
+		TTY:         createJob.TTY,
+		Priority:    createJob.Priority,
+	}
+
+	var err error
+	if spec.StopSignal, err = parseStopSignal(createJob.StopSignal, config.DefaultStopSignal); err != nil {
+		return nil, err
+	}
+
+	if spec.StopGracePeriod, err = parseDuration("stop_grace_period", createJob.StopGracePeriod, config.DefaultStopGracePeriod); err != nil {
+		return nil, err
+	}
+
+	if spec.Timeout, err = parseTimeout(createJob.Timeout, config.MaxTimeout); err != nil {
+		return nil, err
+	}
+
+	if spec.DependsOn, err = parseDependencies(createJob.DependsOn); err != nil {
+		return nil, err
+	}
+
+	if spec.Retry, err = parseRetry(createJob.Retry); err != nil {
+		return nil, err
+	}
+
+	if spec.StartAt, err = parseStartAt(createJob); err != nil {
+		return nil, err
+	}
+
+	if spec.Array, err = parseArray(createJob.Array, createJob.Command, createJob.Env); err != nil {
+		return nil, err
+	}
+
+	if spec.Stdin, err = decodeStdin(createJob); err != nil {
+		return nil, err
+	}
+
+	if spec.Env, err = parseEnv(createJob.Env, config.BaseEnv); err != nil {
+		return nil, err
+	}
+
+	if spec.WorkingDir, err = parseWorkingDir(createJob.WorkingDir, config.DefaultWorkingDir); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// reads a multipart body with a 'job' part containing the JSON request and an optional 'stdin' part
+func parseMultipartJobCreation(reader *multipart.Reader, config *Config) (*JobSpec, error) {
+	var jobJSON, stdin []byte
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch part.FormName() {
+		case "job":
+			jobJSON, err = ioutil.ReadAll(part)
+		case "stdin":
+			stdin, err = ioutil.ReadAll(part)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if jobJSON == nil {
+		return nil, errors.New("Invalid multipart body: missing 'job' part")
+	}
+
+	spec, err := parseJobCreation(jobJSON, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if stdin != nil {
+		if len(spec.Stdin) != 0 {
+			return nil, errors.New("Invalid multipart body: stdin set in both the 'job' and 'stdin' parts")
+		}
+
+		spec.Stdin = stdin
+	}
+
+	return spec, nil
+}
+
+// parses a job creation request, either a JSON body or a multipart body with the stdin as a separate part
+func parseJobRequest(w http.ResponseWriter, r *http.Request, config *Config) (*JobSpec, error) {
+	// the stdin can be base64 encoded, taking 4/3 of the size
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxStdinSize*4/3+maxJobRequestSize)
+
+	var spec *JobSpec
+	if reader, err := r.MultipartReader(); err == nil {
+		spec, err = parseMultipartJobCreation(reader, config)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		reqBody, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		if spec, err = parseJobCreation(reqBody, config); err != nil {
+			return nil, err
+		}
+	}
+
+	if int64(len(spec.Stdin)) > config.MaxStdinSize {
+		return nil, errStdinTooLarge
+	}
+
+	return spec, nil
+}
+
+func parseOverlapPolicy(value string) (OverlapPolicy, error) {
+	switch policy := OverlapPolicy(value); policy {
+	case "":
+		return OverlapAllow, nil
+	case OverlapAllow, OverlapSkip, OverlapReplace:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("Invalid JSON schema: overlap must be one of allow, skip or replace, got '%s'", value)
+	}
+}
+
+// parses a schedule creation request, a JSON body with the cron expression and the spec of the job of each run
+func parseScheduleRequest(w http.ResponseWriter, r *http.Request, config *Config) (*ScheduleSpec, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxStdinSize*4/3+maxJobRequestSize)
+
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	createSchedule := view.ScheduleViewCommand{}
+	if err := json.Unmarshal(reqBody, &createSchedule); err != nil {
+		return nil, fmt.Errorf("Invalid JSON: %s", err)
+	}
+
+	cron, err := parseCron(createSchedule.Cron)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JSON schema: invalid cron expression, %s", err)
+	}
+
+	overlap, err := parseOverlapPolicy(createSchedule.Overlap)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := parseJobCommand(&createSchedule.Job, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if !job.StartAt.IsZero() {
+		return nil, errors.New("Invalid JSON schema: the job of a schedule can't have a start_at or start_after")
+	}
+
+	if len(job.DependsOn.Jobs) != 0 {
+		return nil, errors.New("Invalid JSON schema: the job of a schedule can't have depends_on")
+	}
+
+	if job.Array != nil {
+		return nil, errors.New("Invalid JSON schema: the job of a schedule can't be an array")
+	}
+
+	if int64(len(job.Stdin)) > config.MaxStdinSize {
+		return nil, errStdinTooLarge
+	}
+
+	return &ScheduleSpec{Cron: createSchedule.Cron, Overlap: overlap, Job: *job, cron: cron}, nil
+}
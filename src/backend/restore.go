@@ -0,0 +1,169 @@
+package backend
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const adoptedJobPollInterval = 500 * time.Millisecond
+
+// returns the state of the process and its start time in clock ticks since boot, from /proc/<pid>/stat
+func readProcessStat(pid int) (string, uint64, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", 0, err
+	}
+
+	// the process name, the 2nd field, is in parentheses and can contain spaces
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return "", 0, fmt.Errorf("invalid stat of process %d", pid)
+	}
+
+	// the fields after the name start at the 3rd, the state, and the start time is the 22nd
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return "", 0, fmt.Errorf("invalid stat of process %d", pid)
+	}
+
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	return fields[0], start, err
+}
+
+func processStartTime(pid int) (uint64, error) {
+	_, start, err := readProcessStat(pid)
+	return start, err
+}
+
+// whether the process with 'pid' is still the one that started at 'start' and hasn't exited, PIDs are reused
+func isProcessRunning(pid int, start uint64) bool {
+	state, current, err := readProcessStat(pid)
+	return err == nil && state != "Z" && start != 0 && current == start
+}
+
+// restoreJob creates a job from its saved record. A job that was executing when the server stopped is re-adopted if
+// its process is still running, otherwise it's marked as LOST. Queued jobs are returned still queued.
+func restoreJob(state *State, record *JobRecord) *Job {
+	proc, _ := os.FindProcess(record.PID) // always succeeds on Unix
+	spec := record.Spec
+
+	j := &Job{
+		id:           record.ID,
+		owner:        record.Username,
+		store:        state.store,
+		proc:         proc,
+		processStart: record.ProcessStart,
+		spec:         &spec,
+		status:       record.Status,
+		timedOut:     record.TimedOut,
+		requeue:      record.Requeue,
+		exitCode:     record.ExitCode,
+		createdAt:    record.CreatedAt,
+		startedAt:    record.StartedAt,
+		stoppedAt:    record.StoppedAt,
+		done:         make(chan struct{}),
+		history:      record.History,
+		scheduleID:   record.ScheduleID,
+		arrayID:      record.ArrayID,
+		arrayIndex:   record.ArrayIndex,
+		startAt:      record.StartAt,
+		attempts:     record.Attempts,
+		output:       restoreJobOutput(record.Output, state.outputLimits()),
+	}
+
+	if j.startAt.IsZero() {
+		j.startAt = spec.StartAt // saved before the start time was kept apart from the spec
+	}
+	state.outputBudget.use(j.attemptsOutputSizeLocked())
+
+	if j.isWaitingLocked() {
+		j.proc = nil
+		return j
+	}
+
+	if j.startedAt.IsZero() {
+		j.startedAt = j.createdAt // saved before the jobs were queued, they started once created
+	}
+
+	if !j.isExecutingLocked() {
+		close(j.done)
+		return j
+	}
+
+	if !isProcessRunning(record.PID, record.ProcessStart) {
+		// a preempted job being stopped to be requeued can be queued again
+		if j.requeue && !j.timedOut {
+			j.lock.Lock()
+			j.requeueLocked()
+			j.lock.Unlock()
+
+			return j
+		}
+
+		j.lock.Lock()
+		j.endJobLocked(JobLost)
+		j.lock.Unlock()
+
+		return j
+	}
+
+	j.adopt(state)
+	return j
+}
+
+// adopt resumes managing the process of a job that was running when the server stopped.
+// The server isn't the parent of the process anymore, so its output is no longer received and its exit code is unknown.
+func (j *Job) adopt(state *State) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if state.cgroups != nil {
+		j.cgroup = state.cgroups.openJobCgroup(j.id)
+	}
+
+	if j.status == JobStopping {
+		j.killTimer = time.AfterFunc(j.spec.StopGracePeriod, j.killAfterGracePeriod)
+	} else if j.spec.Timeout != 0 {
+		j.timer = time.AfterFunc(time.Until(j.startedAt.Add(j.spec.Timeout)), j.stopAfterTimeout)
+	}
+
+	log.Printf("Re-adopted job %s with PID %d", j.id, j.proc.Pid)
+	go j.watchAdoptedProcess(state.scheduler)
+}
+
+// polls the process of an adopted job until it exits, it can't be waited on since the server isn't its parent
+func (j *Job) watchAdoptedProcess(scheduler *scheduler) {
+	defer scheduler.release(j)
+
+	ticker := time.NewTicker(adoptedJobPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !isProcessRunning(j.proc.Pid, j.processStart) {
+			break
+		}
+	}
+
+	j.markAdoptedAsExited()
+	j.removeCgroup()
+}
+
+func (j *Job) markAdoptedAsExited() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	switch {
+	case j.requeue && !j.timedOut:
+		j.requeueLocked()
+	case j.timedOut:
+		j.endJobLocked(JobTimedOut)
+	case j.status == JobStopping:
+		j.endJobLocked(JobStopped)
+	default:
+		j.endJobLocked(JobFinished) // without an exit code
+	}
+}
@@ -0,0 +1,259 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+)
+
+const eventRetrying = "retrying" // the attempt failed and the job is scheduled to run again
+
+var (
+	ErrAttemptNotFound    = errors.New("job doesn't have this previous attempt")
+	ErrAttemptInterleaved = errors.New("only the end of each stream of the attempt is kept, read it with 'stream'")
+)
+
+// RetryPolicy is when and how often a job that failed is run again, each run is an attempt of the same job
+type RetryPolicy struct {
+	MaxAttempts int           `json:"max_attempts,omitempty"` // attempts in total including the first, the job isn't retried if 0 or 1
+	Backoff     time.Duration `json:"backoff,omitempty"`      // delay before the first retry, doubled after each attempt
+	MaxBackoff  time.Duration `json:"max_backoff,omitempty"`  // the delay doesn't grow beyond this
+	ExitCodes   []int         `json:"exit_codes,omitempty"`   // exit codes retried, any non-zero one if both 'ExitCodes' and 'Statuses' are empty
+	Statuses    []JobStatus   `json:"statuses,omitempty"`     // statuses retried among KILLED and TIMED_OUT
+}
+
+// the durations are persisted as strings, like the ones of 'JobSpec'
+func (p RetryPolicy) MarshalJSON() ([]byte, error) {
+	type plain RetryPolicy
+	return json.Marshal(struct {
+		plain
+		Backoff    string `json:"backoff,omitempty"`
+		MaxBackoff string `json:"max_backoff,omitempty"`
+	}{plain(p), formatOptionalDuration(p.Backoff), formatOptionalDuration(p.MaxBackoff)})
+}
+
+func (p *RetryPolicy) UnmarshalJSON(data []byte) error {
+	type plain RetryPolicy
+	decoded := struct {
+		*plain
+		Backoff    string `json:"backoff,omitempty"`
+		MaxBackoff string `json:"max_backoff,omitempty"`
+	}{plain: (*plain)(p)}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	var err error
+	if p.Backoff, err = parseOptionalDuration(decoded.Backoff); err != nil {
+		return err
+	}
+
+	p.MaxBackoff, err = parseOptionalDuration(decoded.MaxBackoff)
+	return err
+}
+
+// whether an attempt that ended with 'status' and 'exitCode' is retried, with 'attempts' done so far
+func (p *RetryPolicy) shouldRetry(status JobStatus, exitCode *int, attempts int) bool {
+	if attempts >= p.MaxAttempts {
+		return false
+	}
+
+	for _, retried := range p.Statuses {
+		if status == retried {
+			return true
+		}
+	}
+
+	if status != JobFinished || exitCode == nil || *exitCode == 0 {
+		return false
+	}
+
+	if len(p.ExitCodes) == 0 {
+		return len(p.Statuses) == 0
+	}
+
+	for _, code := range p.ExitCodes {
+		if *exitCode == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// delay before the attempt after 'attempts' failed ones
+func (p *RetryPolicy) backoff(attempts int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempts && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+
+	return delay
+}
+
+// bytes of the end of each stream kept of the previous attempts of a job, they count against the output budget
+const attemptOutputSize = 4 << 10
+
+// JobAttempt is a previous run of a retried job, with the end of its output and its log files, if the output is in them
+type JobAttempt struct {
+	Status        JobStatus `json:"status"`
+	ExitCode      *int      `json:"exit_code,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+	StoppedAt     time.Time `json:"stopped_at"`
+	Stdout        []byte    `json:"stdout,omitempty"`
+	Stderr        []byte    `json:"stderr,omitempty"`
+	StdoutTotal   int       `json:"stdout_total"`
+	StdoutDropped int       `json:"stdout_dropped"`
+	StderrTotal   int       `json:"stderr_total"`
+	StderrDropped int       `json:"stderr_dropped"`
+	LogPath       string    `json:"log_path,omitempty"` // path of the log files without the extension, '<log dir>/<job id>.attempt-<n>'
+}
+
+// ends the attempt, which is retried if the job's retry policy allows it or ends the job otherwise.
+// A job stopped by the user isn't retried however it exits, only the stop after its timeout can be.
+func (j *Job) endAttemptLocked(status JobStatus) {
+	attempts := len(j.attempts) + 1
+	stoppedByUser := j.status == JobStopping && !j.timedOut
+	if stoppedByUser || !j.spec.Retry.shouldRetry(status, j.exitCode, attempts) {
+		j.endJobLocked(status)
+		return
+	}
+
+	attempt := JobAttempt{Status: status, ExitCode: j.exitCode, StartedAt: j.startedAt, StoppedAt: time.Now()}
+	attempt.Stdout, attempt.StdoutTotal, attempt.StdoutDropped = j.output.attemptTail(StdoutStream)
+	attempt.Stderr, attempt.StderrTotal, attempt.StderrDropped = j.output.attemptTail(StderrStream)
+	// the log files are kept for the attempt instead of being removed with its output
+	attempt.LogPath = j.output.keepLogs(fmt.Sprintf("attempt-%d", attempts))
+	j.attempts = append(j.attempts, attempt)
+
+	delay := j.spec.Retry.backoff(attempts)
+	message := fmt.Sprintf("attempt %d of %d ended as %s", attempts, j.spec.Retry.MaxAttempts, status)
+	if j.exitCode != nil {
+		message += fmt.Sprintf(" with exit code %d", *j.exitCode)
+	}
+	j.addEventLocked(eventRetrying, fmt.Sprintf("%s, retrying in %s", message, delay))
+
+	// scheduled like a deferred job, the scheduler hands it to the timer wheel once its slot is released
+	j.resetLocked(JobScheduled)
+	j.timedOut, j.startAt = false, time.Now().Add(delay)
+	j.saveLocked()
+}
+
+// returns the end of the stream kept of an attempt, as much of the last 'attemptOutputSize' bytes as the output budget
+// allows, with the size of the stream and the number of bytes that aren't kept
+func (o *jobOutput) attemptTail(stream OutputStream) ([]byte, int, int) {
+	total := o.buffer(stream).total
+	size := o.limits.budget.reserve(minInt(total, attemptOutputSize))
+
+	tail, _ := o.read(stream, total-size)
+	if len(tail) > size {
+		tail = tail[len(tail)-size:]
+	}
+
+	// bytes of the tail that were dropped before the attempt ended aren't kept either
+	o.limits.budget.release(size - len(tail))
+	return tail, total, total - len(tail)
+}
+
+// ReadAttemptOutput reads the output of the previous attempt 'number', counted from 1, like ReadOutput. It's read from
+// the attempt's log files, or from the end of each stream that's kept when there are none.
+func (j *Job) ReadAttemptOutput(number int, stream OutputStream, offset int) ([]byte, int, error) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	if number < 1 || number > len(j.attempts) {
+		return nil, offset, ErrAttemptNotFound
+	}
+
+	return j.attempts[number-1].read(stream, offset)
+}
+
+func (a *JobAttempt) read(stream OutputStream, offset int) ([]byte, int, error) {
+	total := a.StdoutTotal + a.StderrTotal
+	tail := []byte(nil)
+	switch stream {
+	case StdoutStream:
+		total, tail = a.StdoutTotal, a.Stdout
+	case StderrStream:
+		total, tail = a.StderrTotal, a.Stderr
+	}
+
+	if offset >= total {
+		return nil, offset, nil
+	}
+
+	if a.LogPath == "" {
+		if stream == BothStreams {
+			return nil, offset, ErrAttemptInterleaved
+		}
+
+		// the bytes before the tail weren't kept
+		start := total - len(tail)
+		if offset < start {
+			offset = start
+		}
+
+		return tail[offset-start:], total, nil
+	}
+
+	logs := &outputLogs{path: a.LogPath, lastIndex: -1}
+	var output []byte
+	var err error
+	if stream == BothStreams {
+		output, err = logs.readInterleaved(offset, maxLogReadSize)
+	} else {
+		output, err = logs.readStream(stream, offset, minInt(total, offset+maxLogReadSize))
+	}
+
+	if err != nil {
+		log.Printf("Failed to read the log files %s: %s", a.LogPath, err)
+		return nil, offset, nil
+	}
+
+	return output, offset + len(output), nil
+}
+
+// removes the log files of the previous attempts
+func (j *Job) removeAttemptLogsLocked() {
+	for _, attempt := range j.attempts {
+		if attempt.LogPath == "" {
+			continue
+		}
+
+		if err := (&outputLogs{path: attempt.LogPath}).remove(); err != nil {
+			log.Printf("Failed to remove the log files %s: %s", attempt.LogPath, err)
+		}
+	}
+}
+
+// bytes of output kept of the previous attempts
+func (j *Job) attemptsOutputSizeLocked() int {
+	size := 0
+	for _, attempt := range j.attempts {
+		size += len(attempt.Stdout) + len(attempt.Stderr)
+	}
+
+	return size
+}
+
+func attemptView(number int, attempt *JobAttempt) view.JobViewAttempt {
+	return view.JobViewAttempt{
+		Attempt:    number,
+		Status:     string(attempt.Status),
+		ExitCode:   attempt.ExitCode,
+		StartedAt:  attempt.StartedAt,
+		StoppedAt:  attempt.StoppedAt,
+		Stdout:     string(attempt.Stdout),
+		Stderr:     string(attempt.Stderr),
+		StdoutSize: outputSizeView(attempt.StdoutTotal, attempt.StdoutDropped),
+		StderrSize: outputSizeView(attempt.StderrTotal, attempt.StderrDropped),
+	}
+}
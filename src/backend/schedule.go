@@ -0,0 +1,301 @@
+package backend
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+	"github.com/google/uuid"
+)
+
+// OverlapPolicy is what a schedule does when it fires while its previous run is still going
+type OverlapPolicy string
+
+const (
+	OverlapAllow   OverlapPolicy = "allow"   // the new run starts anyway
+	OverlapSkip    OverlapPolicy = "skip"    // the new run is skipped
+	OverlapReplace OverlapPolicy = "replace" // the previous run is stopped and the new run starts once it ended
+)
+
+var ErrScheduleNotFound = errors.New("invalid schedule ID")
+
+// ScheduleSpec is a validated schedule creation request
+type ScheduleSpec struct {
+	Cron    string        // cron expression, evaluated in the server's time zone
+	Overlap OverlapPolicy // what to do when it fires while the previous run is still going
+	Job     JobSpec       // spec of the job started by each run
+	cron    *cronSchedule // parsed 'Cron'
+}
+
+// Schedule starts a job each time its cron expression fires. Runs that were missed while the server was stopped
+// aren't started after a restart.
+type Schedule struct {
+	lock      sync.Mutex // synchronizes access to all of the fields of the struct
+	id        string     // ID exposed to the client (UUID), NOT EMPTY, UNIQUE
+	user      *User      // user the schedule belongs to, its runs are started as them
+	state     *State     // where the runs are submitted and the schedule's record is saved
+	spec      *ScheduleSpec
+	paused    bool
+	createdAt time.Time
+	nextRunAt time.Time   // zero if paused or the expression never matches again
+	lastRunAt time.Time   // zero if it never fired
+	runs      []string    // IDs of the jobs started by the schedule, the latest last
+	skipped   int         // runs skipped because the previous run was still going
+	lastError string      // why the last run failed to start, empty if it started
+	timer     *time.Timer // fires the next run, nil if paused or removed
+	armed     int         // incremented each time the timer is set, to ignore a timer that fired before being replaced
+}
+
+// CreateSchedule creates a schedule for the user, which fires from now on
+func CreateSchedule(state *State, user *User, spec *ScheduleSpec) (*Schedule, error) {
+	if err := checkJobAllowed(state, user, &spec.Job); err != nil {
+		return nil, err
+	}
+
+	schedule := &Schedule{
+		id:        uuid.NewString(),
+		user:      user,
+		state:     state,
+		spec:      spec,
+		createdAt: time.Now(),
+	}
+
+	schedule.lock.Lock()
+	defer schedule.lock.Unlock()
+
+	schedule.armLocked(schedule.createdAt)
+	schedule.saveLocked()
+	user.AddSchedule(schedule)
+
+	return schedule, nil
+}
+
+func restoreSchedule(state *State, user *User, record *ScheduleRecord) (*Schedule, error) {
+	cron, err := parseCron(record.Cron)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := &Schedule{
+		id:        record.ID,
+		user:      user,
+		state:     state,
+		spec:      &ScheduleSpec{Cron: record.Cron, Overlap: record.Overlap, Job: record.Job, cron: cron},
+		paused:    record.Paused,
+		createdAt: record.CreatedAt,
+		lastRunAt: record.LastRunAt,
+		runs:      record.Runs,
+		skipped:   record.Skipped,
+		lastError: record.LastError,
+	}
+
+	if !schedule.paused {
+		schedule.lock.Lock()
+		schedule.armLocked(time.Now())
+		schedule.lock.Unlock()
+	}
+
+	return schedule, nil
+}
+
+func (s *Schedule) GetID() string {
+	// not necessary to synchronize since 'id' isn't modified after creation
+	return s.id
+}
+
+// sets the timer for the first time the expression matches after 'after'
+func (s *Schedule) armLocked(after time.Time) {
+	s.nextRunAt = s.spec.cron.next(after)
+	if s.nextRunAt.IsZero() {
+		s.timer = nil
+		return
+	}
+
+	s.armed++
+	armed := s.armed
+	s.timer = time.AfterFunc(time.Until(s.nextRunAt), func() { s.fire(armed) })
+}
+
+func (s *Schedule) stopLocked() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.nextRunAt = time.Time{}
+}
+
+func (s *Schedule) fire(armed int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// paused, resumed or removed after the timer fired
+	if s.timer == nil || s.armed != armed {
+		return
+	}
+
+	// the timer can fire slightly early, the next run is after the one that fired
+	firedAt := s.nextRunAt
+	s.runLocked()
+	s.armLocked(firedAt)
+}
+
+// returns the IDs of the runs that weren't removed
+func (s *Schedule) existingRunsLocked() []string {
+	runs := []string{}
+	for _, id := range s.runs {
+		if s.user.GetJob(id) != nil {
+			runs = append(runs, id)
+		}
+	}
+
+	return runs
+}
+
+// returns the IDs of the runs that didn't end
+func (s *Schedule) runningRunsLocked() []string {
+	runs := []string{}
+	for _, id := range s.runs {
+		if job := s.user.GetJob(id); job != nil {
+			if _, ended := job.getEndedAt(); !ended {
+				runs = append(runs, id)
+			}
+		}
+	}
+
+	return runs
+}
+
+// returns the last run that wasn't removed, nil if there's none
+func (s *Schedule) lastRunLocked() *Job {
+	if len(s.runs) == 0 {
+		return nil
+	}
+
+	return s.user.GetJob(s.runs[len(s.runs)-1])
+}
+
+func (s *Schedule) runLocked() {
+	spec := s.spec.Job
+	if previous := s.lastRunLocked(); previous != nil {
+		if _, ended := previous.getEndedAt(); !ended {
+			switch s.spec.Overlap {
+			case OverlapSkip:
+				s.skipped++
+				s.saveLocked()
+				return
+
+			case OverlapReplace:
+				if err := s.state.StopJob(previous, false); err != nil {
+					log.Printf("Failed to stop the previous run %s of schedule %s: %s", previous.GetID(), s.id, err)
+				}
+
+				// the new run waits for the stopped runs to exit, which can take their stop grace period
+				spec.DependsOn = Dependencies{Jobs: s.runningRunsLocked(), Condition: DependOnAny}
+			}
+		}
+	}
+
+	job, err := submitJob(s.state, s.user, &spec, jobOrigin{scheduleID: s.id})
+	s.lastRunAt = time.Now()
+	if err != nil {
+		log.Printf("Failed to start a run of schedule %s, because: %s", s.id, err)
+		s.lastError = err.Error()
+	} else {
+		s.runs = append(s.existingRunsLocked(), job.GetID())
+		s.lastError = ""
+	}
+
+	s.saveLocked()
+}
+
+// Pause stops the schedule from firing until it's resumed
+func (s *Schedule) Pause() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.paused {
+		return
+	}
+
+	s.paused = true
+	s.stopLocked()
+	s.saveLocked()
+}
+
+// Resume makes a paused schedule fire again, the runs missed while paused aren't started
+func (s *Schedule) Resume() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.paused {
+		return
+	}
+
+	s.paused = false
+	s.armLocked(time.Now())
+	s.saveLocked()
+}
+
+// stops the schedule from firing for good, its runs aren't affected
+func (s *Schedule) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stopLocked()
+}
+
+func (s *Schedule) saveLocked() {
+	if err := s.state.store.SaveSchedule(s.recordLocked()); err != nil {
+		log.Printf("Failed to save schedule %s: %s", s.id, err)
+	}
+}
+
+func (s *Schedule) recordLocked() *ScheduleRecord {
+	return &ScheduleRecord{
+		ID:        s.id,
+		Username:  s.user.username,
+		Cron:      s.spec.Cron,
+		Overlap:   s.spec.Overlap,
+		Job:       s.spec.Job,
+		Paused:    s.paused,
+		CreatedAt: s.createdAt,
+		LastRunAt: s.lastRunAt,
+		Runs:      append([]string(nil), s.runs...),
+		Skipped:   s.skipped,
+		LastError: s.lastError,
+	}
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+func (s *Schedule) AsView() view.ScheduleViewFull {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	job := jobSpecView(&s.spec.Job)
+	return view.ScheduleViewFull{
+		ScheduleViewPartial: view.ScheduleViewPartial{
+			ScheduleViewCommand: view.ScheduleViewCommand{
+				Cron:    s.spec.Cron,
+				Overlap: string(s.spec.Overlap),
+				Job:     job,
+			},
+			ID:        s.id,
+			Paused:    s.paused,
+			CreatedAt: s.createdAt,
+			NextRunAt: optionalTime(s.nextRunAt),
+			LastRunAt: optionalTime(s.lastRunAt),
+		},
+		Runs:      s.existingRunsLocked(),
+		Skipped:   s.skipped,
+		LastError: s.lastError,
+	}
+}
@@ -0,0 +1,419 @@
+package backend
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// PreemptionMode is how a queued job takes the slot of a running job with a lower priority
+type PreemptionMode string
+
+const (
+	PreemptionOff     PreemptionMode = "off"     // queued jobs wait for running jobs to end
+	PreemptionSuspend PreemptionMode = "suspend" // the running job is paused with SIGSTOP and continued once there's a slot
+	PreemptionRequeue PreemptionMode = "requeue" // the running job is stopped and queued again, it restarts from scratch
+)
+
+// a job waiting for a free slot, with the user it runs as
+type queuedJob struct {
+	user *User
+	job  *Job
+}
+
+// a stop requested by the user while the job was being started, applied once it started
+type startingJob struct {
+	stopped bool
+	force   bool
+}
+
+// scheduler limits how many jobs run at once, server wide and for each user. Jobs that can't start right away wait
+// in a queue ordered by priority, and by submission for the same priority, and are started as running jobs end.
+// Among the queued jobs of the highest priority that can start, the policy picks the one started next.
+// A queued job only waits while its own user is at their limit, jobs of other users behind it can still start.
+// Suspended jobs wait in the queue too, and are continued instead of started.
+// The jobs are picked and given their slot under the lock, and started outside of it, so that starting a process
+// doesn't hold back the other jobs starting and ending.
+type scheduler struct {
+	lock              sync.Mutex
+	maxRunning        int                  // jobs running at once on the server, no maximum if 0
+	maxRunningPerUser int                  // jobs running at once for each user, no maximum if 0
+	preemption        PreemptionMode       // how queued jobs take the slots of running jobs with a lower priority
+	running           map[*Job]*User       // jobs using a slot, started by the scheduler or re-adopted
+	starting          map[*Job]startingJob // jobs given a slot that are being started outside of the lock
+	runningPerUser    map[string]int       // number of running jobs of each user, index key is the username
+	queue             []*queuedJob         // jobs waiting for a slot, the next to start first
+	preempting        *Job                 // job being stopped to be requeued, nil if none. Only one is stopped at a time
+	policyName        SchedulingPolicy
+	policy            queuePolicy
+	usage             map[string]cpuUsage // CPU time recently used by the jobs of each user, index key is the username
+	halfLife          time.Duration       // time after which the CPU time used by a user counts half as much
+	start             func(user *User, job *Job) error
+	retry             func(user *User, job *Job) // schedules a job whose attempt failed, to be submitted again later
+}
+
+func newScheduler(config *Config, start func(user *User, job *Job) error, retry func(user *User, job *Job)) *scheduler {
+	return &scheduler{
+		maxRunning:        config.MaxRunningJobs,
+		maxRunningPerUser: config.MaxRunningJobsPerUser,
+		preemption:        config.Preemption,
+		running:           map[*Job]*User{},
+		starting:          map[*Job]startingJob{},
+		runningPerUser:    map[string]int{},
+		policyName:        config.SchedulingPolicy,
+		policy:            newQueuePolicy(config.SchedulingPolicy),
+		usage:             map[string]cpuUsage{},
+		halfLife:          config.FairShareHalfLife,
+		start:             start,
+		retry:             retry,
+	}
+}
+
+func (s *scheduler) isFullLocked() bool {
+	return s.maxRunning != 0 && len(s.running) >= s.maxRunning
+}
+
+func (s *scheduler) isUserFullLocked(username string) bool {
+	return s.maxRunningPerUser != 0 && s.runningPerUser[username] >= s.maxRunningPerUser
+}
+
+func (s *scheduler) hasSlotLocked(username string) bool {
+	return !s.isFullLocked() && !s.isUserFullLocked(username)
+}
+
+func (s *scheduler) trackLocked(user *User, job *Job) {
+	s.running[job] = user
+	s.runningPerUser[user.username]++
+}
+
+func (s *scheduler) untrackLocked(job *Job) {
+	user := s.running[job]
+	delete(s.running, job)
+	if s.runningPerUser[user.username]--; s.runningPerUser[user.username] == 0 {
+		delete(s.runningPerUser, user.username)
+	}
+}
+
+// inserts the job after the queued jobs with the same or a higher priority
+func (s *scheduler) insertLocked(user *User, job *Job) {
+	position := len(s.queue)
+	for i, queued := range s.queue {
+		if queued.job.spec.Priority < job.spec.Priority {
+			position = i
+			break
+		}
+	}
+
+	s.queue = append(s.queue, nil)
+	copy(s.queue[position+1:], s.queue[position:])
+	s.queue[position] = &queuedJob{user: user, job: job}
+}
+
+func (s *scheduler) removeLocked(job *Job) bool {
+	for i, queued := range s.queue {
+		if queued.job == job {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// submit starts the job if there's a free slot, returning the error if it fails to start, or queues it otherwise.
+// No queued job can take the slot instead, since the queue is dispatched every time a slot is freed.
+func (s *scheduler) submit(user *User, job *Job) error {
+	picked, queued := s.pick(user, job)
+	if queued {
+		s.startPicked(picked)
+		return nil
+	}
+
+	err := s.start(user, job)
+	s.startPicked(s.started(job, err))
+	return err
+}
+
+// gives the job a slot if there's a free one, or queues it and returns the queued jobs to start
+func (s *scheduler) pick(user *User, job *Job) ([]*queuedJob, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.hasSlotLocked(user.username) {
+		s.insertLocked(user, job)
+		return s.dispatchLocked(), true // it can preempt a running job
+	}
+
+	s.trackLocked(user, job)
+	s.starting[job] = startingJob{}
+	return nil, false
+}
+
+// starts the jobs picked from the queue, outside of the lock. A job that fails to start is killed, and its slot
+// is given to the next queued jobs.
+func (s *scheduler) startPicked(picked []*queuedJob) {
+	for len(picked) != 0 {
+		queued := picked[0]
+		picked = picked[1:]
+
+		err := s.start(queued.user, queued.job)
+		if err != nil {
+			log.Printf("Failed to start queued job %s, because: %s", queued.job.GetID(), err)
+			queued.job.MarkAsKilled()
+		}
+
+		picked = append(picked, s.started(queued.job, err)...)
+	}
+}
+
+// started is called once a job given a slot was started, with the error if it failed to start, which frees its slot.
+// The job is stopped if the user stopped it meanwhile. Returns the queued jobs to start.
+func (s *scheduler) started(job *Job, err error) []*queuedJob {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	starting := s.starting[job]
+	delete(s.starting, job)
+
+	if err != nil {
+		s.untrackLocked(job)
+		return s.dispatchLocked()
+	}
+
+	if starting.stopped {
+		if err := job.StopJob(starting.force); err != nil {
+			log.Printf("Failed to stop job %s, because: %s", job.GetID(), err)
+		}
+	}
+
+	return nil
+}
+
+// enqueue adds a restored queued or suspended job to the queue, without starting it
+func (s *scheduler) enqueue(user *User, job *Job) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.insertLocked(user, job)
+}
+
+// adopted counts a re-adopted job as running, release must be called once it ends
+func (s *scheduler) adopted(user *User, job *Job) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.trackLocked(user, job)
+}
+
+// release is called when the process of a job ends. It frees the job's slot, or removes it from the queue if it
+// was suspended, and starts the queued jobs that can use it. A preempted job is queued again, and a failed job
+// that is retried is scheduled.
+func (s *scheduler) release(job *Job) {
+	s.startPicked(s.releaseSlot(job))
+}
+
+func (s *scheduler) releaseSlot(job *Job) []*queuedJob {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.preempting == job {
+		s.preempting = nil
+	}
+
+	if user, ok := s.running[job]; ok {
+		s.untrackLocked(job)
+		switch job.GetStatus() {
+		case JobQueued:
+			s.insertLocked(user, job)
+		case JobScheduled:
+			s.retry(user, job)
+		}
+	} else {
+		s.removeLocked(job)
+	}
+
+	return s.dispatchLocked()
+}
+
+// dispatch starts the queued jobs that have a free slot
+func (s *scheduler) dispatch() {
+	s.startPicked(s.dispatchPicked())
+}
+
+func (s *scheduler) dispatchPicked() []*queuedJob {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.dispatchLocked()
+}
+
+// gives the free slots to the queued jobs, returns the ones to start with 'startPicked' once the lock is released
+func (s *scheduler) dispatchLocked() []*queuedJob {
+	picked := []*queuedJob{}
+	for {
+		picked = s.pickQueuedLocked(picked)
+		if len(s.queue) == 0 || !s.preemptLocked() {
+			return picked
+		}
+	}
+}
+
+// continues the suspended jobs that have a slot, and appends the queued jobs given a slot to 'picked'
+func (s *scheduler) pickQueuedLocked(picked []*queuedJob) []*queuedJob {
+	s.dropEndedLocked()
+
+	for !s.isFullLocked() {
+		next := s.nextLocked()
+		if next < 0 {
+			return picked
+		}
+
+		queued := s.queue[next]
+		s.queue = append(s.queue[:next], s.queue[next+1:]...)
+
+		if queued.job.GetStatus() == JobSuspended {
+			if err := queued.job.resume(); err != nil {
+				log.Printf("Failed to resume job %s, because: %s", queued.job.GetID(), err)
+			}
+		} else {
+			s.starting[queued.job] = startingJob{}
+			picked = append(picked, queued)
+		}
+
+		s.trackLocked(queued.user, queued.job)
+	}
+
+	return picked
+}
+
+// removes the jobs that were cancelled, or stopped by the user while suspended
+func (s *scheduler) dropEndedLocked() {
+	waiting := s.queue[:0]
+	for _, queued := range s.queue {
+		if status := queued.job.GetStatus(); status == JobQueued || status == JobSuspended {
+			waiting = append(waiting, queued)
+		}
+	}
+
+	// clears the references left after the jobs that remain
+	for i := len(waiting); i < len(s.queue); i++ {
+		s.queue[i] = nil
+	}
+	s.queue = waiting
+}
+
+// returns the index in the queue of the job started next, the policy's pick among the jobs of the highest priority
+// whose user has a free slot, -1 if none can start
+func (s *scheduler) nextLocked() int {
+	first := -1
+	candidates := []*queuedJob{}
+	for i, queued := range s.queue {
+		if first >= 0 && queued.job.spec.Priority != s.queue[first].job.spec.Priority {
+			break
+		}
+
+		if !s.hasSlotLocked(queued.user.username) {
+			continue
+		}
+
+		if first < 0 {
+			first = i
+		}
+		candidates = append(candidates, queued)
+	}
+
+	if first < 0 {
+		return -1
+	}
+
+	picked := candidates[s.policy.pick(s, candidates)]
+	for i := first; i < len(s.queue); i++ {
+		if s.queue[i] == picked {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// finds a running job to preempt for the first queued job that can take its slot, returns whether a slot was freed
+func (s *scheduler) preemptLocked() bool {
+	if s.preemption == PreemptionOff || s.preempting != nil {
+		return false
+	}
+
+	for _, queued := range s.queue {
+		victim := s.findVictimLocked(queued)
+		if victim == nil {
+			continue
+		}
+
+		by := queued.job.GetID()
+		if s.preemption == PreemptionRequeue {
+			if err := victim.preempt(by); err != nil {
+				log.Printf("Failed to preempt job %s, because: %s", victim.GetID(), err)
+				return false
+			}
+
+			// the slot is only freed once the job ends
+			s.preempting = victim
+			return false
+		}
+
+		if err := victim.suspend(by); err != nil {
+			log.Printf("Failed to suspend job %s, because: %s", victim.GetID(), err)
+			return false
+		}
+
+		user := s.running[victim]
+		s.untrackLocked(victim)
+		s.insertLocked(user, victim)
+		return true
+	}
+
+	return false
+}
+
+// returns the running job with the lowest priority, and the last to start among those, whose slot the queued job
+// could take, nil if there's none with a lower priority
+func (s *scheduler) findVictimLocked(queued *queuedJob) *Job {
+	if queued.job.GetStatus() != JobQueued && queued.job.GetStatus() != JobSuspended {
+		return nil
+	}
+
+	// a user at their limit can only take the slot of one of their own jobs
+	sameUser := s.isUserFullLocked(queued.user.username)
+
+	var victim *Job
+	for job, user := range s.running {
+		if job.spec.Priority >= queued.job.spec.Priority || (sameUser && user != queued.user) || job.GetStatus() != JobRunning {
+			continue
+		}
+
+		if victim == nil || job.spec.Priority < victim.spec.Priority ||
+			(job.spec.Priority == victim.spec.Priority && job.getStartedAt().After(victim.getStartedAt())) {
+			victim = job
+		}
+	}
+
+	return victim
+}
+
+// cancel removes the job from the queue and marks it as stopped, returns false if the job isn't queued or scheduled.
+// A job being started is stopped once it started.
+func (s *scheduler) cancel(job *Job, force bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if starting, ok := s.starting[job]; ok {
+		s.starting[job] = startingJob{stopped: true, force: starting.force || force}
+		return true
+	}
+
+	if !job.cancel() {
+		return false
+	}
+
+	s.removeLocked(job)
+	return true
+}
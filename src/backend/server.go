@@ -3,20 +3,21 @@ package backend
 import (
 	"encoding/json"
 	"errors"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/Ross65536/job-scheduler/src/core/view"
 	"github.com/gorilla/mux"
 )
 
 type Server struct {
-	state  *State
-	router *mux.Router
+	state    *State
+	router   *mux.Router
+	limiters *requestLimiters // rate limits of the requests
 }
 
 func (s *Server) GetRouter() http.Handler {
@@ -33,10 +34,35 @@ func (s *Server) addRoutes() {
 	jobsRouter := s.router.PathPrefix("/api/jobs/{id}").Subrouter()
 	jobsRouter.HandleFunc("", s.authMiddleware(s.jobIDMiddleware(s.getJob))).Methods("GET")
 	jobsRouter.HandleFunc("", s.authMiddleware(s.jobIDMiddleware(s.stopJob))).Methods("DELETE")
+	jobsRouter.HandleFunc("/logs", s.authMiddleware(s.jobIDMiddleware(s.getJobLogs))).Methods("GET")
+	jobsRouter.HandleFunc("/attach", s.authMiddleware(s.jobIDMiddleware(s.attachJob))).Methods("GET")
+	jobsRouter.HandleFunc("/purge", s.authMiddleware(s.purgeJob)).Methods("POST")
+	jobsRouter.HandleFunc("/resize", s.authMiddleware(s.jobIDMiddleware(s.resizeJobTerminal))).Methods("POST")
+	jobsRouter.HandleFunc("/dag", s.authMiddleware(s.getJobGraph)).Methods("GET")
+
+	s.router.HandleFunc("/api/arrays", s.authMiddleware(s.getJobArrays)).Methods("GET")
+	arraysRouter := s.router.PathPrefix("/api/arrays/{id}").Subrouter()
+	arraysRouter.HandleFunc("", s.authMiddleware(s.getJobArray)).Methods("GET")
+	arraysRouter.HandleFunc("", s.authMiddleware(s.stopJobArray)).Methods("DELETE")
+
+	s.router.HandleFunc("/api/quota", s.authMiddleware(s.getQuota)).Methods("GET")
+
+	s.router.HandleFunc("/api/admin/scheduler", s.authMiddleware(s.adminMiddleware(s.getScheduler))).Methods("GET")
+	s.router.HandleFunc("/api/admin/users/reload", s.authMiddleware(s.adminMiddleware(s.reloadUsers))).Methods("POST")
+
+	topSchedulesRouter := s.router.PathPrefix("/api/schedules").Subrouter()
+	topSchedulesRouter.HandleFunc("", s.authMiddleware(s.getSchedules)).Methods("GET")
+	topSchedulesRouter.HandleFunc("", s.authMiddleware(s.createSchedule)).Methods("POST")
+
+	schedulesRouter := s.router.PathPrefix("/api/schedules/{id}").Subrouter()
+	schedulesRouter.HandleFunc("", s.authMiddleware(s.scheduleIDMiddleware(s.getSchedule))).Methods("GET")
+	schedulesRouter.HandleFunc("", s.authMiddleware(s.deleteSchedule)).Methods("DELETE")
+	schedulesRouter.HandleFunc("/pause", s.authMiddleware(s.scheduleIDMiddleware(s.pauseSchedule))).Methods("POST")
+	schedulesRouter.HandleFunc("/resume", s.authMiddleware(s.scheduleIDMiddleware(s.resumeSchedule))).Methods("POST")
 }
 
 func NewServer(state *State) (*Server, error) {
-	s := &Server{state: state, router: mux.NewRouter().StrictSlash(true)}
+	s := &Server{state: state, router: mux.NewRouter().StrictSlash(true), limiters: newRequestLimiters(&state.config)}
 	s.addRoutes()
 
 	return s, nil
@@ -61,6 +87,10 @@ func (s *Server) checkAuth(r *http.Request) (*User, error) {
 		return nil, errors.New("Invalid username")
 	}
 
+	if user.IsRemoved() {
+		return nil, errors.New("User was removed")
+	}
+
 	if !user.IsTokenMatching(password) {
 		return user, errors.New("Invalid token")
 	}
@@ -70,15 +100,32 @@ func (s *Server) checkAuth(r *http.Request) (*User, error) {
 
 func (s *Server) authMiddleware(next func(http.ResponseWriter, *http.Request, *User)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// the client IP is limited before authenticating, so that requests with invalid credentials are limited too
+		userLimiter, ipLimiter := s.limiters.forRequest(r)
+		if !allowRequest(w, ipLimiter, clientIP(r)) {
+			return
+		}
+
 		if user, err := s.checkAuth(r); err != nil {
 			log.Printf("Invalid user tried to access API: %s", err)
 			WriteJSONError(w, http.StatusUnauthorized, "Invalid user credentials")
-		} else {
+		} else if allowRequest(w, userLimiter, user.username) {
 			next(w, r, user)
 		}
 	}
 }
 
+func (s *Server) adminMiddleware(next func(http.ResponseWriter, *http.Request, *User)) func(w http.ResponseWriter, r *http.Request, user *User) {
+	return func(w http.ResponseWriter, r *http.Request, user *User) {
+		if !user.IsAdmin() {
+			WriteJSONError(w, http.StatusForbidden, "only admins can access this endpoint")
+			return
+		}
+
+		next(w, r, user)
+	}
+}
+
 func (s *Server) jobIDMiddleware(next func(http.ResponseWriter, *http.Request, *Job)) func(w http.ResponseWriter, r *http.Request, user *User) {
 	return func(w http.ResponseWriter, r *http.Request, user *User) {
 		id := mux.Vars(r)["id"]
@@ -92,12 +139,152 @@ func (s *Server) jobIDMiddleware(next func(http.ResponseWriter, *http.Request, *
 	}
 }
 
+func (s *Server) scheduleIDMiddleware(next func(http.ResponseWriter, *http.Request, *Schedule)) func(w http.ResponseWriter, r *http.Request, user *User) {
+	return func(w http.ResponseWriter, r *http.Request, user *User) {
+		schedule := user.GetSchedule(mux.Vars(r)["id"])
+		if schedule == nil {
+			WriteJSONError(w, http.StatusNotFound, ErrScheduleNotFound.Error())
+			return
+		}
+
+		next(w, r, schedule)
+	}
+}
+
 func (s *Server) getJob(w http.ResponseWriter, r *http.Request, job *Job) {
 	WriteJSON(w, http.StatusOK, job.AsView())
 }
 
+func parseLogsQuery(query url.Values) (stream OutputStream, offset int, follow bool, err error) {
+	stream = OutputStream(query.Get("stream"))
+	switch stream {
+	case "":
+		stream = BothStreams
+	case StdoutStream, StderrStream, BothStreams:
+	default:
+		return "", 0, false, errors.New("stream must be one of 'stdout', 'stderr' or 'both'")
+	}
+
+	if value := query.Get("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			return "", 0, false, errors.New("offset must be a positive integer")
+		}
+	}
+
+	return stream, offset, query.Get("follow") == "true", nil
+}
+
+func (s *Server) getJobLogs(w http.ResponseWriter, r *http.Request, job *Job) {
+	stream, offset, follow, err := parseLogsQuery(r.URL.Query())
+	if err != nil {
+		WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if value := r.URL.Query().Get("attempt"); value != "" {
+		attempt, err := strconv.Atoi(value)
+		if err != nil || attempt < 1 {
+			WriteJSONError(w, http.StatusUnprocessableEntity, "attempt must be a positive integer")
+			return
+		}
+
+		s.getAttemptLogs(w, job, attempt, stream, offset)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		output, next, executing, updated := job.ReadOutput(stream, offset)
+		offset = next
+		if len(output) != 0 {
+			if _, err := w.Write(output); err != nil {
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			// reads of the log files are limited in size, more output can be available
+			continue
+		}
+
+		if !follow || !executing {
+			return
+		}
+
+		select {
+		case <-updated:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// getAttemptLogs writes the output of a previous attempt of the job, which ended so it can't be followed
+func (s *Server) getAttemptLogs(w http.ResponseWriter, job *Job, attempt int, stream OutputStream, offset int) {
+	output, next, err := job.ReadAttemptOutput(attempt, stream, offset)
+	switch err {
+	case nil:
+	case ErrAttemptNotFound:
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+		return
+	case ErrAttemptInterleaved:
+		WriteJSONError(w, http.StatusConflict, err.Error())
+		return
+	default:
+		log.Printf("Something went wrong reading the output of an attempt: %s", err)
+		WriteJSONError(w, http.StatusInternalServerError, "Failed to read the output of the attempt")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+
+	// reads of the log files are limited in size, the attempt is read until no more bytes are returned
+	for len(output) != 0 {
+		if _, err := w.Write(output); err != nil {
+			return
+		}
+
+		if output, next, err = job.ReadAttemptOutput(attempt, stream, next); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) resizeJobTerminal(w http.ResponseWriter, r *http.Request, job *Job) {
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		WriteJSONError(w, http.StatusUnprocessableEntity, "Failed to read POST body")
+		return
+	}
+
+	size := view.JobViewTerminalSize{}
+	if err := json.Unmarshal(reqBody, &size); err != nil || size.Rows == 0 || size.Cols == 0 {
+		WriteJSONError(w, http.StatusUnprocessableEntity, "Invalid JSON schema: 'rows' and 'cols' must be positive integers")
+		return
+	}
+
+	if err := job.ResizeTerminal(size.Rows, size.Cols); err == ErrNoTerminal {
+		WriteJSONError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("Something went wrong resizing the terminal of job: %s", err)
+		WriteJSONError(w, http.StatusInternalServerError, "Failed to resize terminal")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Server) stopJob(w http.ResponseWriter, r *http.Request, job *Job) {
-	if err := job.StopJob(); err != nil {
+	force := r.URL.Query().Get("force") == "true"
+
+	if err := s.state.StopJob(job, force); err != nil {
 		log.Printf("Something went wrong stopping job: %s", err)
 		WriteJSONError(w, http.StatusInternalServerError, "Failed to stop job")
 		return
@@ -106,61 +293,211 @@ func (s *Server) stopJob(w http.ResponseWriter, r *http.Request, job *Job) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// purgeJob removes a job that ended and its output, unlike stopping it which keeps its record
+func (s *Server) purgeJob(w http.ResponseWriter, r *http.Request, user *User) {
+	switch err := user.RemoveJob(mux.Vars(r)["id"]); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ErrJobNotFound:
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+	case ErrJobRunning:
+		WriteJSONError(w, http.StatusConflict, "job is still running, it must be stopped first")
+	default:
+		log.Printf("Something went wrong removing job: %s", err)
+		WriteJSONError(w, http.StatusInternalServerError, "Failed to remove job")
+	}
+}
+
+// getJobGraph returns the jobs connected to the job through their dependencies
+func (s *Server) getJobGraph(w http.ResponseWriter, r *http.Request, user *User) {
+	graph, err := user.GetJobGraph(mux.Vars(r)["id"])
+	if err != nil {
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, graph)
+}
+
 func (s *Server) getJobs(w http.ResponseWriter, r *http.Request, user *User) {
 	jobs := user.GetAllJobs()
 	jobViews := make([]view.JobViewPartial, 0, len(jobs))
 
 	for _, v := range jobs {
-		jobViews = append(jobViews, v.AsView().JobViewPartial)
+		jobViews = append(jobViews, v.AsPartialView())
 	}
 
 	WriteJSON(w, http.StatusOK, jobViews)
 }
 
-func isCommandValid(command []string) error {
-	if len(command) == 0 {
-		return errors.New("Invalid JSON schema: command must have at least 1 element")
+func (s *Server) createJob(w http.ResponseWriter, r *http.Request, user *User) {
+	spec, err := parseJobRequest(w, r, &s.state.config)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if err == errStdinTooLarge || errors.As(err, &maxBytesErr) {
+			WriteJSONError(w, http.StatusRequestEntityTooLarge, errStdinTooLarge.Error())
+		} else {
+			WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		}
+		return
 	}
 
-	if program := command[0]; len(strings.TrimSpace(program)) == 0 {
-		return errors.New("Invalid JSON schema: command must have at least 1 non-empty element")
+	if spec.Limits != (view.JobViewLimits{}) && s.state.cgroups == nil {
+		WriteJSONError(w, http.StatusUnprocessableEntity, "Resource limits aren't enabled on this server")
+		return
 	}
 
-	// TODO: add more sanity checks like invalid characters, etc
+	if spec.Array != nil {
+		s.createJobArray(w, user, spec)
+		return
+	}
+
+	if job, err := SubmitJob(s.state, user, spec); err == ErrNoCredential || err == ErrPriorityTooHigh {
+		WriteJSONError(w, http.StatusForbidden, err.Error())
+	} else if errors.Is(err, ErrDependencyNotFound) {
+		WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+	} else if errors.Is(err, ErrQuotaExceeded) {
+		WriteJSONError(w, http.StatusTooManyRequests, err.Error())
+	} else if err != nil {
+		log.Printf("Failed to start job %s, because: %s", spec.Command, err)
+		WriteJSONError(w, http.StatusInternalServerError, "Failed to start job")
+	} else {
+		WriteJSON(w, http.StatusCreated, job.AsPartialView())
+	}
+}
+
+// createJobArray submits a job for each index of the array, and returns the array's ID to access them together
+func (s *Server) createJobArray(w http.ResponseWriter, user *User, spec *JobSpec) {
+	if arrayID, err := SubmitJobArray(s.state, user, spec); err == ErrNoCredential || err == ErrPriorityTooHigh {
+		WriteJSONError(w, http.StatusForbidden, err.Error())
+	} else if errors.Is(err, ErrDependencyNotFound) {
+		WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+	} else if errors.Is(err, ErrQuotaExceeded) {
+		WriteJSONError(w, http.StatusTooManyRequests, err.Error())
+	} else if err != nil {
+		log.Printf("Failed to start job array %s, because: %s", spec.Command, err)
+		WriteJSONError(w, http.StatusInternalServerError, "Failed to start job array")
+	} else if array, err := user.GetJobArray(arrayID); err != nil {
+		// every job was purged already
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+	} else {
+		WriteJSON(w, http.StatusCreated, array.JobArrayViewPartial)
+	}
+}
 
-	return nil
+func (s *Server) getJobArrays(w http.ResponseWriter, r *http.Request, user *User) {
+	WriteJSON(w, http.StatusOK, user.GetAllJobArrays())
 }
 
-func parseJobCreation(r io.Reader) ([]string, error) {
-	reqBody, err := ioutil.ReadAll(r)
+func (s *Server) getJobArray(w http.ResponseWriter, r *http.Request, user *User) {
+	array, err := user.GetJobArray(mux.Vars(r)["id"])
 	if err != nil {
-		return nil, err
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+		return
 	}
 
-	createJob := view.JobViewCommand{}
-	if err := json.Unmarshal(reqBody, &createJob); err != nil {
-		return nil, err
+	WriteJSON(w, http.StatusOK, array)
+}
+
+// stopJobArray stops every job of the array, like stopping each of them
+func (s *Server) stopJobArray(w http.ResponseWriter, r *http.Request, user *User) {
+	force := r.URL.Query().Get("force") == "true"
+
+	switch err := s.state.StopJobArray(user, mux.Vars(r)["id"], force); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ErrArrayNotFound:
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+	default:
+		log.Printf("Something went wrong stopping job array: %s", err)
+		WriteJSONError(w, http.StatusInternalServerError, "Failed to stop job array")
 	}
+}
+
+// getQuota returns what the user's jobs are using of each limit of the user's quota
+func (s *Server) getQuota(w http.ResponseWriter, r *http.Request, user *User) {
+	WriteJSON(w, http.StatusOK, user.GetQuotaView(time.Now()))
+}
 
-	if err := isCommandValid(createJob.Command); err != nil {
-		return nil, err
+// getScheduler returns the share, usage and queue depth of each user
+func (s *Server) getScheduler(w http.ResponseWriter, r *http.Request, user *User) {
+	WriteJSON(w, http.StatusOK, s.state.GetSchedulerView())
+}
+
+// reloadUsers replaces the users with the ones of the users file, returns which were added, updated and removed
+func (s *Server) reloadUsers(w http.ResponseWriter, r *http.Request, user *User) {
+	if reload, err := s.state.LoadUsersFile(); err == ErrNoUsersFile {
+		WriteJSONError(w, http.StatusConflict, err.Error())
+	} else if err != nil {
+		log.Printf("Failed to reload the users, because: %s", err)
+		WriteJSONError(w, http.StatusUnprocessableEntity, "Failed to reload the users, they're unchanged: "+err.Error())
+	} else {
+		log.Printf("Reloaded the users, requested by %s: %s", user.username, reload.String())
+		WriteJSON(w, http.StatusOK, reload)
+	}
+}
+
+func (s *Server) getSchedules(w http.ResponseWriter, r *http.Request, user *User) {
+	schedules := user.GetAllSchedules()
+	scheduleViews := make([]view.ScheduleViewPartial, 0, len(schedules))
+
+	for _, schedule := range schedules {
+		scheduleViews = append(scheduleViews, schedule.AsView().ScheduleViewPartial)
 	}
 
-	return createJob.Command, nil
+	WriteJSON(w, http.StatusOK, scheduleViews)
 }
 
-func (s *Server) createJob(w http.ResponseWriter, r *http.Request, user *User) {
-	command, err := parseJobCreation(r.Body)
+func (s *Server) getSchedule(w http.ResponseWriter, r *http.Request, schedule *Schedule) {
+	WriteJSON(w, http.StatusOK, schedule.AsView())
+}
+
+func (s *Server) createSchedule(w http.ResponseWriter, r *http.Request, user *User) {
+	spec, err := parseScheduleRequest(w, r, &s.state.config)
 	if err != nil {
-		WriteJSONError(w, http.StatusUnprocessableEntity, "Invalid or missing 'command' in POST body")
+		var maxBytesErr *http.MaxBytesError
+		if err == errStdinTooLarge || errors.As(err, &maxBytesErr) {
+			WriteJSONError(w, http.StatusRequestEntityTooLarge, errStdinTooLarge.Error())
+		} else {
+			WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		}
 		return
 	}
 
-	if job, err := SpawnJob(user, command); err != nil {
-		log.Printf("Failed to start job %s, because: %s", command, err)
-		WriteJSONError(w, http.StatusInternalServerError, "Failed to start job")
+	if spec.Job.Limits != (view.JobViewLimits{}) && s.state.cgroups == nil {
+		WriteJSONError(w, http.StatusUnprocessableEntity, "Resource limits aren't enabled on this server")
+		return
+	}
+
+	if schedule, err := CreateSchedule(s.state, user, spec); err == ErrNoCredential || err == ErrPriorityTooHigh {
+		WriteJSONError(w, http.StatusForbidden, err.Error())
+	} else if err != nil {
+		log.Printf("Failed to create schedule '%s', because: %s", spec.Cron, err)
+		WriteJSONError(w, http.StatusInternalServerError, "Failed to create schedule")
 	} else {
-		user.AddJob(job)
-		WriteJSON(w, http.StatusCreated, job.AsView().JobViewPartial)
+		WriteJSON(w, http.StatusCreated, schedule.AsView().ScheduleViewPartial)
 	}
 }
+
+// deleteSchedule stops the schedule from firing and removes it, the jobs it started are kept
+func (s *Server) deleteSchedule(w http.ResponseWriter, r *http.Request, user *User) {
+	switch err := user.RemoveSchedule(s.state.store, mux.Vars(r)["id"]); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ErrScheduleNotFound:
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+	default:
+		log.Printf("Something went wrong removing schedule: %s", err)
+		WriteJSONError(w, http.StatusInternalServerError, "Failed to remove schedule")
+	}
+}
+
+func (s *Server) pauseSchedule(w http.ResponseWriter, r *http.Request, schedule *Schedule) {
+	schedule.Pause()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) resumeSchedule(w http.ResponseWriter, r *http.Request, schedule *Schedule) {
+	schedule.Resume()
+	w.WriteHeader(http.StatusNoContent)
+}
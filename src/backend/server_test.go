@@ -2,16 +2,28 @@ package backend_test
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/Ross65536/job-scheduler/src/backend"
 	"github.com/Ross65536/job-scheduler/src/core/testutil"
+	"github.com/Ross65536/job-scheduler/src/core/view"
+	"github.com/gorilla/websocket"
 )
 
 type httpBasic struct {
@@ -47,6 +59,17 @@ func makeRequestWithHttpBasic(t *testing.T, basic httpBasic, method, url, body s
 	return resp
 }
 
+func parseJsonList(t *testing.T, resp *http.Response) []interface{} {
+	reqBody, err := ioutil.ReadAll(resp.Body)
+	testutil.AssertNotError(t, err)
+
+	var jsonResponse []interface{}
+	err = json.Unmarshal(reqBody, &jsonResponse)
+	testutil.AssertNotError(t, err)
+
+	return jsonResponse
+}
+
 func parseJsonObj(t *testing.T, resp *http.Response) map[string]interface{} {
 	reqBody, err := ioutil.ReadAll(resp.Body)
 	testutil.AssertNotError(t, err)
@@ -69,19 +92,38 @@ func limitedWait(t *testing.T, body func() bool) {
 	t.Fatal("Timeout waiting for response")
 }
 
+// the server config of the tests, which run jobs as the server's account for users not mapped to a Unix account
+func testConfig() backend.Config {
+	config := backend.DefaultConfig()
+	config.AllowUnmappedUsers = true
+
+	return config
+}
+
 func setupTest(t *testing.T, basic httpBasic) (*backend.State, *httptest.Server) {
-	state := backend.NewState()
+	return setupTestWithConfig(t, basic, testConfig())
+}
+
+func setupTestWithConfig(t *testing.T, basic httpBasic, config backend.Config) (*backend.State, *httptest.Server) {
+	state, err := backend.NewStateWithConfig(config)
+	testutil.AssertNotError(t, err)
 	state.AddUser(basic.username, basic.password)
+
+	return state, startTestServer(t, state)
+}
+
+func startTestServer(t *testing.T, state *backend.State) *httptest.Server {
 	server, err := backend.NewServer(state)
 	testutil.AssertNotError(t, err)
 
 	router := server.GetRouter()
-	return state, httptest.NewServer(router)
+	return httptest.NewServer(router)
 }
 
 func teardownTest(state *backend.State, server *httptest.Server) {
 	state.ClearUsers()
 	server.Close()
+	state.Close()
 }
 
 func TestCanCreateJob(t *testing.T) {
@@ -140,3 +182,1742 @@ func TestInvalidAuth(t *testing.T) {
 
 	makeRequestWithHttpBasic(t, invalidAuth, "GET", server.URL+"/api/jobs", "", 401)
 }
+
+func TestLimitsRequireCgroups(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	command := `{"command": ["true"], "cpu": 0.5, "memory_max": 1048576}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 422)
+	jsonResponse := parseJsonObj(t, resp)
+	testutil.AssertContains(t, jsonResponse["message"].(string), "Resource limits")
+}
+
+func TestInvalidLimits(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	command := `{"command": ["true"], "io_weight": 20000}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 422)
+	jsonResponse := parseJsonObj(t, resp)
+	testutil.AssertContains(t, jsonResponse["message"].(string), "io_weight")
+
+	// below the smallest cpu.max quota the kernel accepts
+	command = `{"command": ["true"], "cpu": 0.001}`
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 422)
+	jsonResponse = parseJsonObj(t, resp)
+	testutil.AssertContains(t, jsonResponse["message"].(string), "cpu must be at least 0.01")
+}
+
+func TestStopKillsProcessTree(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	// the background 'sleep' holds the stdout/stderr pipes, it must be stopped with the shell for the job to end
+	command := `{"command": ["sh", "-c", "sleep 30 & sleep 30; wait"]}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	time.Sleep(100 * time.Millisecond)
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+id, "", 204)
+
+	waitForStatus(t, basic, server, id, backend.JobStopped)
+}
+
+func startJobIgnoringSigterm(t *testing.T, basic httpBasic, server *httptest.Server, gracePeriod string) string {
+	command := `{"command": ["sh", "-c", "trap '' TERM; sleep 30"], "stop_grace_period": "` + gracePeriod + `"}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	time.Sleep(100 * time.Millisecond)
+	return id
+}
+
+func waitForStatus(t *testing.T, basic httpBasic, server *httptest.Server, id string, status backend.JobStatus) {
+	limitedWait(t, func() bool {
+		resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+		return parseJsonObj(t, resp)["status"].(string) == string(status)
+	})
+}
+
+func TestStopEscalatesAfterGracePeriod(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	id := startJobIgnoringSigterm(t, basic, server, "200ms")
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+id, "", 204)
+
+	resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["status"], string(backend.JobStopping))
+
+	waitForStatus(t, basic, server, id, backend.JobStopped)
+}
+
+func TestForceStop(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	id := startJobIgnoringSigterm(t, basic, server, "1h")
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+id+"?force=true", "", 204)
+
+	waitForStatus(t, basic, server, id, backend.JobStopped)
+}
+
+func TestInvalidStopSignal(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	command := `{"command": ["true"], "stop_signal": "SIGFOO"}`
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 422)
+}
+
+func TestFollowJobLogs(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	command := `{"command": ["sh", "-c", "echo out1; sleep 0.2; echo err1 >&2; sleep 0.2; echo out2"]}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	// the request only returns when the job ends
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id+"/logs?follow=true", "", 200)
+	logs, err := ioutil.ReadAll(resp.Body)
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, string(logs), "out1\nerr1\nout2\n")
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id+"/logs?stream=stdout&offset=2", "", 200)
+	logs, err = ioutil.ReadAll(resp.Body)
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, string(logs), "t1\nout2\n")
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id+"/logs?offset=6", "", 200)
+	logs, err = ioutil.ReadAll(resp.Body)
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, string(logs), "rr1\nout2\n")
+}
+
+func dialAttach(t *testing.T, basic httpBasic, server *httptest.Server, id string, writeStdin bool) (*websocket.Conn, *http.Response, error) {
+	header := http.Header{}
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(basic.username+":"+basic.password)))
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/jobs/" + id + "/attach?stdin=" + strconv.FormatBool(writeStdin)
+	return websocket.DefaultDialer.Dial(url, header)
+}
+
+func TestAttachToInteractiveJob(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	command := `{"command": ["cat"], "interactive": true}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	writer, _, err := dialAttach(t, basic, server, id, true)
+	testutil.AssertNotError(t, err)
+	defer writer.Close()
+
+	// only one session can write stdin at a time, but any number can watch
+	_, resp, err = dialAttach(t, basic, server, id, true)
+	testutil.AssertEquals(t, err, websocket.ErrBadHandshake)
+	testutil.AssertEquals(t, resp.StatusCode, http.StatusConflict)
+
+	watcher, _, err := dialAttach(t, basic, server, id, false)
+	testutil.AssertNotError(t, err)
+	defer watcher.Close()
+
+	testutil.AssertNotError(t, writer.WriteMessage(websocket.BinaryMessage, append([]byte{view.AttachStdin}, "hello\n"...)))
+	for _, conn := range []*websocket.Conn{writer, watcher} {
+		_, frame, err := conn.ReadMessage()
+		testutil.AssertNotError(t, err)
+		testutil.AssertEquals(t, string(frame), string(view.AttachStdout)+"hello\n")
+	}
+
+	// an empty stdin frame closes stdin, which ends 'cat'
+	testutil.AssertNotError(t, writer.WriteMessage(websocket.BinaryMessage, []byte{view.AttachStdin}))
+	_, _, err = watcher.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	testutil.AssertEquals(t, ok, true)
+	testutil.AssertEquals(t, closeErr.Text, string(backend.JobFinished))
+}
+
+func TestAttachWaitsForTheStdinOfTheJob(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	// larger than the pipe's buffer, the write only ends once the job reads it
+	stdin := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("a"), 256<<10))
+	command := `{"command": ["sh", "-c", "sleep 0.3; exec wc -c"], "interactive": true, "stdin_base64": "` + stdin + `"}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+	waitForStatus(t, basic, server, id, backend.JobRunning)
+
+	// the job's stdin is still being written
+	_, resp, err := dialAttach(t, basic, server, id, true)
+	testutil.AssertEquals(t, err, websocket.ErrBadHandshake)
+	testutil.AssertEquals(t, resp.StatusCode, http.StatusConflict)
+
+	var writer *websocket.Conn
+	limitedWait(t, func() bool {
+		writer, _, err = dialAttach(t, basic, server, id, true)
+		return err == nil
+	})
+	defer writer.Close()
+
+	testutil.AssertNotError(t, writer.WriteMessage(websocket.BinaryMessage, append([]byte{view.AttachStdin}, "bbbb"...)))
+	testutil.AssertNotError(t, writer.WriteMessage(websocket.BinaryMessage, []byte{view.AttachStdin}))
+	waitForStatus(t, basic, server, id, backend.JobFinished)
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["stdout"], strconv.Itoa(256<<10+4)+"\n")
+}
+
+func TestTerminalJob(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	// waits for the resize however late it's applied, the test times out if it never is
+	command := `{"command": ["sh", "-c", "until [ \"$(stty size)\" = '30 100' ]; do sleep 0.05; done; stty size"], "tty": true}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs/"+id+"/resize", `{"rows": 30, "cols": 100}`, 204)
+	waitForStatus(t, basic, server, id, backend.JobFinished)
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["stdout"], "30 100\r\n")
+}
+
+func TestResizeRequiresTerminal(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "1"]}`, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs/"+id+"/resize", `{"rows": 30, "cols": 100}`, 409)
+}
+
+func TestJobWithStdin(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	command := `{"command": ["cat"], "stdin_base64": "` + base64.StdEncoding.EncodeToString([]byte("from stdin\n")) + `"}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	waitForStatus(t, basic, server, id, backend.JobFinished)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["stdout"], "from stdin\n")
+}
+
+func TestJobWithMultipartStdin(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	body := bytes.Buffer{}
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("job", `{"command": ["wc", "-c"]}`)
+	part, err := writer.CreateFormFile("stdin", "stdin")
+	testutil.AssertNotError(t, err)
+	part.Write([]byte("12345"))
+	writer.Close()
+
+	req, err := http.NewRequest("POST", server.URL+"/api/jobs", &body)
+	testutil.AssertNotError(t, err)
+	req.SetBasicAuth(basic.username, basic.password)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := client.Do(req)
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, resp.StatusCode, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	waitForStatus(t, basic, server, id, backend.JobFinished)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	testutil.AssertEquals(t, strings.TrimSpace(parseJsonObj(t, resp)["stdout"].(string)), "5")
+}
+
+func TestJobEnvironment(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	os.Setenv("SERVER_SECRET", "secret")
+	defer os.Unsetenv("SERVER_SECRET")
+
+	command := `{"command": ["sh", "-c", "echo $FOO $SERVER_SECRET; pwd"], "env": {"FOO": "bar"}, "working_dir": "/tmp"}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	waitForStatus(t, basic, server, id, backend.JobFinished)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	jsonResponse := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, jsonResponse["stdout"], "bar\n/tmp\n")
+	testutil.AssertEquals(t, jsonResponse["working_dir"], "/tmp")
+	testutil.AssertEquals(t, jsonResponse["env"].(map[string]interface{})["FOO"], "bar")
+}
+
+func TestInvalidWorkingDir(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "working_dir": "relative"}`, 422)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "env": {"A=B": "C"}}`, 422)
+}
+
+func TestJobTimesOut(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "10"], "timeout": "100ms"}`, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	waitForStatus(t, basic, server, id, backend.JobTimedOut)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["timeout"], "100ms")
+}
+
+func TestTimeoutLimitedByServer(t *testing.T) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.MaxTimeout = time.Minute
+	state, server := setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "timeout": "2m"}`, 422)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "timeout": "soon"}`, 422)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["timeout"], "1m0s")
+}
+
+func TestJobRunsAsUnixUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the credentials of jobs requires root")
+	}
+
+	basic := buildDefaultUser()
+
+	state, err := backend.NewStateWithConfig(backend.DefaultConfig())
+	testutil.AssertNotError(t, err)
+	state.AddUserWithCredential(basic.username, basic.password, &backend.UnixCredential{UID: 65534, GID: 65534})
+	state.AddUser("unmapped", "1234")
+
+	server := startTestServer(t, state)
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["id", "-u"]}`, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	waitForStatus(t, basic, server, id, backend.JobFinished)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["stdout"], "65534\n")
+
+	unmapped := httpBasic{username: "unmapped", password: "1234"}
+	resp = makeRequestWithHttpBasic(t, unmapped, "POST", server.URL+"/api/jobs", `{"command": ["id", "-u"]}`, 403)
+	testutil.AssertContains(t, parseJsonObj(t, resp)["message"].(string), "Unix account")
+}
+
+func TestUnmappedUsersCantCreateJobsByDefault(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTestWithConfig(t, basic, backend.DefaultConfig())
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 403)
+	testutil.AssertContains(t, parseJsonObj(t, resp)["message"].(string), "unix_user")
+}
+
+func runJobWithOutputLimit(t *testing.T, retention backend.OutputRetention, command string) (httpBasic, *httptest.Server, string, func()) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.MaxOutputSize = 10
+	config.OutputRetention = retention
+	state, server := setupTestWithConfig(t, basic, config)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+	waitForStatus(t, basic, server, id, backend.JobFinished)
+
+	return basic, server, id, func() { teardownTest(state, server) }
+}
+
+func TestOutputRetention(t *testing.T) {
+	expectedStdout := map[backend.OutputRetention]string{
+		backend.RetainHead: "0123456789",
+		backend.RetainTail: "klmnopqrst",
+		backend.RetainBoth: "01234pqrst",
+	}
+
+	for retention, expected := range expectedStdout {
+		basic, server, id, teardown := runJobWithOutputLimit(t, retention, `{"command": ["printf", "0123456789abcdefghijklmnopqrst"]}`)
+
+		resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+		job := parseJsonObj(t, resp)
+		testutil.AssertEquals(t, job["stdout"], expected)
+		testutil.AssertEquals(t, job["stdout_size"], map[string]interface{}{"total": 30.0, "dropped": 20.0, "truncated": true})
+		testutil.AssertEquals(t, job["stderr_size"], map[string]interface{}{"total": 0.0, "dropped": 0.0, "truncated": false})
+
+		teardown()
+	}
+}
+
+func TestInterleavedLogsSkipDroppedOutput(t *testing.T) {
+	basic, server, id, teardown := runJobWithOutputLimit(t, backend.RetainTail,
+		`{"command": ["sh", "-c", "printf 0123456789abcdefghij; sleep 0.1; printf ERR >&2; sleep 0.1; printf klmno"]}`)
+	defer teardown()
+
+	expectedLogs := map[string]string{
+		"":                        "fghijERRklmno",
+		"?offset=17":              "hijERRklmno", // offsets count the dropped bytes
+		"?offset=24":              "lmno",
+		"?stream=stdout&offset=2": "fghijklmno",
+		"?stream=stderr":          "ERR",
+	}
+
+	for query, expected := range expectedLogs {
+		resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id+"/logs"+query, "", 200)
+		logs, err := ioutil.ReadAll(resp.Body)
+		testutil.AssertNotError(t, err)
+		testutil.AssertEquals(t, string(logs), expected)
+	}
+}
+
+func TestOutputInLogFiles(t *testing.T) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.LogDir = t.TempDir()
+	config.MaxOutputSize = 10
+	state, server := setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+
+	// larger than the window kept in memory
+	command := `{"command": ["sh", "-c", "head -c 200000 /dev/zero | tr '\\0' a; sleep 0.1; printf ERR >&2; sleep 0.1; printf end"]}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+	waitForStatus(t, basic, server, id, backend.JobFinished)
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id+"/logs", "", 200)
+	logs, err := ioutil.ReadAll(resp.Body)
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, string(logs), strings.Repeat("a", 200000)+"ERRend")
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id+"/logs?stream=stdout&offset=199998", "", 200)
+	logs, err = ioutil.ReadAll(resp.Body)
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, string(logs), "aaend")
+
+	// the job's details keep showing the bounded output
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	job := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, job["stdout"], "aaaaaaaend")
+	testutil.AssertEquals(t, job["stdout_size"], map[string]interface{}{"total": 200003.0, "dropped": 199993.0, "truncated": true})
+
+	files, err := os.ReadDir(config.LogDir)
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, len(files), 3)
+
+	testutil.AssertNotError(t, state.GetIndexedUser(basic.username).RemoveJob(id))
+	files, err = os.ReadDir(config.LogDir)
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, len(files), 0)
+}
+
+func TestReadsInterleavedLogsFromAnyOffset(t *testing.T) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.StoreDir, config.LogDir = t.TempDir(), t.TempDir()
+
+	// log files switching streams on every line, the index has a record for each, past a few checkpoints
+	stdout, stderr, index, expected := []byte{}, []byte{}, []byte{}, ""
+	for i := 0; i < 3000; i++ {
+		for stream, line := range []string{fmt.Sprintf("o%d\n", i), fmt.Sprintf("e%d\n", i)} {
+			if stream == 0 {
+				stdout = append(stdout, line...)
+			} else {
+				stderr = append(stderr, line...)
+			}
+
+			record := make([]byte, 9)
+			record[0] = byte(stream)
+			binary.LittleEndian.PutUint64(record[1:], uint64(len(line)))
+			index = append(index, record...)
+			expected += line
+		}
+	}
+
+	logPath := filepath.Join(config.LogDir, "logged")
+	testutil.AssertNotError(t, os.WriteFile(logPath+".stdout", stdout, 0600))
+	testutil.AssertNotError(t, os.WriteFile(logPath+".stderr", stderr, 0600))
+	testutil.AssertNotError(t, os.WriteFile(logPath+".index", index, 0600))
+
+	store, err := backend.NewFileStore(config.StoreDir)
+	testutil.AssertNotError(t, err)
+	exitCode := 0
+	logged := &backend.JobRecord{ID: "logged", Username: basic.username, Status: backend.JobFinished, ExitCode: &exitCode, Output: &backend.OutputRecord{LogPath: logPath}}
+	testutil.AssertNotError(t, store.Save(logged))
+	testutil.AssertNotError(t, store.Close())
+
+	state, server := setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+	testutil.AssertNotError(t, state.LoadJobs())
+
+	// from the end first, so that the later reads start from the checkpoints found by the earlier ones
+	for _, offset := range []int{len(expected) - 1, len(expected) / 2, 3, 0} {
+		resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/logged/logs?offset="+strconv.Itoa(offset), "", 200)
+		logs, err := ioutil.ReadAll(resp.Body)
+		testutil.AssertNotError(t, err)
+		testutil.AssertEquals(t, string(logs), expected[offset:])
+	}
+}
+
+func TestJobsSurviveRestart(t *testing.T) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.StoreDir = t.TempDir()
+	state, server := setupTestWithConfig(t, basic, config)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["echo", "hi"]}`, 201)
+	finishedID := parseJsonObj(t, resp)["id"].(string)
+	waitForStatus(t, basic, server, finishedID, backend.JobFinished)
+
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "10"]}`, 201)
+	runningID := parseJsonObj(t, resp)["id"].(string)
+
+	teardownTest(state, server)
+	testutil.AssertNotError(t, state.Close())
+
+	// a job whose process is gone, as if the server stopped while it was running and it then exited
+	store, err := backend.NewFileStore(config.StoreDir)
+	testutil.AssertNotError(t, err)
+	lost := &backend.JobRecord{ID: "lost", Username: basic.username, Status: backend.JobRunning, PID: os.Getpid(), ProcessStart: 1}
+	testutil.AssertNotError(t, store.Save(lost))
+	testutil.AssertNotError(t, store.Close())
+
+	state, server = setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+	testutil.AssertNotError(t, state.LoadJobs())
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+finishedID, "", 200)
+	job := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, job["status"], string(backend.JobFinished))
+	testutil.AssertEquals(t, job["stdout"], "hi\n")
+
+	waitForStatus(t, basic, server, "lost", backend.JobLost)
+
+	// the process of the running job is re-adopted, and can still be stopped
+	waitForStatus(t, basic, server, runningID, backend.JobRunning)
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+runningID, "", 204)
+	waitForStatus(t, basic, server, runningID, backend.JobStopped)
+}
+
+func TestRestartKeepsTheEndOfTheOutputAndNotTheEnv(t *testing.T) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.StoreDir = t.TempDir()
+	state, server := setupTestWithConfig(t, basic, config)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sh", "-c", "head -c 10000 /dev/zero; echo end"], "env": {"SECRET": "s3cr3t"}, "timeout": "1m"}`, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+	waitForStatus(t, basic, server, id, backend.JobFinished)
+
+	teardownTest(state, server)
+	testutil.AssertNotError(t, state.Close())
+
+	store, err := backend.NewFileStore(config.StoreDir)
+	testutil.AssertNotError(t, err)
+	records, err := store.Load()
+	testutil.AssertNotError(t, err)
+	testutil.AssertNotError(t, store.Close())
+	testutil.AssertEquals(t, len(records), 1)
+	testutil.AssertEquals(t, len(records[0].Spec.Env), 0)
+
+	spec, err := json.Marshal(records[0].Spec)
+	testutil.AssertNotError(t, err)
+	testutil.AssertContains(t, string(spec), `"timeout":"1m0s"`)
+
+	state, server = setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+	testutil.AssertNotError(t, state.LoadJobs())
+
+	// only the last bytes of the output are saved without log files
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	job := parseJsonObj(t, resp)
+	stdout := job["stdout"].(string)
+	testutil.AssertEquals(t, len(stdout), 4<<10)
+	testutil.AssertEquals(t, strings.HasSuffix(stdout, "end\n"), true)
+	testutil.AssertEquals(t, job["stdout_size"].(map[string]interface{})["total"], float64(10004))
+}
+
+func TestPurgeJob(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 201)
+	finishedID := parseJsonObj(t, resp)["id"].(string)
+	waitForStatus(t, basic, server, finishedID, backend.JobFinished)
+
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "10"]}`, 201)
+	runningID := parseJsonObj(t, resp)["id"].(string)
+	defer makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+runningID+"?force=true", "", 204)
+
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs/"+runningID+"/purge", "", 409)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs/"+finishedID+"/purge", "", 204)
+	makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+finishedID, "", 404)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs/"+finishedID+"/purge", "", 404)
+}
+
+func TestRetentionSweeper(t *testing.T) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.MaxJobsPerUser = 1
+	config.RetentionSweepInterval = 20 * time.Millisecond
+	state, server := setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+
+	ids := []string{}
+	for i := 0; i < 2; i++ {
+		resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 201)
+		ids = append(ids, parseJsonObj(t, resp)["id"].(string))
+		waitForStatus(t, basic, server, ids[i], backend.JobFinished)
+	}
+
+	// only the job that ended last is kept
+	limitedWait(t, func() bool {
+		resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs", "", 200)
+		jobs := parseJsonList(t, resp)
+		return len(jobs) == 1 && jobs[0].(map[string]interface{})["id"] == ids[1]
+	})
+	makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+ids[0], "", 404)
+}
+
+func TestQueuedJobsWaitForFreeSlot(t *testing.T) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.MaxRunningJobs = 1
+	state, server := setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "10"]}`, 201)
+	running := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, running["status"], string(backend.JobRunning))
+
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 201)
+	cancelled := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, cancelled["status"], string(backend.JobQueued))
+
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["echo", "started"]}`, 201)
+	queued := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, queued["status"], string(backend.JobQueued))
+
+	// cancelling a queued job only removes it from the queue
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+cancelled["id"].(string), "", 204)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+cancelled["id"].(string), "", 200)
+	job := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, job["status"], string(backend.JobStopped))
+	testutil.AssertEquals(t, job["started_at"], nil)
+	testutil.AssertEquals(t, job["exit_code"], nil)
+
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+running["id"].(string)+"?force=true", "", 204)
+	waitForStatus(t, basic, server, queued["id"].(string), backend.JobFinished)
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+queued["id"].(string), "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["stdout"], "started\n")
+}
+
+func TestQueuedJobStdinSurvivesRestartWithoutBeingInTheLog(t *testing.T) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.MaxRunningJobs = 1
+	config.StoreDir = t.TempDir()
+	state, server := setupTestWithConfig(t, basic, config)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "10"]}`, 201)
+	runningID := parseJsonObj(t, resp)["id"].(string)
+
+	stdin := base64.StdEncoding.EncodeToString([]byte("queued stdin\n"))
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["cat"], "stdin_base64": "`+stdin+`"}`, 201)
+	queuedID := parseJsonObj(t, resp)["id"].(string)
+
+	teardownTest(state, server)
+	testutil.AssertNotError(t, state.Close())
+
+	// the stdin is in its own file instead of in the records
+	wal, err := os.ReadFile(filepath.Join(config.StoreDir, "jobs.wal"))
+	testutil.AssertNotError(t, err)
+	snapshot, err := os.ReadFile(filepath.Join(config.StoreDir, "jobs.json"))
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, strings.Contains(string(wal)+string(snapshot), stdin), false)
+
+	state, server = setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+	testutil.AssertNotError(t, state.LoadJobs())
+
+	waitForStatus(t, basic, server, runningID, backend.JobRunning)
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+runningID+"?force=true", "", 204)
+	waitForStatus(t, basic, server, queuedID, backend.JobFinished)
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+queuedID, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["stdout"], "queued stdin\n")
+
+	// and removed once the job started
+	files, err := os.ReadDir(filepath.Join(config.StoreDir, "stdin"))
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, len(files), 0)
+}
+
+func TestQueuedJobsOfOtherUsersStart(t *testing.T) {
+	basic := buildDefaultUser()
+	other := httpBasic{username: "user2", password: "5678"}
+
+	config := testConfig()
+	config.MaxRunningJobsPerUser = 1
+	state, server := setupTestWithConfig(t, basic, config)
+	state.AddUser(other.username, other.password)
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "10"]}`, 201)
+	running := parseJsonObj(t, resp)
+
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 201)
+	queued := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, queued["status"], string(backend.JobQueued))
+
+	resp = makeRequestWithHttpBasic(t, other, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 201)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["status"], string(backend.JobRunning))
+
+	// following the logs of a queued job waits for it to start and end
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		time.Sleep(100 * time.Millisecond)
+		makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+running["id"].(string)+"?force=true", "", 204)
+	}()
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+queued["id"].(string)+"/logs?follow=true", "", 200)
+	_, err := ioutil.ReadAll(resp.Body)
+	testutil.AssertNotError(t, err)
+	<-stopped
+	waitForStatus(t, basic, server, queued["id"].(string), backend.JobFinished)
+}
+
+func setupPriorityTest(t *testing.T, basic httpBasic, preemption backend.PreemptionMode) (*backend.State, *httptest.Server) {
+	config := testConfig()
+	config.MaxRunningJobs = 1
+	config.Preemption = preemption
+	state, server := setupTestWithConfig(t, basic, config)
+	state.AddUserWithOptions(basic.username, basic.password, backend.UserOptions{MaxPriority: 10})
+
+	return state, server
+}
+
+func getJobHistory(t *testing.T, basic httpBasic, server *httptest.Server, id string) []string {
+	resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	history, _ := parseJsonObj(t, resp)["history"].([]interface{})
+
+	events := []string{}
+	for _, event := range history {
+		events = append(events, event.(map[string]interface{})["event"].(string))
+	}
+
+	return events
+}
+
+func TestQueuedJobsStartByPriority(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupPriorityTest(t, basic, backend.PreemptionOff)
+	defer teardownTest(state, server)
+
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "priority": 11}`, 403)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "priority": -1}`, 422)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "10"]}`, 201)
+	running := parseJsonObj(t, resp)["id"].(string)
+
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 201)
+	low := parseJsonObj(t, resp)["id"].(string)
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "priority": 5}`, 201)
+	high := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, high["status"], string(backend.JobQueued))
+	testutil.AssertEquals(t, high["priority"], 5.0)
+
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+running+"?force=true", "", 204)
+	waitForStatus(t, basic, server, low, backend.JobFinished)
+
+	// only one job runs at a time, the one with the higher priority ran first
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+high["id"].(string), "", 200)
+	highStoppedAt, err := time.Parse(time.RFC3339Nano, parseJsonObj(t, resp)["stopped_at"].(string))
+	testutil.AssertNotError(t, err)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+low, "", 200)
+	lowStartedAt, err := time.Parse(time.RFC3339Nano, parseJsonObj(t, resp)["started_at"].(string))
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, highStoppedAt.After(lowStartedAt), false)
+}
+
+func TestPreemptionSuspendsLowerPriorityJob(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupPriorityTest(t, basic, backend.PreemptionSuspend)
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "10"]}`, 201)
+	low := parseJsonObj(t, resp)["id"].(string)
+	defer makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+low+"?force=true", "", 204)
+
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "0.2"], "priority": 5}`, 201)
+	high := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, high["status"], string(backend.JobRunning))
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+low, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["status"], string(backend.JobSuspended))
+
+	waitForStatus(t, basic, server, high["id"].(string), backend.JobFinished)
+	waitForStatus(t, basic, server, low, backend.JobRunning)
+	testutil.AssertEquals(t, getJobHistory(t, basic, server, low), []string{"suspended", "resumed"})
+}
+
+func TestPreemptionRequeuesLowerPriorityJob(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupPriorityTest(t, basic, backend.PreemptionRequeue)
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "10"]}`, 201)
+	low := parseJsonObj(t, resp)["id"].(string)
+	defer makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+low+"?force=true", "", 204)
+
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "priority": 5}`, 201)
+	high := parseJsonObj(t, resp)["id"].(string)
+
+	waitForStatus(t, basic, server, high, backend.JobFinished)
+	waitForStatus(t, basic, server, low, backend.JobRunning)
+	testutil.AssertEquals(t, getJobHistory(t, basic, server, low), []string{"preempted", "requeued"})
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+low, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["exit_code"], nil)
+}
+
+// waits for up to 3s, schedules only fire on the second
+func waitForSchedule(t *testing.T, basic httpBasic, server *httptest.Server, id string, done func(schedule map[string]interface{}) bool) map[string]interface{} {
+	for i := 0; i < 60; i++ {
+		resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/schedules/"+id, "", 200)
+		if schedule := parseJsonObj(t, resp); done(schedule) {
+			return schedule
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatal("Timeout waiting for schedule")
+	return nil
+}
+
+func TestScheduleSkipsOverlappingRuns(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/schedules",
+		`{"cron": "* * * * * *", "overlap": "skip", "job": {"command": ["sleep", "10"]}}`, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	schedule := waitForSchedule(t, basic, server, id, func(schedule map[string]interface{}) bool {
+		return schedule["skipped"].(float64) >= 1
+	})
+	runs := schedule["runs"].([]interface{})
+	testutil.AssertEquals(t, len(runs), 1)
+
+	runID := runs[0].(string)
+	defer makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+runID+"?force=true", "", 204)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+runID, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["schedule_id"], id)
+
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/schedules/"+id+"/pause", "", 204)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/schedules/"+id, "", 200)
+	schedule = parseJsonObj(t, resp)
+	testutil.AssertEquals(t, schedule["paused"], true)
+	testutil.AssertEquals(t, schedule["next_run_at"], nil)
+
+	// the runs are kept once the schedule is removed
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/schedules/"+id, "", 204)
+	makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/schedules/"+id, "", 404)
+	makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+runID, "", 200)
+}
+
+func TestScheduleReplacesOverlappingRun(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/schedules",
+		`{"cron": "* * * * * *", "overlap": "replace", "job": {"command": ["sh", "-c", "trap '' TERM; sleep 10"], "stop_grace_period": "300ms"}}`, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	schedule := waitForSchedule(t, basic, server, id, func(schedule map[string]interface{}) bool {
+		return len(schedule["runs"].([]interface{})) >= 2
+	})
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/schedules/"+id, "", 204)
+
+	// the new run only starts once the previous one was killed after its grace period
+	runs := schedule["runs"].([]interface{})
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+runs[1].(string), "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["status"], string(backend.JobWaiting))
+
+	waitForStatus(t, basic, server, runs[0].(string), backend.JobStopped)
+	waitForStatus(t, basic, server, runs[1].(string), backend.JobRunning)
+	for _, run := range runs[1:] {
+		makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+run.(string)+"?force=true", "", 204)
+	}
+}
+
+func TestNextCronRun(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	testutil.AssertNotError(t, err)
+
+	// 2026-01-01 is a Thursday
+	newYear := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		expression string
+		after      time.Time
+		expected   time.Time
+	}{
+		{"every minute", "* * * * *", newYear, newYear.Add(time.Minute)},
+		{"step", "*/15 * * * *", newYear.Add(7 * time.Minute), newYear.Add(15 * time.Minute)},
+		{"range with step", "0 9-17/4 * * *", newYear.Add(10 * time.Hour), newYear.Add(13 * time.Hour)},
+		{"list", "0 8,20 * * *", newYear.Add(8 * time.Hour), newYear.Add(20 * time.Hour)},
+		{"seconds", "*/30 * * * * *", newYear.Add(10 * time.Second), newYear.Add(30 * time.Second)},
+		{"month and weekday names", "0 0 * feb-mar mon", newYear, time.Date(2026, time.February, 2, 0, 0, 0, 0, time.UTC)},
+		{"sunday as 7", "0 0 * * 7", newYear, time.Date(2026, time.January, 4, 0, 0, 0, 0, time.UTC)},
+		{"macro", "@monthly", newYear, time.Date(2026, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"day of month or day of week", "0 0 13 * fri", newYear, time.Date(2026, time.January, 2, 0, 0, 0, 0, time.UTC)},
+		{"day of month or day of week, the day of month first", "0 0 3 * mon", newYear, time.Date(2026, time.January, 3, 0, 0, 0, 0, time.UTC)},
+		{"day of month and any day of week", "0 0 13 * *", newYear, time.Date(2026, time.January, 13, 0, 0, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 feb *", newYear, time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"february 30th never matches", "0 0 30 feb *", newYear, time.Time{}},
+		{"hourly across the clocks going forward", "0 * * * *", time.Date(2026, time.March, 29, 1, 30, 0, 0, berlin), time.Date(2026, time.March, 29, 3, 0, 0, 0, berlin)},
+		{"time skipped when the clocks go forward", "30 2 * * *", time.Date(2026, time.March, 29, 0, 0, 0, 0, berlin), time.Date(2026, time.March, 30, 2, 30, 0, 0, berlin)},
+		{"time repeated when the clocks go back", "30 2 * * *", time.Date(2026, time.October, 25, 0, 0, 0, 0, berlin), time.Date(2026, time.October, 25, 1, 30, 0, 0, time.UTC)},
+		{"time repeated when the clocks go back only once", "30 2 * * *", time.Date(2026, time.October, 25, 0, 30, 0, 0, time.UTC).In(berlin), time.Date(2026, time.October, 26, 2, 30, 0, 0, berlin)},
+	}
+
+	for _, test := range tests {
+		next, err := backend.NextCronRun(test.expression, test.after)
+		testutil.AssertNotError(t, err)
+		if !next.Equal(test.expected) {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, next)
+		}
+	}
+}
+
+func TestCreateSchedule(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/schedules", `{"cron": "61 * * * *", "job": {"command": ["true"]}}`, 422)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/schedules", `{"cron": "* * *", "job": {"command": ["true"]}}`, 422)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/schedules", `{"cron": "@daily", "overlap": "queue", "job": {"command": ["true"]}}`, 422)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/schedules", `{"cron": "@daily", "job": {"command": []}}`, 422)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/schedules", `{"cron": "0 0 1 1 *", "job": {"command": ["true"]}}`, 201)
+	schedule := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, schedule["overlap"], string(backend.OverlapAllow))
+
+	nextRunAt, err := time.Parse(time.RFC3339, schedule["next_run_at"].(string))
+	testutil.AssertNotError(t, err)
+	expected := time.Date(time.Now().Year()+1, time.January, 1, 0, 0, 0, 0, time.Local)
+	testutil.AssertEquals(t, nextRunAt.Equal(expected), true)
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/schedules", "", 200)
+	testutil.AssertEquals(t, len(parseJsonList(t, resp)), 1)
+}
+
+func TestSchedulesSurviveRestart(t *testing.T) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.StoreDir = t.TempDir()
+	state, server := setupTestWithConfig(t, basic, config)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/schedules", `{"cron": "@hourly", "job": {"command": ["true"]}}`, 201)
+	activeID := parseJsonObj(t, resp)["id"].(string)
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/schedules", `{"cron": "@daily", "job": {"command": ["true"]}}`, 201)
+	pausedID := parseJsonObj(t, resp)["id"].(string)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/schedules/"+pausedID+"/pause", "", 204)
+
+	teardownTest(state, server)
+
+	state, server = setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+	testutil.AssertNotError(t, state.LoadJobs())
+	testutil.AssertNotError(t, state.LoadSchedules())
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/schedules/"+activeID, "", 200)
+	schedule := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, schedule["cron"], "@hourly")
+	testutil.AssertNotEquals(t, schedule["next_run_at"], nil)
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/schedules/"+pausedID, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["paused"], true)
+}
+
+func TestScheduledJobStartsLater(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["echo", "hi"], "start_after": "300ms"}`, 201)
+	job := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, job["status"], string(backend.JobScheduled))
+	testutil.AssertNotEquals(t, job["start_at"], nil)
+	id := job["id"].(string)
+
+	waitForStatus(t, basic, server, id, backend.JobFinished)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	job = parseJsonObj(t, resp)
+	testutil.AssertEquals(t, job["stdout"], "hi\n")
+
+	startedAt, err := time.Parse(time.RFC3339, job["started_at"].(string))
+	testutil.AssertNotError(t, err)
+	startAt, err := time.Parse(time.RFC3339, job["start_at"].(string))
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, startedAt.Before(startAt), false)
+
+	// a start time in the past queues the job right away
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "start_at": "2020-01-01T00:00:00Z"}`, 201)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["status"], string(backend.JobRunning))
+
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "start_after": "1h", "start_at": "2020-01-01T00:00:00Z"}`, 422)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "start_after": "soon"}`, 422)
+}
+
+func TestCancelScheduledJob(t *testing.T) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.StoreDir = t.TempDir()
+	state, server := setupTestWithConfig(t, basic, config)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "start_after": "1h"}`, 201)
+	cancelledID := parseJsonObj(t, resp)["id"].(string)
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "start_after": "1h"}`, 201)
+	scheduledID := parseJsonObj(t, resp)["id"].(string)
+
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+cancelledID, "", 204)
+	waitForStatus(t, basic, server, cancelledID, backend.JobStopped)
+
+	// scheduled jobs keep waiting for their start time after a restart
+	teardownTest(state, server)
+	state, server = setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+	testutil.AssertNotError(t, state.LoadJobs())
+
+	waitForStatus(t, basic, server, scheduledID, backend.JobScheduled)
+	waitForStatus(t, basic, server, cancelledID, backend.JobStopped)
+}
+
+func TestRetriesFailedJob(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	retry := `"retry": {"max_attempts": 3, "backoff": "50ms", "max_backoff": "50ms", "exit_codes": [3]}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sh", "-c", "echo try; exit 3"], `+retry+`}`, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	waitForStatus(t, basic, server, id, backend.JobFinished)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	job := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, job["exit_code"], float64(3))
+	testutil.AssertEquals(t, job["attempt"], float64(3))
+	testutil.AssertEquals(t, job["stdout"], "try\n")
+
+	attempts := job["attempts"].([]interface{})
+	testutil.AssertEquals(t, len(attempts), 2)
+	for i, attempt := range attempts {
+		attempt := attempt.(map[string]interface{})
+		testutil.AssertEquals(t, attempt["attempt"], float64(i+1))
+		testutil.AssertEquals(t, attempt["status"], string(backend.JobFinished))
+		testutil.AssertEquals(t, attempt["exit_code"], float64(3))
+		testutil.AssertEquals(t, attempt["stdout"], "try\n")
+	}
+
+	// exit codes that aren't in the policy aren't retried
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sh", "-c", "exit 1"], `+retry+`}`, 201)
+	id = parseJsonObj(t, resp)["id"].(string)
+	waitForStatus(t, basic, server, id, backend.JobFinished)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["attempts"], nil)
+}
+
+func TestRetriedAttemptsKeepTheEndOfTheirOutput(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	retry := `"retry": {"max_attempts": 2, "backoff": "50ms"}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sh", "-c", "head -c 10000 /dev/zero; echo end; exit 1"], `+retry+`}`, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	limitedWait(t, func() bool {
+		resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+		job := parseJsonObj(t, resp)
+		return job["status"] == string(backend.JobFinished) && job["attempts"] != nil
+	})
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	attempt := parseJsonObj(t, resp)["attempts"].([]interface{})[0].(map[string]interface{})
+	stdout := attempt["stdout"].(string)
+	testutil.AssertEquals(t, len(stdout), 4<<10)
+	testutil.AssertEquals(t, strings.HasSuffix(stdout, "end\n"), true)
+	testutil.AssertEquals(t, attempt["stdout_size"].(map[string]interface{})["total"], float64(10004))
+	testutil.AssertEquals(t, attempt["stdout_size"].(map[string]interface{})["dropped"], float64(10004-4<<10))
+
+	// without log files only the end of each stream of the attempt can be read
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id+"/logs?attempt=1&stream=stdout", "", 200)
+	logs, err := ioutil.ReadAll(resp.Body)
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, string(logs), stdout)
+	makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id+"/logs?attempt=1", "", 409)
+
+	// the list doesn't have the attempts
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs", "", 200)
+	testutil.AssertEquals(t, parseJsonList(t, resp)[0].(map[string]interface{})["attempts"], nil)
+}
+
+func TestRetriedAttemptsKeepTheirLogFiles(t *testing.T) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.LogDir = t.TempDir()
+	state, server := setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+
+	// each attempt writes its number over the whole output, the first two fail
+	counter := filepath.Join(t.TempDir(), "counter")
+	script := `n=$(($(cat ` + counter + ` 2>/dev/null || echo 0) + 1)); echo $n > ` + counter + `; ` +
+		`head -c 10000 /dev/zero | tr '\\0' $n; sleep 0.1; printf err$n >&2; [ $n -eq 3 ]`
+	retry := `"retry": {"max_attempts": 3, "backoff": "50ms"}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sh", "-c", "`+script+`"], `+retry+`}`, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	limitedWait(t, func() bool {
+		resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+		job := parseJsonObj(t, resp)
+		return job["status"] == string(backend.JobFinished) && job["attempt"] == float64(3)
+	})
+
+	for attempt, query := range map[string]string{"1": "?attempt=1", "2": "?attempt=2", "3": ""} {
+		resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id+"/logs"+query, "", 200)
+		logs, err := ioutil.ReadAll(resp.Body)
+		testutil.AssertNotError(t, err)
+		testutil.AssertEquals(t, string(logs), strings.Repeat(attempt, 10000)+"err"+attempt)
+	}
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id+"/logs?attempt=2&stream=stderr", "", 200)
+	logs, err := ioutil.ReadAll(resp.Body)
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, string(logs), "err2")
+	makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id+"/logs?attempt=3", "", 404)
+
+	// the log files of the attempts are only removed with the job
+	files, err := os.ReadDir(config.LogDir)
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, len(files), 9)
+
+	testutil.AssertNotError(t, state.GetIndexedUser(basic.username).RemoveJob(id))
+	files, err = os.ReadDir(config.LogDir)
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, len(files), 0)
+}
+
+func TestJobStoppedByUserIsNotRetried(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	// exits with an error when stopped
+	retry := `"retry": {"max_attempts": 3, "backoff": "50ms"}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sh", "-c", "trap 'exit 1' TERM; while true; do sleep 0.05; done"], `+retry+`}`, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+	time.Sleep(100 * time.Millisecond)
+
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+id, "", 204)
+	waitForStatus(t, basic, server, id, backend.JobFinished)
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	job := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, job["exit_code"], float64(1))
+	testutil.AssertEquals(t, job["attempts"], nil)
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	// fails the first time only
+	body := `{"command": ["sh", "-c", "if [ -e marker ]; then echo ok; else touch marker; exit 1; fi"], "working_dir": "` + t.TempDir() + `",
+		"retry": {"max_attempts": 5, "backoff": "50ms"}}`
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", body, 201)
+	id := parseJsonObj(t, resp)["id"].(string)
+
+	limitedWait(t, func() bool {
+		resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+		job := parseJsonObj(t, resp)
+		return job["status"] == string(backend.JobFinished) && job["exit_code"] == float64(0)
+	})
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+	job := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, job["attempt"], float64(2))
+	testutil.AssertEquals(t, job["stdout"], "ok\n")
+	testutil.AssertEquals(t, len(job["attempts"].([]interface{})), 1)
+	testutil.AssertEquals(t, len(job["history"].([]interface{})), 1)
+}
+
+func TestInvalidRetryPolicy(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	for _, retry := range []string{
+		`{"max_attempts": 0}`,
+		`{"max_attempts": 3, "backoff": "1m", "max_backoff": "1s"}`,
+		`{"max_attempts": 3, "exit_codes": [0]}`,
+		`{"max_attempts": 3, "statuses": ["STOPPED"]}`,
+	} {
+		makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "retry": `+retry+`}`, 422)
+	}
+}
+
+func TestJobDependencies(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	createJob := func(body string) string {
+		resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", body, 201)
+		return parseJsonObj(t, resp)["id"].(string)
+	}
+
+	parent := createJob(`{"command": ["sleep", "0.3"]}`)
+	onSuccess := createJob(`{"command": ["echo", "next"], "depends_on": {"jobs": ["` + parent + `"]}}`)
+	onFailure := createJob(`{"command": ["echo", "recover"], "depends_on": {"jobs": ["` + parent + `"], "condition": "failure"}}`)
+	fanIn := createJob(`{"command": ["true"], "depends_on": {"jobs": ["` + onSuccess + `", "` + onFailure + `"], "condition": "any"}}`)
+	waitForStatus(t, basic, server, onSuccess, backend.JobWaiting)
+
+	waitForStatus(t, basic, server, onSuccess, backend.JobFinished)
+	waitForStatus(t, basic, server, onFailure, backend.JobCancelled)
+	waitForStatus(t, basic, server, fanIn, backend.JobFinished)
+
+	resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+onSuccess, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["stdout"], "next\n")
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+parent+"/dag", "", 200)
+	graph := parseJsonObj(t, resp)
+	nodes := []string{}
+	for _, node := range graph["nodes"].([]interface{}) {
+		nodes = append(nodes, node.(map[string]interface{})["id"].(string))
+	}
+	testutil.AssertEquals(t, nodes, []string{parent, onSuccess, onFailure, fanIn})
+	testutil.AssertEquals(t, len(graph["edges"].([]interface{})), 4)
+
+	// a job can be stopped while it waits
+	waiting := createJob(`{"command": ["true"], "depends_on": {"jobs": ["` + createJob(`{"command": ["sleep", "10"]}`) + `"]}}`)
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+waiting, "", 204)
+	waitForStatus(t, basic, server, waiting, backend.JobStopped)
+
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "depends_on": {"jobs": ["missing"]}}`, 422)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "depends_on": {"jobs": ["`+parent+`"], "condition": "maybe"}}`, 422)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "depends_on": {"jobs": ["`+parent+`", "`+parent+`"]}}`, 422)
+	makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/missing/dag", "", 404)
+}
+
+func TestJobArrayIsRemovedWhenAJobFailsToStart(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	// only the command of the first job exists
+	dir := t.TempDir()
+	testutil.AssertNotError(t, os.WriteFile(filepath.Join(dir, "0"), []byte("#!/bin/sh\nsleep 10\n"), 0700))
+	command := `{"command": ["` + filepath.Join(dir, "{{index}}") + `"], "array": {"range": {"start": 0, "end": 1}}}`
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", command, 500)
+
+	resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/arrays", "", 200)
+	testutil.AssertEquals(t, len(parseJsonList(t, resp)), 0)
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs", "", 200)
+	testutil.AssertEquals(t, len(parseJsonList(t, resp)), 0)
+}
+
+func TestJobArrayOverRange(t *testing.T) {
+	basic := buildDefaultUser()
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs",
+		`{"command": ["sh", "-c", "echo item-{{index}}-$N"], "env": {"N": "n{{index}}"}, "array": {"range": {"start": 1, "end": 5, "step": 2}}}`, 201)
+	array := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, array["size"], 3.0)
+	arrayID := array["id"].(string)
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/arrays/"+arrayID, "", 200)
+	jobs := parseJsonObj(t, resp)["jobs"].([]interface{})
+	testutil.AssertEquals(t, len(jobs), 3)
+	for i, index := range []int{1, 3, 5} {
+		job := jobs[i].(map[string]interface{})
+		testutil.AssertEquals(t, job["index"], float64(index))
+
+		id := job["id"].(string)
+		waitForStatus(t, basic, server, id, backend.JobFinished)
+		resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+		jobView := parseJsonObj(t, resp)
+		testutil.AssertEquals(t, jobView["stdout"], "item-"+strconv.Itoa(index)+"-n"+strconv.Itoa(index)+"\n")
+		testutil.AssertEquals(t, jobView["array_id"], arrayID)
+		testutil.AssertEquals(t, jobView["array_index"], float64(index))
+	}
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/arrays/"+arrayID, "", 200)
+	array = parseJsonObj(t, resp)
+	testutil.AssertEquals(t, array["status"], "ENDED")
+	testutil.AssertEquals(t, array["counts"], map[string]interface{}{"FINISHED": 3.0})
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/arrays", "", 200)
+	testutil.AssertEquals(t, len(parseJsonList(t, resp)), 1)
+
+	makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/arrays/missing", "", 404)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "array": {}}`, 422)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "array": {"args": [[]], "range": {"start": 0, "end": 1}}}`, 422)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["echo", "{{index}}"], "array": {"range": {"start": 0, "end": 100000}}}`, 422)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["echo", "{{index}}"], "array": {"range": {"start": 5, "end": 1}}}`, 422)
+
+	// a range whose jobs wouldn't differ
+	resp = makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["echo", "index"], "env": {"N": "1"}, "array": {"range": {"start": 0, "end": 1}}}`, 422)
+	testutil.AssertContains(t, parseJsonObj(t, resp)["message"].(string), "{{index}}")
+}
+
+func TestStopJobArray(t *testing.T) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.MaxRunningJobs = 1
+	state, server := setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["sleep"], "array": {"args": [["10"], ["20"], ["30"]]}}`, 201)
+	arrayID := parseJsonObj(t, resp)["id"].(string)
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/arrays/"+arrayID, "", 200)
+	array := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, array["status"], "ACTIVE")
+	testutil.AssertEquals(t, array["counts"], map[string]interface{}{"RUNNING": 1.0, "QUEUED": 2.0})
+
+	jobs := array["jobs"].([]interface{})
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+jobs[2].(map[string]interface{})["id"].(string), "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["command"], []interface{}{"sleep", "30"})
+
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/arrays/"+arrayID, "", 204)
+	for _, job := range jobs {
+		waitForStatus(t, basic, server, job.(map[string]interface{})["id"].(string), backend.JobStopped)
+	}
+
+	resp = makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/arrays/"+arrayID, "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["counts"], map[string]interface{}{"STOPPED": 3.0})
+
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/arrays/missing", "", 404)
+}
+
+func TestFairShareStartsJobsOfLessLoadedUsersFirst(t *testing.T) {
+	basic := buildDefaultUser()
+	admin := httpBasic{username: "admin", password: "5678"}
+
+	config := testConfig()
+	config.MaxRunningJobs = 1
+	config.SchedulingPolicy = backend.PolicyFairShare
+	config.FairShareHalfLife = time.Second
+	state, server := setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+	state.AddUserWithOptions(admin.username, admin.password, backend.UserOptions{Admin: true, Shares: 3})
+
+	createJob := func(basic httpBasic, body string) string {
+		resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", body, 201)
+		return parseJsonObj(t, resp)["id"].(string)
+	}
+
+	// uses CPU until stopped, so that its user is the most loaded
+	busy := createJob(basic, `{"command": ["sh", "-c", "while :; do :; done"]}`)
+	queued := createJob(basic, `{"command": ["true"]}`)
+	other := createJob(admin, `{"command": ["true"]}`)
+	waitForStatus(t, basic, server, queued, backend.JobQueued)
+
+	resp := makeRequestWithHttpBasic(t, admin, "GET", server.URL+"/api/admin/scheduler", "", 200)
+	scheduler := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, scheduler["policy"], "fairshare")
+	testutil.AssertEquals(t, scheduler["queued"], 2.0)
+	users := scheduler["users"].([]interface{})
+	testutil.AssertEquals(t, users[0].(map[string]interface{})["username"], "admin")
+	testutil.AssertEquals(t, users[0].(map[string]interface{})["share"], 0.75)
+	testutil.AssertEquals(t, users[0].(map[string]interface{})["queued"], 1.0)
+	testutil.AssertEquals(t, users[1].(map[string]interface{})["running"], 1.0)
+
+	time.Sleep(200 * time.Millisecond)
+	makeRequestWithHttpBasic(t, basic, "DELETE", server.URL+"/api/jobs/"+busy, "", 204)
+	waitForStatus(t, basic, server, queued, backend.JobFinished)
+	waitForStatus(t, admin, server, other, backend.JobFinished)
+
+	startedAt := func(basic httpBasic, id string) time.Time {
+		resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs/"+id, "", 200)
+		at, err := time.Parse(time.RFC3339, parseJsonObj(t, resp)["started_at"].(string))
+		testutil.AssertNotError(t, err)
+		return at
+	}
+	testutil.AssertEquals(t, startedAt(admin, other).Before(startedAt(basic, queued)), true)
+
+	resp = makeRequestWithHttpBasic(t, admin, "GET", server.URL+"/api/admin/scheduler", "", 200)
+	users = parseJsonObj(t, resp)["users"].([]interface{})
+	testutil.AssertEquals(t, users[1].(map[string]interface{})["cpu_seconds"].(float64) > 0, true)
+
+	makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/admin/scheduler", "", 403)
+}
+
+func TestInvalidSchedulingPolicy(t *testing.T) {
+	config := testConfig()
+	config.SchedulingPolicy = "random"
+	_, err := backend.NewStateWithConfig(config)
+	testutil.AssertNotEquals(t, err, nil)
+}
+
+func TestQuotaHoldsForConcurrentRequests(t *testing.T) {
+	limited := httpBasic{username: "limited", password: "5678"}
+
+	state, server := setupTest(t, buildDefaultUser())
+	defer teardownTest(state, server)
+	state.AddUserWithOptions(limited.username, limited.password, backend.UserOptions{
+		Quota: backend.Quota{MaxRunningJobs: 3},
+	})
+
+	statuses := make(chan int, 20)
+	for i := 0; i < cap(statuses); i++ {
+		go func() {
+			req, err := http.NewRequest("POST", server.URL+"/api/jobs", strings.NewReader(`{"command": ["sleep", "10"]}`))
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			req.SetBasicAuth(limited.username, limited.password)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+
+	created := 0
+	for i := 0; i < cap(statuses); i++ {
+		status := <-statuses
+		if status == 201 {
+			created++
+		} else {
+			testutil.AssertEquals(t, status, 429)
+		}
+	}
+	testutil.AssertEquals(t, created, 3)
+
+	resp := makeRequestWithHttpBasic(t, limited, "GET", server.URL+"/api/jobs", "", 200)
+	for _, job := range parseJsonList(t, resp) {
+		makeRequestWithHttpBasic(t, limited, "DELETE", server.URL+"/api/jobs/"+job.(map[string]interface{})["id"].(string)+"?force=true", "", 204)
+	}
+}
+
+func TestQuotaRejectsJobsOverTheLimits(t *testing.T) {
+	basic := buildDefaultUser()
+	limited := httpBasic{username: "limited", password: "5678"}
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+	state.AddUserWithOptions(limited.username, limited.password, backend.UserOptions{
+		Quota: backend.Quota{MaxRunningJobs: 1, MaxJobs: 2},
+	})
+
+	resp := makeRequestWithHttpBasic(t, limited, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "10"]}`, 201)
+	running := parseJsonObj(t, resp)["id"].(string)
+
+	resp = makeRequestWithHttpBasic(t, limited, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 429)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["message"], "quota exceeded: 1 jobs haven't ended, of a maximum of 1")
+
+	// other users aren't limited
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 201)
+
+	makeRequestWithHttpBasic(t, limited, "DELETE", server.URL+"/api/jobs/"+running, "", 204)
+	waitForStatus(t, limited, server, running, backend.JobStopped)
+
+	resp = makeRequestWithHttpBasic(t, limited, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 201)
+	waitForStatus(t, limited, server, parseJsonObj(t, resp)["id"].(string), backend.JobFinished)
+
+	makeRequestWithHttpBasic(t, limited, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 429)
+
+	resp = makeRequestWithHttpBasic(t, limited, "GET", server.URL+"/api/quota", "", 200)
+	quota := parseJsonObj(t, resp)
+	testutil.AssertEquals(t, quota["running_jobs"], map[string]interface{}{"used": 0.0, "limit": 1.0})
+	testutil.AssertEquals(t, quota["jobs"], map[string]interface{}{"used": 2.0, "limit": 2.0})
+	testutil.AssertEquals(t, quota["output_bytes"], map[string]interface{}{"used": 0.0})
+
+	// the whole array is rejected when it doesn't fit
+	makeRequestWithHttpBasic(t, limited, "POST", server.URL+"/api/jobs/"+running+"/purge", "", 204)
+	makeRequestWithHttpBasic(t, limited, "POST", server.URL+"/api/jobs", `{"command": ["echo", "{{index}}"], "array": {"range": {"start": 1, "end": 2}}}`, 429)
+	resp = makeRequestWithHttpBasic(t, limited, "GET", server.URL+"/api/jobs", "", 200)
+	testutil.AssertEquals(t, len(parseJsonList(t, resp)), 1)
+}
+
+func TestQuotaLimitsCPUTimePerDay(t *testing.T) {
+	basic := buildDefaultUser()
+	limited := httpBasic{username: "limited", password: "5678"}
+
+	state, server := setupTest(t, basic)
+	defer teardownTest(state, server)
+	state.AddUserWithOptions(limited.username, limited.password, backend.UserOptions{
+		Quota: backend.Quota{MaxCPUPerDay: time.Millisecond},
+	})
+
+	resp := makeRequestWithHttpBasic(t, limited, "POST", server.URL+"/api/jobs", `{"command": ["sh", "-c", "i=0; while [ $i -lt 20000 ]; do i=$((i+1)); done"]}`, 201)
+	waitForStatus(t, limited, server, parseJsonObj(t, resp)["id"].(string), backend.JobFinished)
+
+	resp = makeRequestWithHttpBasic(t, limited, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 429)
+	testutil.AssertContains(t, parseJsonObj(t, resp)["message"].(string), "of CPU time were used today")
+
+	resp = makeRequestWithHttpBasic(t, limited, "GET", server.URL+"/api/quota", "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp)["cpu_seconds_today"], map[string]interface{}{"used": 0.0})
+}
+
+func TestRateLimitsJobCreationOfEachUser(t *testing.T) {
+	basic := buildDefaultUser()
+	other := httpBasic{username: "other", password: "5678"}
+
+	config := testConfig()
+	config.UserCreateRateLimit = backend.RateLimit{Rate: 0.01, Burst: 2}
+	state, server := setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+	state.AddUserWithOptions(other.username, other.password, backend.UserOptions{})
+
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 201)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 201)
+
+	resp := makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 429)
+	testutil.AssertEquals(t, resp.Header.Get("Retry-After"), "100")
+	testutil.AssertContains(t, parseJsonObj(t, resp)["message"].(string), "too many requests")
+
+	// reads and the other users have their own limits
+	makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs", "", 200)
+	makeRequestWithHttpBasic(t, other, "POST", server.URL+"/api/jobs", `{"command": ["true"]}`, 201)
+}
+
+func TestRateLimitsRequestsOfEachClientIP(t *testing.T) {
+	basic := buildDefaultUser()
+
+	config := testConfig()
+	config.IPReadRateLimit = backend.RateLimit{Rate: 0.5}
+	state, server := setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+
+	// requests with invalid credentials count too
+	makeRequestWithHttpBasic(t, httpBasic{username: basic.username, password: "invalid"}, "GET", server.URL+"/api/jobs", "", 401)
+
+	resp := makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs", "", 429)
+	testutil.AssertEquals(t, resp.Header.Get("Retry-After"), "2")
+
+	time.Sleep(2 * time.Second)
+	makeRequestWithHttpBasic(t, basic, "GET", server.URL+"/api/jobs", "", 200)
+}
+
+func TestInvalidRateLimit(t *testing.T) {
+	config := testConfig()
+	config.IPCreateRateLimit = backend.RateLimit{Rate: -1}
+	_, err := backend.NewStateWithConfig(config)
+	testutil.AssertNotEquals(t, err, nil)
+}
+
+// writes a users file with the users, each given as username, token and extra JSON fields
+func writeUsersFile(t *testing.T, path string, users ...[3]string) {
+	entries := make([]string, 0, len(users))
+	for _, user := range users {
+		hash := sha256.Sum256([]byte(user[1]))
+		entry := `{"username": "` + user[0] + `", "token_sha256": "` + hex.EncodeToString(hash[:]) + `"`
+		if user[2] != "" {
+			entry += ", " + user[2]
+		}
+		entries = append(entries, entry+"}")
+	}
+
+	err := ioutil.WriteFile(path, []byte(`{"users": [`+strings.Join(entries, ", ")+`]}`), 0600)
+	testutil.AssertNotError(t, err)
+}
+
+func TestReloadUsersFromFile(t *testing.T) {
+	basic := buildDefaultUser()
+	admin := httpBasic{username: "admin", password: "5678"}
+	removed := httpBasic{username: "removed", password: "abcd"}
+	added := httpBasic{username: "added", password: "efgh"}
+
+	usersFile := t.TempDir() + "/users.json"
+	writeUsersFile(t, usersFile, [3]string{basic.username, basic.password, ""},
+		[3]string{admin.username, admin.password, `"admin": true`}, [3]string{removed.username, removed.password, ""})
+
+	config := testConfig()
+	config.UsersFile = usersFile
+	state, server := setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+
+	reload, err := state.LoadUsersFile()
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, reload.Added, []string{"admin", "removed"})
+	testutil.AssertEquals(t, reload.Updated, []string{"user1"})
+
+	resp := makeRequestWithHttpBasic(t, removed, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "10"]}`, 201)
+	running := parseJsonObj(t, resp)["id"].(string)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "priority": 5}`, 403)
+
+	writeUsersFile(t, usersFile, [3]string{basic.username, basic.password, `"max_priority": 5`},
+		[3]string{admin.username, admin.password, `"admin": true`}, [3]string{added.username, added.password, ""})
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/admin/users/reload", "", 403)
+
+	resp = makeRequestWithHttpBasic(t, admin, "POST", server.URL+"/api/admin/users/reload", "", 200)
+	testutil.AssertEquals(t, parseJsonObj(t, resp), map[string]interface{}{
+		"added":   []interface{}{"added"},
+		"updated": []interface{}{"admin", "user1"},
+		"removed": []interface{}{"removed"},
+	})
+
+	makeRequestWithHttpBasic(t, removed, "GET", server.URL+"/api/jobs", "", 401)
+	makeRequestWithHttpBasic(t, added, "GET", server.URL+"/api/jobs", "", 200)
+	makeRequestWithHttpBasic(t, basic, "POST", server.URL+"/api/jobs", `{"command": ["true"], "priority": 5}`, 201)
+
+	// the jobs of removed users are kept running by default
+	job := state.GetIndexedUser(removed.username).GetJob(running)
+	testutil.AssertEquals(t, job.GetStatus(), backend.JobRunning)
+	testutil.AssertNotError(t, state.StopJob(job, true))
+
+	// an invalid file leaves the users unchanged
+	testutil.AssertNotError(t, ioutil.WriteFile(usersFile, []byte(`{"users": [{"username": "added"}]}`), 0600))
+	makeRequestWithHttpBasic(t, admin, "POST", server.URL+"/api/admin/users/reload", "", 422)
+	makeRequestWithHttpBasic(t, added, "GET", server.URL+"/api/jobs", "", 200)
+}
+
+func TestRemovedUsersJobsAreStopped(t *testing.T) {
+	basic := buildDefaultUser()
+	removed := httpBasic{username: "removed", password: "abcd"}
+
+	usersFile := t.TempDir() + "/users.json"
+	writeUsersFile(t, usersFile, [3]string{basic.username, basic.password, ""}, [3]string{removed.username, removed.password, ""})
+
+	config := testConfig()
+	config.UsersFile = usersFile
+	config.RemovedUserJobs = backend.RemovedUserStopJobs
+	state, server := setupTestWithConfig(t, basic, config)
+	defer teardownTest(state, server)
+
+	_, err := state.LoadUsersFile()
+	testutil.AssertNotError(t, err)
+
+	resp := makeRequestWithHttpBasic(t, removed, "POST", server.URL+"/api/jobs", `{"command": ["sleep", "10"]}`, 201)
+	running := parseJsonObj(t, resp)["id"].(string)
+	resp = makeRequestWithHttpBasic(t, removed, "POST", server.URL+"/api/schedules", `{"cron": "@daily", "job": {"command": ["true"]}}`, 201)
+	scheduleID := parseJsonObj(t, resp)["id"].(string)
+
+	writeUsersFile(t, usersFile, [3]string{basic.username, basic.password, ""})
+	reload, err := state.LoadUsersFile()
+	testutil.AssertNotError(t, err)
+	testutil.AssertEquals(t, reload.Removed, []string{"removed"})
+
+	user := state.GetIndexedUser(removed.username)
+	limitedWait(t, func() bool { return user.GetJob(running).GetStatus() == backend.JobStopped })
+	testutil.AssertEquals(t, user.GetSchedule(scheduleID).AsView().Paused, true)
+
+	// the user gets their jobs back when added again
+	writeUsersFile(t, usersFile, [3]string{basic.username, basic.password, ""}, [3]string{removed.username, removed.password, ""})
+	_, err = state.LoadUsersFile()
+	testutil.AssertNotError(t, err)
+	waitForStatus(t, removed, server, running, backend.JobStopped)
+}
+
+func TestInvalidUsersFile(t *testing.T) {
+	usersFile := t.TempDir() + "/users.json"
+
+	for _, content := range []string{
+		`{"users": [{"username": "user1", "token_sha256": "1234"}]}`,
+		`{"users": [{"username": "", "token_sha256": "` + strings.Repeat("a", 64) + `"}]}`,
+		`{"users": [{"username": "user1", "token_sha256": "` + strings.Repeat("a", 64) + `", "unix_user": "1001"}]}`,
+		`{"users": [{"username": "user1", "token_sha256": "` + strings.Repeat("a", 64) + `", "shares": -1}]}`,
+		`{"users": [{"username": "user1", "token_sha256": "` + strings.Repeat("a", 64) + `", "unknown": 1}]}`,
+		`{"users": [{"username": "user1", "token_sha256": "` + strings.Repeat("a", 64) + `"}, {"username": "user1", "token_sha256": "` + strings.Repeat("b", 64) + `"}]}`,
+	} {
+		testutil.AssertNotError(t, ioutil.WriteFile(usersFile, []byte(content), 0600))
+		_, err := backend.ParseUsersFile(usersFile)
+		testutil.AssertNotEquals(t, err, nil)
+	}
+
+	state := backend.NewState()
+	_, err := state.LoadUsersFile()
+	testutil.AssertEquals(t, err, backend.ErrNoUsersFile)
+}
@@ -1,10 +1,23 @@
 package backend
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultTerminalRows = 24
+	defaultTerminalCols = 80
 )
 
 var bufSize = os.Getpagesize()
@@ -22,7 +35,8 @@ func readPipe(consumer func([]byte), r io.Reader, ch chan<- error) {
 			continue
 		}
 
-		if err == io.EOF {
+		// the terminal of TTY jobs returns EIO instead of EOF once every process closes it
+		if err == io.EOF || errors.Is(err, syscall.EIO) {
 			ch <- nil
 		} else {
 			ch <- err
@@ -32,11 +46,22 @@ func readPipe(consumer func([]byte), r io.Reader, ch chan<- error) {
 	}
 }
 
-func waitJob(job *Job, cmd *exec.Cmd, stdout, stderr io.Reader) {
+// 'stderr' is nil for TTY jobs, the terminal output is all in 'stdout'
+func waitJob(user *User, job *Job, cmd *exec.Cmd, stdout, stderr io.Reader, scheduler *scheduler) {
+	defer scheduler.release(job)
+	defer job.removeCgroup()
+	defer job.closeTerminal()
+
 	waiter := make(chan error, 2)
 	go readPipe(job.UpdateStdout, stdout, waiter)
-	go readPipe(job.UpdateStderr, stderr, waiter)
+	if stderr != nil {
+		go readPipe(job.UpdateStderr, stderr, waiter)
+	} else {
+		waiter <- nil
+	}
 
+	// the pipes are only closed when every process holding them exits, including descendants of the job,
+	// so the job isn't reported as completed while any of them are still running
 	for i := 0; i < cap(waiter); i++ {
 		err := <-waiter
 		if err != nil {
@@ -44,7 +69,16 @@ func waitJob(job *Job, cmd *exec.Cmd, stdout, stderr io.Reader) {
 		}
 	}
 
-	switch err := cmd.Wait(); exitErr := err.(type) {
+	err := cmd.Wait()
+	// used by the fair share policy and the quota. The job's cgroup has the CPU time of all its processes, without it
+	// only the descendants that the job waited for are included.
+	cpu := job.runningCPU()
+	if cpu == 0 && cmd.ProcessState != nil {
+		cpu = cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+	}
+	scheduler.charge(job.owner, cpu)
+
+	switch exitErr := err.(type) {
 	case nil:
 		job.MarkAsFinished(0)
 
@@ -60,27 +94,204 @@ func waitJob(job *Job, cmd *exec.Cmd, stdout, stderr io.Reader) {
 		log.Printf("Something went wrong with process execution or termination %s %s", cmd.Path, err)
 		job.MarkAsKilled()
 	}
+
+	// the quota counts the CPU time of the job while it's executing, it's only charged to the day once it ended
+	user.chargeCPU(cpu, time.Now())
 }
 
-func SpawnJob(user *User, command []string) (*Job, error) {
-	cmd := exec.Command(command[0], command[1:]...)
+var (
+	ErrNoCredential    = errors.New("user isn't mapped to a Unix account to run jobs as, set its unix_user in the users file")
+	ErrPriorityTooHigh = errors.New("priority is higher than the maximum allowed for the user")
+)
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
+func buildEnv(env map[string]string) []string {
+	result := make([]string, 0, len(env))
+	for key, value := range env {
+		result = append(result, key+"="+value)
+	}
+
+	// deterministic order, to not depend on map iteration
+	sort.Strings(result)
+	return result
+}
+
+// SubmitJob creates a job for the user, which is started right away if the scheduler has a free slot or queued otherwise.
+// A job with a future start time is scheduled until then, and a job with dependencies waits for them. Errors starting the job are only returned when it's started right away.
+// The job is added to the user.
+func SubmitJob(state *State, user *User, spec *JobSpec) (*Job, error) {
+	return submitJob(state, user, spec, jobOrigin{})
+}
+
+// jobOrigin is what created a job other than a request for it alone, the zero value if nothing did
+type jobOrigin struct {
+	scheduleID string // schedule whose run the job is
+	arrayID    string // job array the job belongs to
+	arrayIndex int
+}
+
+func submitJob(state *State, user *User, spec *JobSpec, origin jobOrigin) (*Job, error) {
+	if err := checkJobAllowed(state, user, spec); err != nil {
 		return nil, err
 	}
 
-	stderr, err := cmd.StderrPipe()
+	if err := user.reserveQuota(1, time.Now()); err != nil {
+		return nil, err
+	}
+
+	job, err := createJob(state, user, spec, origin)
 	if err != nil {
+		user.releaseQuota(1)
 		return nil, err
 	}
 
-	if err := cmd.Start(); err != nil {
+	user.addReservedJobs(job)
+	return job, nil
+}
+
+// creates the job and submits it, once the user is allowed to run it and has the quota for it
+func createJob(state *State, user *User, spec *JobSpec, origin jobOrigin) (*Job, error) {
+	dependencies, err := user.getDependencies(spec.DependsOn.Jobs)
+	if err != nil {
 		return nil, err
 	}
 
-	job := CreateJob(command, cmd.Process)
-	go waitJob(job, cmd, stdout, stderr)
+	job := CreateJob(uuid.NewString(), user.username, spec, state.outputLimits())
+	job.scheduleID, job.arrayID, job.arrayIndex = origin.scheduleID, origin.arrayID, origin.arrayIndex
+	switch job.GetStatus() {
+	case JobWaiting:
+		state.waitForDependencies(user, job, dependencies)
+	case JobScheduled:
+		state.wheel.add(user, job, spec.StartAt)
+	default:
+		if err := state.scheduler.submit(user, job); err != nil {
+			return nil, err
+		}
+	}
 
+	job.persistTo(state.store)
 	return job, nil
 }
+
+// checks whether the user can run a job with the spec
+func checkJobAllowed(state *State, user *User, spec *JobSpec) error {
+	if user.GetCredential() == nil && !state.config.AllowUnmappedUsers {
+		return ErrNoCredential
+	}
+
+	if spec.Priority > user.getMaxPriority() {
+		return ErrPriorityTooHigh
+	}
+
+	return nil
+}
+
+// starts the process of a queued job
+func startJob(state *State, user *User, job *Job) error {
+	spec, id := job.spec, job.id
+	command := spec.Command
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = spec.WorkingDir
+	cmd.Env = buildEnv(spec.Env)
+
+	// the job leads its own process group, so that it can be signaled together with its descendants
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if credential := user.GetCredential(); credential != nil {
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    credential.UID,
+			Gid:    credential.GID,
+			Groups: credential.Groups,
+		}
+	}
+
+	output, err := newJobOutput(id, state.outputLimits())
+	if err != nil {
+		return err
+	}
+
+	var cgroup *jobCgroup
+	if state.cgroups != nil {
+		if cgroup, err = state.cgroups.createJobCgroup(id, spec.Limits); err != nil {
+			output.release()
+			return err
+		}
+
+		// the process is placed in the cgroup before it execs, so the limits apply from the start
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = cgroup.fd()
+	}
+
+	var terminal *os.File
+	var stdin io.WriteCloser
+	var stdout, stderr io.Reader
+	if spec.TTY {
+		terminal, err = startTerminalProcess(cmd)
+		stdin, stdout = terminal, terminal
+	} else {
+		stdin, stdout, stderr, err = startProcess(cmd, spec)
+	}
+
+	if err != nil {
+		if cgroup != nil {
+			cgroup.remove()
+		}
+		output.release()
+
+		return err
+	}
+
+	processStart, err := processStartTime(cmd.Process.Pid)
+	if err != nil {
+		log.Printf("Failed to read the start time of job %s, it can't be re-adopted after a restart: %s", id, err)
+	}
+	job.start(cmd.Process, processStart, cgroup, stdin, terminal, output)
+	if stdin != nil && len(spec.Stdin) != 0 {
+		// interactive and TTY jobs keep their stdin open after the content, which is written like attach sessions do,
+		// holding the stdin that 'start' acquired for it
+		go func() {
+			defer job.ReleaseStdin()
+			if err := job.WriteStdin(spec.Stdin); err != nil {
+				log.Printf("Failed to write the stdin of job %s: %s", id, err)
+			}
+		}()
+	}
+	go waitJob(user, job, cmd, stdout, stderr, state.scheduler)
+
+	return nil
+}
+
+// starts the process with a new pseudo-terminal as its stdin, stdout and stderr, returns the terminal's master side
+func startTerminalProcess(cmd *exec.Cmd) (*os.File, error) {
+	// the process leads a new session to have a controlling terminal, which also makes it lead its own process group
+	attrs := cmd.SysProcAttr
+	attrs.Setpgid = false
+	attrs.Setsid = true
+	attrs.Setctty = true // the terminal is the process' stdin, fd 0
+
+	return pty.StartWithAttrs(cmd, &pty.Winsize{Rows: defaultTerminalRows, Cols: defaultTerminalCols}, attrs)
+}
+
+func startProcess(cmd *exec.Cmd, spec *JobSpec) (stdin io.WriteCloser, stdout, stderr io.Reader, err error) {
+	if spec.Interactive {
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return nil, nil, nil, err
+		}
+	} else if len(spec.Stdin) != 0 {
+		// copied to the process and closed by 'exec'
+		cmd.Stdin = bytes.NewReader(spec.Stdin)
+	}
+
+	if stdout, err = cmd.StdoutPipe(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if stderr, err = cmd.StderrPipe(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return stdin, stdout, stderr, nil
+}
@@ -1,16 +1,350 @@
 package backend
 
-import "sync"
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+)
+
+type Config struct {
+	CgroupRoot             string            // parent cgroup v2 directory for the job cgroups, resource limits are disabled if empty
+	DefaultStopSignal      string            // stop signal of jobs that don't specify one
+	DefaultStopGracePeriod time.Duration     // stop grace period of jobs that don't specify one
+	MaxStdinSize           int64             // maximum size in bytes of the stdin given when creating a job
+	BaseEnv                map[string]string // environment every job starts with, instead of inheriting the server's
+	DefaultWorkingDir      string            // working directory of jobs that don't specify one
+	AllowUnmappedUsers     bool              // users not mapped to a Unix account can create jobs, run as the server's account
+	MaxTimeout             time.Duration     // maximum timeout of jobs, also used for jobs that don't specify one, no maximum if 0
+	MaxOutputSize          int               // bytes of each stream of a job kept in memory
+	MaxTotalOutputSize     int64             // bytes of output kept in memory by all the jobs, no maximum if 0
+	OutputRetention        OutputRetention   // which part of the output is kept once a stream is larger than MaxOutputSize
+	LogDir                 string            // directory where the output of the jobs is written, only kept in memory if empty
+	StoreDir               string            // directory where the job records are persisted, only kept in memory if empty
+	MaxJobAge              time.Duration     // ended jobs are removed this long after they end, kept if 0
+	MaxJobsPerUser         int               // ended jobs kept for each user, the ones that ended first are removed, no maximum if 0
+	RetentionSweepInterval time.Duration     // how often the jobs are checked against MaxJobAge and MaxJobsPerUser
+	MaxRunningJobs         int               // jobs running at once on the server, the others are queued, no maximum if 0
+	MaxRunningJobsPerUser  int               // jobs running at once for each user, no maximum if 0
+	Preemption             PreemptionMode    // how queued jobs take the slots of running jobs with a lower priority
+	SchedulingPolicy       SchedulingPolicy  // which of the queued jobs of the same priority is started first
+	FairShareHalfLife      time.Duration     // time after which the CPU time used by a user counts half as much for the fair share
+	UserReadRateLimit      RateLimit         // requests of each user other than job and schedule creations, no limit by default
+	UserCreateRateLimit    RateLimit         // job and schedule creations of each user, no limit by default
+	IPReadRateLimit        RateLimit         // requests from each client IP other than job and schedule creations, no limit by default
+	IPCreateRateLimit      RateLimit         // job and schedule creations from each client IP, no limit by default
+	UsersFile              string            // file the users are loaded and reloaded from, the users are only added in code if empty
+	RemovedUserJobs        RemovedUserPolicy // what happens to the jobs of the users removed from the users file
+}
+
+func DefaultConfig() Config {
+	return Config{
+		DefaultStopSignal:      "SIGTERM",
+		DefaultStopGracePeriod: 10 * time.Second,
+		MaxStdinSize:           16 << 20,
+		BaseEnv: map[string]string{
+			"PATH": "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		},
+		DefaultWorkingDir:      "/",
+		MaxOutputSize:          8 << 20,
+		MaxTotalOutputSize:     1 << 30,
+		OutputRetention:        RetainBoth,
+		RetentionSweepInterval: time.Minute,
+		Preemption:             PreemptionOff,
+		SchedulingPolicy:       PolicyFIFO,
+		FairShareHalfLife:      time.Hour,
+		RemovedUserJobs:        RemovedUserKeepJobs,
+	}
+}
 
 type State struct {
 	usersIndexLock sync.RWMutex     // synchronizes access to the 'usersIndex' global state
 	usersIndex     map[string]*User // maps username to user struct
+	config         Config           // server wide configuration, not modified after creation
+	cgroups        *CgroupManager   // nil when resource limits are disabled
+	outputBudget   *outputBudget    // output kept in memory by all the jobs
+	store          JobStore         // persists the job records
+	stopSweeper    chan struct{}    // closed to stop the retention sweeper, nil if it isn't running
+	scheduler      *scheduler       // starts the jobs, limiting how many run at once
+	wheel          *timerWheel      // queues the scheduled jobs once their start time is reached
 }
 
 func NewState() *State {
-	return &State{
+	s := &State{
 		usersIndexLock: sync.RWMutex{},
 		usersIndex:     map[string]*User{},
+		config:         DefaultConfig(),
+		outputBudget:   &outputBudget{max: DefaultConfig().MaxTotalOutputSize},
+		store:          NewMemoryStore(),
+	}
+	s.scheduler = s.newScheduler()
+	s.wheel = newTimerWheel(s.promoteJob)
+
+	return s
+}
+
+// queues a scheduled job whose start time was reached, unless it was cancelled
+func (s *State) promoteJob(user *User, job *Job) {
+	if job.promote() {
+		s.submitQueued(user, job)
+	}
+}
+
+// submits a job that was waiting to the scheduler, once it's queued
+func (s *State) submitQueued(user *User, job *Job) {
+	if err := s.scheduler.submit(user, job); err != nil {
+		log.Printf("Failed to start queued job %s, because: %s", job.GetID(), err)
+		job.MarkAsKilled()
+	}
+}
+
+func (s *State) newScheduler() *scheduler {
+	start := func(user *User, job *Job) error {
+		return startJob(s, user, job)
+	}
+	retry := func(user *User, job *Job) {
+		s.wheel.add(user, job, job.getStartAt())
+	}
+
+	return newScheduler(&s.config, start, retry)
+}
+
+func NewStateWithConfig(config Config) (*State, error) {
+	if _, ok := stopSignals[config.DefaultStopSignal]; !ok {
+		return nil, fmt.Errorf("invalid default stop signal '%s'", config.DefaultStopSignal)
+	}
+
+	if config.MaxTimeout < 0 {
+		return nil, fmt.Errorf("invalid maximum timeout '%s'", config.MaxTimeout)
+	}
+
+	if config.MaxJobAge < 0 || config.MaxJobsPerUser < 0 || config.RetentionSweepInterval <= 0 {
+		return nil, errors.New("the retention policy can't be negative, and the sweep interval must be set")
+	}
+
+	if config.MaxRunningJobs < 0 || config.MaxRunningJobsPerUser < 0 {
+		return nil, errors.New("the maximum running jobs can't be negative")
+	}
+
+	switch config.Preemption {
+	case PreemptionOff, PreemptionSuspend, PreemptionRequeue:
+	default:
+		return nil, fmt.Errorf("invalid preemption '%s', must be one of 'off', 'suspend' or 'requeue'", config.Preemption)
+	}
+
+	switch config.SchedulingPolicy {
+	case PolicyFIFO, PolicyFairShare:
+	default:
+		return nil, fmt.Errorf("invalid scheduling policy '%s', must be one of 'fifo' or 'fairshare'", config.SchedulingPolicy)
+	}
+
+	switch config.RemovedUserJobs {
+	case RemovedUserKeepJobs, RemovedUserStopJobs:
+	default:
+		return nil, fmt.Errorf("invalid removed user jobs policy '%s', must be one of 'keep' or 'stop'", config.RemovedUserJobs)
+	}
+
+	if config.FairShareHalfLife <= 0 {
+		return nil, errors.New("the fair share half-life must be positive")
+	}
+
+	for _, limit := range []RateLimit{config.UserReadRateLimit, config.UserCreateRateLimit, config.IPReadRateLimit, config.IPCreateRateLimit} {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return nil, errors.New("the rate limits can't be negative")
+		}
+	}
+
+	if config.MaxOutputSize <= 0 || config.MaxTotalOutputSize < 0 {
+		return nil, errors.New("the maximum output sizes can't be negative, and the maximum of each job must be set")
+	}
+
+	switch config.OutputRetention {
+	case RetainHead, RetainTail, RetainBoth:
+	default:
+		return nil, fmt.Errorf("invalid output retention '%s', must be one of 'head', 'tail' or 'both'", config.OutputRetention)
+	}
+
+	if config.LogDir != "" {
+		if err := os.MkdirAll(config.LogDir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	s := NewState()
+	s.config = config
+	s.outputBudget = &outputBudget{max: config.MaxTotalOutputSize}
+	s.scheduler = s.newScheduler()
+	s.wheel = newTimerWheel(s.promoteJob)
+
+	if config.CgroupRoot != "" {
+		cgroups, err := NewCgroupManager(config.CgroupRoot)
+		if err != nil {
+			return nil, err
+		}
+		s.cgroups = cgroups
+	}
+
+	if config.StoreDir != "" {
+		store, err := NewFileStore(config.StoreDir)
+		if err != nil {
+			return nil, err
+		}
+		s.store = store
+	}
+
+	if config.MaxJobAge != 0 || config.MaxJobsPerUser != 0 {
+		s.stopSweeper = make(chan struct{})
+		go s.runRetentionSweeper(s.stopSweeper)
+	}
+
+	return s, nil
+}
+
+// periodically removes the ended jobs that the retention policy doesn't keep, until the state is closed
+func (s *State) runRetentionSweeper(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.config.RetentionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.sweepJobs(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *State) getAllUsers() []*User {
+	s.usersIndexLock.RLock()
+	defer s.usersIndexLock.RUnlock()
+
+	users := make([]*User, 0, len(s.usersIndex))
+	for _, user := range s.usersIndex {
+		users = append(users, user)
+	}
+
+	return users
+}
+
+func (s *State) sweepJobs(now time.Time) {
+	for _, user := range s.getAllUsers() {
+		user.sweepJobs(s.config.MaxJobAge, s.config.MaxJobsPerUser, now)
+	}
+}
+
+// LoadJobs restores the jobs saved in the store, it must be called once the users are added.
+// Jobs whose process was running when the server stopped are re-adopted if it still runs, or marked as LOST otherwise.
+// Queued and suspended jobs are queued again in the order they were submitted, scheduled jobs wait for their start time
+// and waiting jobs for their dependencies.
+func (s *State) LoadJobs() error {
+	records, err := s.store.Load()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(records, func(i, k int) bool { return records[i].CreatedAt.Before(records[k].CreatedAt) })
+
+	waiting := []*queuedJob{}
+	for _, record := range records {
+		user := s.GetIndexedUser(record.Username)
+		if user == nil {
+			log.Printf("Not loading job %s of unknown user %s", record.ID, record.Username)
+			continue
+		}
+
+		job := restoreJob(s, record)
+		user.AddJob(job)
+		switch job.GetStatus() {
+		case JobWaiting:
+			waiting = append(waiting, &queuedJob{user: user, job: job})
+		case JobScheduled:
+			s.wheel.add(user, job, job.getStartAt())
+		case JobQueued, JobSuspended:
+			s.scheduler.enqueue(user, job)
+		case JobRunning, JobStopping:
+			s.scheduler.adopted(user, job)
+		}
+	}
+
+	// once every job is loaded, since waiting jobs can depend on jobs created after them
+	for _, queued := range waiting {
+		s.restoreDependencies(queued.user, queued.job)
+	}
+
+	// the re-adopted jobs are already counted as running
+	s.scheduler.dispatch()
+	return nil
+}
+
+// LoadSchedules restores the schedules saved in the store, it must be called once the jobs are loaded.
+// Runs missed while the server was stopped aren't started, the schedules fire again from now on.
+func (s *State) LoadSchedules() error {
+	records, err := s.store.LoadSchedules()
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		user := s.GetIndexedUser(record.Username)
+		if user == nil {
+			log.Printf("Not loading schedule %s of unknown user %s", record.ID, record.Username)
+			continue
+		}
+
+		schedule, err := restoreSchedule(s, user, record)
+		if err != nil {
+			log.Printf("Not loading schedule %s, because: %s", record.ID, err)
+			continue
+		}
+
+		user.AddSchedule(schedule)
+	}
+
+	return nil
+}
+
+// StopJob stops the job, a queued or scheduled job is removed from the queue or the wheel and marked as stopped right away
+func (s *State) StopJob(job *Job, force bool) error {
+	if s.scheduler.cancel(job, force) {
+		s.wheel.remove(job)
+		return nil
+	}
+
+	return job.StopJob(force)
+}
+
+// GetSchedulerView returns the scheduler's policy and limits, and the share, usage and queue depth of each user
+func (s *State) GetSchedulerView() view.SchedulerView {
+	return s.scheduler.view(s.getAllUsers())
+}
+
+func (s *State) Close() error {
+	if s.stopSweeper != nil {
+		close(s.stopSweeper)
+		s.stopSweeper = nil
+	}
+
+	for _, user := range s.getAllUsers() {
+		user.stopSchedules()
+	}
+	s.wheel.close()
+
+	return s.store.Close()
+}
+
+func (s *State) outputLimits() outputLimits {
+	return outputLimits{
+		retention: s.config.OutputRetention,
+		maxSize:   s.config.MaxOutputSize,
+		budget:    s.outputBudget,
+		logDir:    s.config.LogDir,
 	}
 }
 
@@ -22,19 +356,27 @@ func (s *State) GetIndexedUser(username string) *User {
 }
 
 func (s *State) AddUser(username, token string) {
+	s.AddUserWithCredential(username, token, nil)
+}
+
+// AddUserWithCredential adds a user whose jobs run as the 'credential' Unix account
+func (s *State) AddUserWithCredential(username, token string, credential *UnixCredential) {
+	s.AddUserWithOptions(username, token, UserOptions{Credential: credential})
+}
+
+func (s *State) AddUserWithOptions(username, token string, options UserOptions) {
 	s.usersIndexLock.Lock()
 	defer s.usersIndexLock.Unlock()
 
-	s.usersIndex[username] = &User{
-		username: username,
-		token:    token,
-		jobs:     map[string]*Job{},
-	}
+	s.usersIndex[username] = newUser(username, sha256.Sum256([]byte(token)), options)
 }
 
 func (s *State) ClearUsers() {
 	s.usersIndexLock.Lock()
 	defer s.usersIndexLock.Unlock()
 
+	for _, user := range s.usersIndex {
+		user.stopSchedules()
+	}
 	s.usersIndex = map[string]*User{}
 }
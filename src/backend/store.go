@@ -0,0 +1,508 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// JobRecord is what's persisted of a job, enough to show it and to find its process after a restart
+type JobRecord struct {
+	ID           string        `json:"id"`
+	Username     string        `json:"username"` // owner of the job
+	Spec         JobSpec       `json:"spec"`     // without the stdin once the job started and the env once it ended, only used to run it
+	Status       JobStatus     `json:"status"`
+	TimedOut     bool          `json:"timed_out,omitempty"`
+	ExitCode     *int          `json:"exit_code,omitempty"`
+	CreatedAt    time.Time     `json:"created_at"`
+	StartedAt    time.Time     `json:"started_at,omitempty"`
+	StoppedAt    time.Time     `json:"stopped_at,omitempty"`
+	PID          int           `json:"pid"`              // 0 while the job is queued
+	ProcessStart uint64        `json:"process_start"`    // start time of the process, tells if the PID still belongs to it after a restart
+	Output       *OutputRecord `json:"output,omitempty"` // output kept when the record was saved, complete once the job ends
+	Requeue      bool          `json:"requeue,omitempty"`
+	History      []JobEvent    `json:"history,omitempty"`
+	ScheduleID   string        `json:"schedule_id,omitempty"` // schedule that started the job, empty if started by the user
+	ArrayID      string        `json:"array_id,omitempty"`    // job array the job belongs to, empty if created on its own
+	ArrayIndex   int           `json:"array_index,omitempty"` // index of the job in its array
+	StartAt      time.Time     `json:"start_at,omitempty"`    // when a scheduled job is queued
+	Attempts     []JobAttempt  `json:"attempts,omitempty"`
+}
+
+// ScheduleRecord is what's persisted of a schedule
+type ScheduleRecord struct {
+	ID        string        `json:"id"`
+	Username  string        `json:"username"` // owner of the schedule
+	Cron      string        `json:"cron"`
+	Overlap   OverlapPolicy `json:"overlap"`
+	Job       JobSpec       `json:"job"` // including the stdin, which is given to every run
+	Paused    bool          `json:"paused,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+	LastRunAt time.Time     `json:"last_run_at,omitempty"`
+	Runs      []string      `json:"runs,omitempty"`
+	Skipped   int           `json:"skipped,omitempty"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// JobStore persists the job and schedule records, so that they survive server restarts.
+// Job records are saved when jobs are created, when they are stopped and when they end,
+// schedule records when they are created, fire or are paused.
+type JobStore interface {
+	Load() ([]*JobRecord, error)  // returns every saved record
+	Save(record *JobRecord) error // creates or replaces the record with the same ID
+	Delete(id string) error       // removes the record, if it exists
+	LoadSchedules() ([]*ScheduleRecord, error)
+	SaveSchedule(record *ScheduleRecord) error
+	DeleteSchedule(id string) error
+	Close() error
+}
+
+// MemoryStore keeps the records in memory, they are lost when the server stops. The output isn't kept since the jobs
+// already hold it in memory, and the records can't outlive the server anyway.
+type MemoryStore struct {
+	lock      sync.RWMutex
+	records   map[string]*JobRecord      // index key is the job ID
+	schedules map[string]*ScheduleRecord // index key is the schedule ID
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]*JobRecord{}, schedules: map[string]*ScheduleRecord{}}
+}
+
+func (s *MemoryStore) Load() ([]*JobRecord, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	records := make([]*JobRecord, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (s *MemoryStore) Save(record *JobRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	withoutOutput := *record
+	withoutOutput.Output = nil
+	s.records[record.ID] = &withoutOutput
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.records, id)
+	return nil
+}
+
+func (s *MemoryStore) LoadSchedules() ([]*ScheduleRecord, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	records := make([]*ScheduleRecord, 0, len(s.schedules))
+	for _, record := range s.schedules {
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (s *MemoryStore) SaveSchedule(record *ScheduleRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.schedules[record.ID] = record
+	return nil
+}
+
+func (s *MemoryStore) DeleteSchedule(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.schedules, id)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+const (
+	snapshotFile          = "jobs.json"
+	schedulesSnapshotFile = "schedules.json"
+	walFile               = "jobs.wal"
+	stdinDir              = "stdin" // directory with a file for the stdin of each waiting job, named after its ID
+	maxWALEntries         = 1000    // entries appended to the WAL before it's compacted into the snapshot
+)
+
+// entry of the write-ahead log, a saved record or the ID of a deleted one, of a job or a schedule
+type walEntry struct {
+	Record          *JobRecord      `json:"record,omitempty"`
+	Deleted         string          `json:"deleted,omitempty"`
+	Schedule        *ScheduleRecord `json:"schedule,omitempty"`
+	DeletedSchedule string          `json:"deleted_schedule,omitempty"`
+}
+
+// FileStore persists the records in a directory, as a snapshot of every record plus a write-ahead log (WAL) of the
+// changes since the snapshot. Each change is synced to disk before returning. The WAL is compacted into a new snapshot
+// when the store is opened and once it grows too large.
+// The stdin of a job is written to its own file the first time a record of the job has it, instead of with every
+// record, and is removed once a record of the job doesn't have it anymore.
+type FileStore struct {
+	lock       sync.Mutex
+	dir        string
+	records    map[string]*JobRecord      // index key is the job ID, without the stdin
+	schedules  map[string]*ScheduleRecord // index key is the schedule ID
+	stdin      map[string]bool            // jobs with a stdin file, index key is the job ID
+	wal        *os.File
+	walEntries int
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, stdinDir), 0700); err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{dir: dir, records: map[string]*JobRecord{}, schedules: map[string]*ScheduleRecord{}, stdin: map[string]bool{}}
+	if err := s.readSnapshot(); err != nil {
+		return nil, err
+	}
+
+	if err := s.replayWAL(); err != nil {
+		return nil, err
+	}
+
+	if err := s.readStdinDir(); err != nil {
+		return nil, err
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func readJSONFile(path string, target interface{}) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, target)
+}
+
+func (s *FileStore) readSnapshot() error {
+	records := []*JobRecord{}
+	if err := readJSONFile(filepath.Join(s.dir, snapshotFile), &records); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		s.records[record.ID] = record
+	}
+
+	schedules := []*ScheduleRecord{}
+	if err := readJSONFile(filepath.Join(s.dir, schedulesSnapshotFile), &schedules); err != nil {
+		return err
+	}
+
+	for _, record := range schedules {
+		s.schedules[record.ID] = record
+	}
+
+	return nil
+}
+
+func (s *FileStore) replayWAL() error {
+	file, err := os.Open(filepath.Join(s.dir, walFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// a line without a newline was being written when the server stopped, the change wasn't acknowledged
+			return nil
+		}
+
+		entry := walEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+
+		s.apply(&entry)
+	}
+}
+
+func (s *FileStore) apply(entry *walEntry) {
+	switch {
+	case entry.Record != nil:
+		s.records[entry.Record.ID] = entry.Record
+	case entry.Deleted != "":
+		delete(s.records, entry.Deleted)
+	case entry.Schedule != nil:
+		s.schedules[entry.Schedule.ID] = entry.Schedule
+	default:
+		delete(s.schedules, entry.DeletedSchedule)
+	}
+}
+
+// finds the stdin files, the ones of jobs without a record are removed
+func (s *FileStore) readStdinDir() error {
+	entries, err := os.ReadDir(filepath.Join(s.dir, stdinDir))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if _, ok := s.records[entry.Name()]; ok {
+			s.stdin[entry.Name()] = true
+		} else if err := os.Remove(s.stdinPath(entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *FileStore) stdinPath(id string) string {
+	return filepath.Join(s.dir, stdinDir, id)
+}
+
+// writes the stdin file of the job of the record the first time it has a stdin, and removes the file once it doesn't.
+// Returns the record to append to the WAL, without the stdin.
+func (s *FileStore) saveStdin(record *JobRecord) (*JobRecord, error) {
+	id, stdin := record.ID, record.Spec.Stdin
+	switch {
+	case len(stdin) != 0 && !s.stdin[id]:
+		if err := writeFileSynced(s.stdinPath(id), stdin); err != nil {
+			return nil, err
+		}
+		s.stdin[id] = true
+	case len(stdin) == 0 && s.stdin[id]:
+		if err := s.deleteStdin(id); err != nil {
+			return nil, err
+		}
+	}
+
+	withoutStdin := *record
+	withoutStdin.Spec.Stdin = nil
+	return &withoutStdin, nil
+}
+
+func (s *FileStore) deleteStdin(id string) error {
+	if !s.stdin[id] {
+		return nil
+	}
+
+	if err := os.Remove(s.stdinPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	delete(s.stdin, id)
+	return nil
+}
+
+// writes every record to new snapshots, of the jobs and of the schedules, and starts an empty WAL. Each snapshot is
+// replaced atomically, if the server stops before the WAL is truncated the WAL's changes are applied again, which
+// gives the same records.
+func (s *FileStore) compact() error {
+	records := make([]*JobRecord, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+
+	snapshot, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	schedules := make([]*ScheduleRecord, 0, len(s.schedules))
+	for _, record := range s.schedules {
+		schedules = append(schedules, record)
+	}
+
+	schedulesSnapshot, err := json.Marshal(schedules)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileSynced(filepath.Join(s.dir, snapshotFile), snapshot); err != nil {
+		return err
+	}
+
+	if err := writeFileSynced(filepath.Join(s.dir, schedulesSnapshotFile), schedulesSnapshot); err != nil {
+		return err
+	}
+
+	if s.wal != nil {
+		s.wal.Close()
+	}
+
+	s.wal, err = os.OpenFile(filepath.Join(s.dir, walFile), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0600)
+	s.walEntries = 0
+	return err
+}
+
+// replaces the file at 'path' with 'content', without leaving a partially written file if the server stops
+func writeFileSynced(path string, content []byte) error {
+	temporary := path + ".tmp"
+	file, err := os.OpenFile(temporary, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, path)
+}
+
+func (s *FileStore) append(entry *walEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.wal == nil {
+		return errors.New("job store is closed")
+	}
+
+	return s.appendLocked(entry)
+}
+
+func (s *FileStore) appendLocked(entry *walEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.wal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+
+	s.apply(entry)
+	if s.walEntries++; s.walEntries >= maxWALEntries {
+		return s.compact()
+	}
+
+	return nil
+}
+
+func (s *FileStore) Load() ([]*JobRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	records := make([]*JobRecord, 0, len(s.records))
+	for id, record := range s.records {
+		if s.stdin[id] {
+			withStdin := *record
+			stdin, err := os.ReadFile(s.stdinPath(id))
+			if err != nil {
+				return nil, err
+			}
+
+			withStdin.Spec.Stdin = stdin
+			record = &withStdin
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (s *FileStore) Save(record *JobRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.wal == nil {
+		return errors.New("job store is closed")
+	}
+
+	record, err := s.saveStdin(record)
+	if err != nil {
+		return err
+	}
+
+	return s.appendLocked(&walEntry{Record: record})
+}
+
+func (s *FileStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.wal == nil {
+		return errors.New("job store is closed")
+	}
+
+	if err := s.deleteStdin(id); err != nil {
+		return err
+	}
+
+	return s.appendLocked(&walEntry{Deleted: id})
+}
+
+func (s *FileStore) LoadSchedules() ([]*ScheduleRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	records := make([]*ScheduleRecord, 0, len(s.schedules))
+	for _, record := range s.schedules {
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (s *FileStore) SaveSchedule(record *ScheduleRecord) error {
+	return s.append(&walEntry{Schedule: record})
+}
+
+func (s *FileStore) DeleteSchedule(id string) error {
+	return s.append(&walEntry{DeletedSchedule: id})
+}
+
+func (s *FileStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.wal == nil {
+		return nil
+	}
+
+	err := s.wal.Close()
+	s.wal = nil
+	return err
+}
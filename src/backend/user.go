@@ -1,15 +1,118 @@
 package backend
 
 import (
+	"crypto/sha256"
 	"crypto/subtle"
+	"errors"
+	"log"
+	"sort"
 	"sync"
+	"time"
 )
 
+var ErrJobNotFound = errors.New("invalid job ID")
+
+// UnixCredential is the Unix account the jobs of a user run as
+type UnixCredential struct {
+	UID    uint32
+	GID    uint32
+	Groups []uint32 // supplementary groups
+}
+
+// UserOptions are the settings of a user chosen by the server's admin
+type UserOptions struct {
+	Credential  *UnixCredential // Unix account the user's jobs run as, nil to run with the server's credentials
+	MaxPriority int             // highest priority the user's jobs can have
+	Shares      int             // weight of the user for the fair share scheduling policy, 1 if 0
+	Admin       bool            // whether the user can access the admin endpoints
+	Quota       Quota           // limits on what the user's jobs can use, none by default
+}
+
 type User struct {
-	username string          // the username
-	token    string          // the API token given to the user to access the API, will be generated using a CSPRNG, stored in base64 format
-	jobsLock sync.RWMutex    // synchronizes access to the jobs map
-	jobs     map[string]*Job // Index. list of jobs that belong to the user. Index key is the job ID.
+	username      string               // the username
+	jobsLock      sync.RWMutex         // synchronizes access to the jobs map and 'reservedJobs'
+	jobs          map[string]*Job      // Index. list of jobs that belong to the user. Index key is the job ID.
+	reservedJobs  int                  // jobs being submitted, counted by the quota until they're added, see 'reserveQuota'
+	schedulesLock sync.RWMutex         // synchronizes access to the schedules map
+	schedules     map[string]*Schedule // Index. schedules that belong to the user. Index key is the schedule ID.
+	optionsLock   sync.RWMutex         // synchronizes access to 'tokenHash', 'options' and 'removed', which change when the users are reloaded
+	tokenHash     [sha256.Size]byte    // SHA-256 of the API token given to the user to access the API, which is generated using a CSPRNG
+	options       UserOptions          // settings chosen by the admin, 'Shares' is NOT ZERO
+	removed       bool                 // whether the user was removed from the users file, it can't access the API anymore
+	cpuLock       sync.Mutex           // synchronizes access to 'cpu'
+	cpu           dailyCPU             // CPU time used today by the jobs that ended, for the quota
+}
+
+func newUser(username string, tokenHash [sha256.Size]byte, options UserOptions) *User {
+	user := &User{
+		username:  username,
+		jobs:      map[string]*Job{},
+		schedules: map[string]*Schedule{},
+	}
+	user.setOptions(tokenHash, options)
+
+	return user
+}
+
+// replaces the token and the settings of the user, and adds it back if it was removed
+func (u *User) setOptions(tokenHash [sha256.Size]byte, options UserOptions) {
+	u.optionsLock.Lock()
+	defer u.optionsLock.Unlock()
+
+	if options.Shares == 0 {
+		options.Shares = 1
+	}
+
+	u.tokenHash, u.options, u.removed = tokenHash, options, false
+}
+
+func (u *User) markAsRemoved() {
+	u.optionsLock.Lock()
+	defer u.optionsLock.Unlock()
+
+	u.removed = true
+}
+
+func (u *User) IsRemoved() bool {
+	u.optionsLock.RLock()
+	defer u.optionsLock.RUnlock()
+
+	return u.removed
+}
+
+func (u *User) GetCredential() *UnixCredential {
+	u.optionsLock.RLock()
+	defer u.optionsLock.RUnlock()
+
+	return u.options.Credential
+}
+
+func (u *User) IsAdmin() bool {
+	u.optionsLock.RLock()
+	defer u.optionsLock.RUnlock()
+
+	return u.options.Admin
+}
+
+func (u *User) getShares() int {
+	u.optionsLock.RLock()
+	defer u.optionsLock.RUnlock()
+
+	return u.options.Shares
+}
+
+func (u *User) getMaxPriority() int {
+	u.optionsLock.RLock()
+	defer u.optionsLock.RUnlock()
+
+	return u.options.MaxPriority
+}
+
+func (u *User) getQuota() Quota {
+	u.optionsLock.RLock()
+	defer u.optionsLock.RUnlock()
+
+	return u.options.Quota
 }
 
 func (u *User) GetAllJobs() []*Job {
@@ -26,11 +129,12 @@ func (u *User) GetAllJobs() []*Job {
 }
 
 func (u *User) IsTokenMatching(token string) bool {
-	// not necessary to synchronize since 'Token' isn't supposed to be modified
-	// on the lifetime of the server
+	u.optionsLock.RLock()
+	defer u.optionsLock.RUnlock()
 
 	// constant time comparison to avoid oracle attacks
-	return subtle.ConstantTimeCompare([]byte(u.token), []byte(token)) == 1
+	hash := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(u.tokenHash[:], hash[:]) == 1
 }
 
 func (u *User) GetJob(jobID string) *Job {
@@ -40,9 +144,106 @@ func (u *User) GetJob(jobID string) *Job {
 	return u.jobs[jobID]
 }
 
+// RemoveJob deletes a job that ended, together with its output
+func (u *User) RemoveJob(jobID string) error {
+	u.jobsLock.Lock()
+	defer u.jobsLock.Unlock()
+
+	job, ok := u.jobs[jobID]
+	if !ok {
+		return ErrJobNotFound
+	}
+
+	if err := job.delete(); err != nil {
+		return err
+	}
+
+	delete(u.jobs, jobID)
+	return nil
+}
+
 func (u *User) AddJob(job *Job) {
 	u.jobsLock.Lock()
 	defer u.jobsLock.Unlock()
 
 	u.jobs[job.GetID()] = job
 }
+
+// removes the ended jobs that are older than 'maxAge' or aren't among the 'maxCount' that ended last, 0 disables each
+func (u *User) sweepJobs(maxAge time.Duration, maxCount int, now time.Time) {
+	type endedJob struct {
+		id      string
+		endedAt time.Time
+	}
+
+	ended := []endedJob{}
+	for _, job := range u.GetAllJobs() {
+		if endedAt, ok := job.getEndedAt(); ok {
+			ended = append(ended, endedJob{id: job.GetID(), endedAt: endedAt})
+		}
+	}
+
+	// the ones that ended last first
+	sort.Slice(ended, func(i, k int) bool { return ended[i].endedAt.After(ended[k].endedAt) })
+
+	for i, job := range ended {
+		if (maxCount == 0 || i < maxCount) && (maxAge == 0 || now.Sub(job.endedAt) <= maxAge) {
+			continue
+		}
+
+		if err := u.RemoveJob(job.id); err != nil {
+			log.Printf("Failed to remove job %s of user %s: %s", job.id, u.username, err)
+		}
+	}
+}
+
+func (u *User) GetAllSchedules() []*Schedule {
+	u.schedulesLock.RLock()
+	defer u.schedulesLock.RUnlock()
+
+	schedules := make([]*Schedule, 0, len(u.schedules))
+	for _, schedule := range u.schedules {
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules
+}
+
+func (u *User) GetSchedule(scheduleID string) *Schedule {
+	u.schedulesLock.RLock()
+	defer u.schedulesLock.RUnlock()
+
+	return u.schedules[scheduleID]
+}
+
+func (u *User) AddSchedule(schedule *Schedule) {
+	u.schedulesLock.Lock()
+	defer u.schedulesLock.Unlock()
+
+	u.schedules[schedule.GetID()] = schedule
+}
+
+// RemoveSchedule stops the schedule and deletes its record, the jobs it started are kept
+func (u *User) RemoveSchedule(store JobStore, scheduleID string) error {
+	u.schedulesLock.Lock()
+	defer u.schedulesLock.Unlock()
+
+	schedule, ok := u.schedules[scheduleID]
+	if !ok {
+		return ErrScheduleNotFound
+	}
+
+	schedule.stop()
+	if err := store.DeleteSchedule(scheduleID); err != nil {
+		return err
+	}
+
+	delete(u.schedules, scheduleID)
+	return nil
+}
+
+func (u *User) stopSchedules() {
+	for _, schedule := range u.GetAllSchedules() {
+		schedule.stop()
+	}
+}
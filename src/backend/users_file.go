@@ -0,0 +1,252 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+)
+
+// RemovedUserPolicy is what happens to the jobs of the users removed from the users file when it's reloaded
+type RemovedUserPolicy string
+
+const (
+	RemovedUserKeepJobs RemovedUserPolicy = "keep" // the jobs run to completion, the queued and scheduled ones still start
+	RemovedUserStopJobs RemovedUserPolicy = "stop" // the jobs that haven't ended are stopped
+)
+
+var ErrNoUsersFile = errors.New("the server has no users file")
+
+// UserConfig is a user of the users file
+type UserConfig struct {
+	Username  string
+	TokenHash [sha256.Size]byte // SHA-256 of the user's API token
+	Options   UserOptions
+}
+
+// format of the users file, JSON
+type usersFile struct {
+	Users []usersFileUser `json:"users"`
+}
+
+type usersFileUser struct {
+	Username    string         `json:"username"`
+	TokenSHA256 string         `json:"token_sha256"`           // hex encoded SHA-256 of the API token
+	UnixUser    string         `json:"unix_user,omitempty"`    // Unix account the jobs run as, in the format uid:gid[:group,group...]
+	MaxPriority int            `json:"max_priority,omitempty"` // highest priority the jobs can have
+	Shares      int            `json:"shares,omitempty"`       // weight for the fair share, 1 if 0
+	Admin       bool           `json:"admin,omitempty"`        // whether the user can access the admin endpoints
+	Quota       usersFileQuota `json:"quota,omitempty"`        // each limit is disabled if 0
+}
+
+type usersFileQuota struct {
+	RunningJobs      int   `json:"running_jobs,omitempty"`
+	Jobs             int   `json:"jobs,omitempty"`
+	OutputBytes      int64 `json:"output_bytes,omitempty"`
+	CPUSecondsPerDay int64 `json:"cpu_seconds_per_day,omitempty"`
+}
+
+// ParseUsersFile reads the users of a users file, it fails if any of them is invalid
+func ParseUsersFile(path string) ([]UserConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := usersFile{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid users file %s: %w", path, err)
+	}
+
+	users := make([]UserConfig, 0, len(file.Users))
+	usernames := map[string]bool{}
+	for i := range file.Users {
+		user, err := file.Users[i].config()
+		if err != nil {
+			return nil, fmt.Errorf("invalid user %d of the users file %s: %w", i+1, path, err)
+		}
+
+		if usernames[user.Username] {
+			return nil, fmt.Errorf("user %s is repeated in the users file %s", user.Username, path)
+		}
+		usernames[user.Username] = true
+
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+func (u *usersFileUser) config() (UserConfig, error) {
+	if u.Username == "" {
+		return UserConfig{}, errors.New("missing username")
+	}
+
+	config := UserConfig{Username: u.Username}
+	hash, err := hex.DecodeString(u.TokenSHA256)
+	if err != nil || len(hash) != sha256.Size {
+		return UserConfig{}, errors.New("token_sha256 must be the hex encoded SHA-256 of the token")
+	}
+	copy(config.TokenHash[:], hash)
+
+	if u.MaxPriority < 0 || u.Shares < 0 {
+		return UserConfig{}, errors.New("max_priority and shares can't be negative")
+	}
+
+	quota := u.Quota
+	if quota.RunningJobs < 0 || quota.Jobs < 0 || quota.OutputBytes < 0 || quota.CPUSecondsPerDay < 0 {
+		return UserConfig{}, errors.New("the quota can't be negative")
+	}
+
+	config.Options = UserOptions{
+		MaxPriority: u.MaxPriority,
+		Shares:      u.Shares,
+		Admin:       u.Admin,
+		Quota: Quota{
+			MaxRunningJobs: quota.RunningJobs,
+			MaxJobs:        quota.Jobs,
+			MaxOutputBytes: quota.OutputBytes,
+			MaxCPUPerDay:   time.Duration(quota.CPUSecondsPerDay) * time.Second,
+		},
+	}
+
+	if u.UnixUser != "" {
+		if config.Options.Credential, err = parseUnixCredential(u.UnixUser); err != nil {
+			return UserConfig{}, err
+		}
+	}
+
+	return config, nil
+}
+
+func parseID(value string) (uint32, error) {
+	id, err := strconv.ParseUint(value, 10, 32)
+	return uint32(id), err
+}
+
+// parses a Unix account in the format uid:gid[:group,group...]
+func parseUnixCredential(value string) (*UnixCredential, error) {
+	ids := strings.Split(value, ":")
+	if len(ids) < 2 || len(ids) > 3 {
+		return nil, errors.New("unix_user must be in the format uid:gid[:group,group...]")
+	}
+
+	credential := &UnixCredential{}
+	var err error
+	if credential.UID, err = parseID(ids[0]); err != nil {
+		return nil, err
+	}
+
+	if credential.GID, err = parseID(ids[1]); err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 3 {
+		for _, group := range strings.Split(ids[2], ",") {
+			gid, err := parseID(group)
+			if err != nil {
+				return nil, err
+			}
+
+			credential.Groups = append(credential.Groups, gid)
+		}
+	}
+
+	return credential, nil
+}
+
+// LoadUsersFile replaces the users with the ones of the server's users file, the users are kept if it's invalid
+func (s *State) LoadUsersFile() (view.UsersReloadView, error) {
+	if s.config.UsersFile == "" {
+		return view.UsersReloadView{}, ErrNoUsersFile
+	}
+
+	users, err := ParseUsersFile(s.config.UsersFile)
+	if err != nil {
+		return view.UsersReloadView{}, err
+	}
+
+	return s.ReloadUsers(users), nil
+}
+
+// ReloadUsers replaces the users at once: the new ones are added, the token and settings of the others are updated
+// and the missing ones are removed. Removed users can't access the API anymore and their schedules are paused, what
+// happens to their jobs follows the server's RemovedUserJobs policy. The records of a removed user are kept, so if
+// it's added back it gets them back, the paused schedules included.
+func (s *State) ReloadUsers(users []UserConfig) view.UsersReloadView {
+	reload := view.UsersReloadView{Added: []string{}, Updated: []string{}, Removed: []string{}}
+	removed := []*User{}
+
+	s.usersIndexLock.Lock()
+
+	configured := map[string]bool{}
+	for _, config := range users {
+		configured[config.Username] = true
+
+		user, ok := s.usersIndex[config.Username]
+		switch {
+		case !ok:
+			s.usersIndex[config.Username] = newUser(config.Username, config.TokenHash, config.Options)
+			reload.Added = append(reload.Added, config.Username)
+		case user.IsRemoved():
+			user.setOptions(config.TokenHash, config.Options)
+			reload.Added = append(reload.Added, config.Username)
+		default:
+			user.setOptions(config.TokenHash, config.Options)
+			reload.Updated = append(reload.Updated, config.Username)
+		}
+	}
+
+	for username, user := range s.usersIndex {
+		if !configured[username] && !user.IsRemoved() {
+			user.markAsRemoved()
+			removed = append(removed, user)
+			reload.Removed = append(reload.Removed, username)
+		}
+	}
+
+	s.usersIndexLock.Unlock()
+
+	// stopping the jobs doesn't need to hold back the requests of the other users
+	for _, user := range removed {
+		s.disableUser(user)
+	}
+
+	sort.Strings(reload.Added)
+	sort.Strings(reload.Updated)
+	sort.Strings(reload.Removed)
+	return reload
+}
+
+// pauses the schedules of a removed user, and stops its jobs if the policy says so
+func (s *State) disableUser(user *User) {
+	for _, schedule := range user.GetAllSchedules() {
+		schedule.Pause()
+	}
+
+	if s.config.RemovedUserJobs != RemovedUserStopJobs {
+		return
+	}
+
+	for _, job := range user.GetAllJobs() {
+		if _, ended := job.getEndedAt(); ended {
+			continue
+		}
+
+		if err := s.StopJob(job, false); err != nil {
+			log.Printf("Failed to stop job %s of removed user %s: %s", job.GetID(), user.username, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	wheelTick  = 100 * time.Millisecond // precision of the start times
+	wheelSlots = 600                    // one revolution of the wheel is a minute
+)
+
+// a job waiting in the wheel for its start time
+type wheelEntry struct {
+	user   *User
+	job    *Job
+	rounds int // revolutions of the wheel left before it's due once its slot is reached
+}
+
+// timerWheel promotes scheduled jobs to the scheduler's queue once their start time is reached. It's a hashed timing
+// wheel: a job is placed in the slot its start time falls in, and each tick the entries of the next slot are due unless
+// they still have revolutions left. Adding and removing a job is constant time, regardless of how many are waiting.
+// The wheel only ticks while it has jobs.
+type timerWheel struct {
+	lock    sync.Mutex
+	slots   [wheelSlots]map[*Job]*wheelEntry
+	slotOf  map[*Job]int  // slot of each job in the wheel
+	current int           // slot of the last tick
+	stop    chan struct{} // closed to stop the ticking goroutine, nil if it isn't running
+	promote func(user *User, job *Job)
+}
+
+func newTimerWheel(promote func(user *User, job *Job)) *timerWheel {
+	wheel := &timerWheel{slotOf: map[*Job]int{}, promote: promote}
+	for i := range wheel.slots {
+		wheel.slots[i] = map[*Job]*wheelEntry{}
+	}
+
+	return wheel
+}
+
+// add places the job in the wheel, to be promoted at 'startAt' or on the next tick if it's already past
+func (w *timerWheel) add(user *User, job *Job, startAt time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	ticks := int((time.Until(startAt) + wheelTick - 1) / wheelTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	// the entry is due on the tick that reaches its slot for the 'rounds'+1-th time
+	slot := (w.current + ticks) % wheelSlots
+	w.slots[slot][job] = &wheelEntry{user: user, job: job, rounds: (ticks - 1) / wheelSlots}
+	w.slotOf[job] = slot
+
+	if w.stop == nil {
+		w.stop = make(chan struct{})
+		go w.run(w.stop)
+	}
+}
+
+// remove takes the job out of the wheel, like when it's cancelled
+func (w *timerWheel) remove(job *Job) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if slot, ok := w.slotOf[job]; ok {
+		delete(w.slots[slot], job)
+		delete(w.slotOf, job)
+	}
+}
+
+func (w *timerWheel) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(wheelTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, entry := range w.tick() {
+				w.promote(entry.user, entry.job)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// advances the wheel by a slot and returns the entries that are due, stops ticking once the wheel is empty
+func (w *timerWheel) tick() []*wheelEntry {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.current = (w.current + 1) % wheelSlots
+	due := []*wheelEntry{}
+	for job, entry := range w.slots[w.current] {
+		if entry.rounds > 0 {
+			entry.rounds--
+			continue
+		}
+
+		due = append(due, entry)
+		delete(w.slots[w.current], job)
+		delete(w.slotOf, job)
+	}
+
+	if len(w.slotOf) == 0 {
+		w.closeLocked()
+	}
+
+	return due
+}
+
+func (w *timerWheel) closeLocked() {
+	if w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+	}
+}
+
+// close stops the wheel from ticking, the jobs in it aren't promoted
+func (w *timerWheel) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.closeLocked()
+}
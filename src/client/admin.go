@@ -0,0 +1,66 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+func adminSchedulerTask(out io.Writer, api *APIClient, commandRest []string) error {
+	if len(commandRest) != 0 {
+		return errors.New("too many args")
+	}
+
+	scheduler, err := api.GetScheduler()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, scheduler)
+
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "USER\tSHARES\tSHARE\tRUNNING\tQUEUED\tCPU_SECONDS\tLOAD\t")
+	for _, user := range scheduler.Users {
+		username := user.Username
+		if user.Removed {
+			username += " (removed)"
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%.1f%%\t%d\t%d\t%.1f\t%.3f\n",
+			username, user.Shares, user.Share*100, user.Running, user.Queued, user.CPUSeconds, user.Load)
+	}
+	w.Flush()
+
+	return nil
+}
+
+func adminReloadUsersTask(out io.Writer, api *APIClient, commandRest []string) error {
+	if len(commandRest) != 0 {
+		return errors.New("too many args")
+	}
+
+	reload, err := api.ReloadUsers()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, reload)
+	return nil
+}
+
+func adminTask(out io.Writer, api *APIClient, commandRest []string) error {
+	if len(commandRest) < 1 {
+		return errors.New("must specify admin command")
+	}
+
+	argsRest := commandRest[1:]
+	switch task := commandRest[0]; task {
+	case "scheduler":
+		return adminSchedulerTask(out, api, argsRest)
+	case "reload-users":
+		return adminReloadUsersTask(out, api, argsRest)
+	default:
+		return errors.New("unknown admin command " + task)
+	}
+}
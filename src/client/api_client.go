@@ -1,18 +1,29 @@
 package client
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	"github.com/Ross65536/job-scheduler/src/core/view"
+	"github.com/gorilla/websocket"
 )
 
 type APIClient struct {
 	HTTPClient *HTTPClient
 }
 
+// ErrStdinUnavailable is returned when attaching to write the stdin of a job whose stdin is closed or already being
+// written by another session
+var ErrStdinUnavailable = errors.New("the job's stdin can't be written")
+
 type ErrorType struct {
 	Status  int
 	Message string
@@ -62,8 +73,7 @@ func (api *APIClient) ShowJob(id string) (*view.JobViewFull, error) {
 	return &job, err
 }
 
-func (api *APIClient) StartJob(command []string) (*view.JobViewPartial, error) {
-	job := view.JobViewCommand{Command: command}
+func (api *APIClient) StartJob(job *view.JobViewCommand) (*view.JobViewPartial, error) {
 	requestJson, err := json.Marshal(job)
 	if err != nil {
 		return nil, err
@@ -74,16 +84,155 @@ func (api *APIClient) StartJob(command []string) (*view.JobViewPartial, error) {
 		return nil, err
 	}
 
+	return parseStartedJob(status, resp)
+}
+
+// StartJobWithStdin starts a job which is given 'stdin' as its input, sent as a separate multipart part
+func (api *APIClient) StartJobWithStdin(job *view.JobViewCommand, stdin []byte) (*view.JobViewPartial, error) {
+	requestJson, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	body := bytes.Buffer{}
+	writer := multipart.NewWriter(&body)
+	if err := writer.WriteField("job", string(requestJson)); err != nil {
+		return nil, err
+	}
+
+	part, err := writer.CreateFormFile("stdin", "stdin")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := part.Write(stdin); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	status, resp, err := api.HTTPClient.PostMultipart(body.Bytes(), writer.FormDataContentType(), "api", "jobs")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseStartedJob(status, resp)
+}
+
+func parseStartedJob(status int, resp []byte) (*view.JobViewPartial, error) {
 	if http.StatusCreated != status {
 		return nil, buildResponseError(status, resp)
 	}
 
 	respJob := view.JobViewPartial{}
-	err = json.Unmarshal(resp, &respJob)
+	err := json.Unmarshal(resp, &respJob)
 
 	return &respJob, err
 }
 
+// StreamLogs returns a reader for the output of the job, which must be closed by the caller.
+// 'stream' is one of stdout, stderr or both. When following, the reader ends when the job ends.
+// A non-zero 'attempt' reads the output of that previous attempt of a retried job instead, which can't be followed.
+func (api *APIClient) StreamLogs(id, stream string, offset int, follow bool, attempt int) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("stream", stream)
+	query.Set("offset", strconv.Itoa(offset))
+	query.Set("follow", strconv.FormatBool(follow))
+	if attempt != 0 {
+		query.Set("attempt", strconv.Itoa(attempt))
+	}
+
+	resp, err := api.HTTPClient.GetStream(query, "api", "jobs", url.PathEscape(id), "logs")
+	if err != nil {
+		return nil, err
+	}
+
+	if http.StatusOK != resp.StatusCode {
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, buildResponseError(resp.StatusCode, body)
+	}
+
+	return resp.Body, nil
+}
+
+// AttachJob opens an attach session to the job, see 'view.AttachStdin' for the frame format.
+// With 'writeStdin' the session can write the job's stdin.
+func (api *APIClient) AttachJob(id string, writeStdin bool) (*websocket.Conn, error) {
+	query := url.Values{}
+	query.Set("stdin", strconv.FormatBool(writeStdin))
+
+	conn, status, resp, err := api.HTTPClient.DialWebSocket(query, "api", "jobs", url.PathEscape(id), "attach")
+	if err != nil {
+		return nil, err
+	}
+
+	if conn == nil && writeStdin && status == http.StatusConflict {
+		return nil, fmt.Errorf("%w, %s", ErrStdinUnavailable, buildResponseError(status, resp))
+	}
+
+	if conn == nil {
+		return nil, buildResponseError(status, resp)
+	}
+
+	return conn, nil
+}
+
+func (api *APIClient) ResizeJob(id string, rows, cols uint16) error {
+	requestJson, err := json.Marshal(view.JobViewTerminalSize{Rows: rows, Cols: cols})
+	if err != nil {
+		return err
+	}
+
+	status, resp, err := api.HTTPClient.Post(requestJson, "api", "jobs", url.PathEscape(id), "resize")
+	if err != nil {
+		return err
+	}
+
+	if http.StatusNoContent != status {
+		return buildResponseError(status, resp)
+	}
+
+	return nil
+}
+
+// GetJobGraph returns the jobs connected to the job through their dependencies
+func (api *APIClient) GetJobGraph(id string) (*view.JobViewGraph, error) {
+	status, resp, err := api.HTTPClient.Get("api", "jobs", url.PathEscape(id), "dag")
+	if err != nil {
+		return nil, err
+	}
+
+	if http.StatusOK != status {
+		return nil, buildResponseError(status, resp)
+	}
+
+	graph := view.JobViewGraph{}
+	err = json.Unmarshal(resp, &graph)
+
+	return &graph, err
+}
+
+// PurgeJob removes a job that ended together with its output
+func (api *APIClient) PurgeJob(id string) error {
+	status, resp, err := api.HTTPClient.Post(nil, "api", "jobs", url.PathEscape(id), "purge")
+	if err != nil {
+		return err
+	}
+
+	if http.StatusNoContent != status {
+		return buildResponseError(status, resp)
+	}
+
+	return nil
+}
+
 func (api *APIClient) StopJob(id string) error {
 	status, resp, err := api.HTTPClient.Delete("api", "jobs", url.PathEscape(id))
 	if err != nil {
@@ -96,3 +245,188 @@ func (api *APIClient) StopJob(id string) error {
 
 	return nil
 }
+
+func (api *APIClient) ListJobArrays() ([]*view.JobArrayViewPartial, error) {
+	status, resp, err := api.HTTPClient.Get("api", "arrays")
+	if err != nil {
+		return nil, err
+	}
+
+	if http.StatusOK != status {
+		return nil, buildResponseError(status, resp)
+	}
+
+	arrays := []*view.JobArrayViewPartial{}
+	err = json.Unmarshal(resp, &arrays)
+
+	return arrays, err
+}
+
+func (api *APIClient) ShowJobArray(id string) (*view.JobArrayViewFull, error) {
+	status, resp, err := api.HTTPClient.Get("api", "arrays", url.PathEscape(id))
+	if err != nil {
+		return nil, err
+	}
+
+	if http.StatusOK != status {
+		return nil, buildResponseError(status, resp)
+	}
+
+	array := view.JobArrayViewFull{}
+	err = json.Unmarshal(resp, &array)
+
+	return &array, err
+}
+
+// StopJobArray stops every job of the array
+func (api *APIClient) StopJobArray(id string) error {
+	status, resp, err := api.HTTPClient.Delete("api", "arrays", url.PathEscape(id))
+	if err != nil {
+		return err
+	}
+
+	if http.StatusNoContent != status {
+		return buildResponseError(status, resp)
+	}
+
+	return nil
+}
+
+// GetQuota returns what the user's jobs are using of each limit of the user's quota
+func (api *APIClient) GetQuota() (*view.QuotaView, error) {
+	status, resp, err := api.HTTPClient.Get("api", "quota")
+	if err != nil {
+		return nil, err
+	}
+
+	if http.StatusOK != status {
+		return nil, buildResponseError(status, resp)
+	}
+
+	quota := view.QuotaView{}
+	err = json.Unmarshal(resp, &quota)
+
+	return &quota, err
+}
+
+// GetScheduler returns the share, usage and queue depth of each user, only for admins
+func (api *APIClient) GetScheduler() (*view.SchedulerView, error) {
+	status, resp, err := api.HTTPClient.Get("api", "admin", "scheduler")
+	if err != nil {
+		return nil, err
+	}
+
+	if http.StatusOK != status {
+		return nil, buildResponseError(status, resp)
+	}
+
+	scheduler := view.SchedulerView{}
+	err = json.Unmarshal(resp, &scheduler)
+
+	return &scheduler, err
+}
+
+// ReloadUsers makes the server reload its users file, only for admins
+func (api *APIClient) ReloadUsers() (*view.UsersReloadView, error) {
+	status, resp, err := api.HTTPClient.Post(nil, "api", "admin", "users", "reload")
+	if err != nil {
+		return nil, err
+	}
+
+	if http.StatusOK != status {
+		return nil, buildResponseError(status, resp)
+	}
+
+	reload := view.UsersReloadView{}
+	err = json.Unmarshal(resp, &reload)
+
+	return &reload, err
+}
+
+func (api *APIClient) ListSchedules() ([]*view.ScheduleViewPartial, error) {
+	status, resp, err := api.HTTPClient.Get("api", "schedules")
+	if err != nil {
+		return nil, err
+	}
+
+	if http.StatusOK != status {
+		return nil, buildResponseError(status, resp)
+	}
+
+	schedules := []*view.ScheduleViewPartial{}
+	err = json.Unmarshal(resp, &schedules)
+
+	return schedules, err
+}
+
+func (api *APIClient) ShowSchedule(id string) (*view.ScheduleViewFull, error) {
+	status, resp, err := api.HTTPClient.Get("api", "schedules", url.PathEscape(id))
+	if err != nil {
+		return nil, err
+	}
+
+	if http.StatusOK != status {
+		return nil, buildResponseError(status, resp)
+	}
+
+	schedule := view.ScheduleViewFull{}
+	err = json.Unmarshal(resp, &schedule)
+
+	return &schedule, err
+}
+
+func (api *APIClient) CreateSchedule(schedule *view.ScheduleViewCommand) (*view.ScheduleViewPartial, error) {
+	requestJson, err := json.Marshal(schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	status, resp, err := api.HTTPClient.Post(requestJson, "api", "schedules")
+	if err != nil {
+		return nil, err
+	}
+
+	if http.StatusCreated != status {
+		return nil, buildResponseError(status, resp)
+	}
+
+	respSchedule := view.ScheduleViewPartial{}
+	err = json.Unmarshal(resp, &respSchedule)
+
+	return &respSchedule, err
+}
+
+// DeleteSchedule stops the schedule from firing and removes it, the jobs it started are kept
+func (api *APIClient) DeleteSchedule(id string) error {
+	status, resp, err := api.HTTPClient.Delete("api", "schedules", url.PathEscape(id))
+	if err != nil {
+		return err
+	}
+
+	if http.StatusNoContent != status {
+		return buildResponseError(status, resp)
+	}
+
+	return nil
+}
+
+func (api *APIClient) PauseSchedule(id string) error {
+	return api.postScheduleAction(id, "pause")
+}
+
+func (api *APIClient) ResumeSchedule(id string) error {
+	return api.postScheduleAction(id, "resume")
+}
+
+func (api *APIClient) postScheduleAction(id, action string) error {
+	status, resp, err := api.HTTPClient.Post(nil, "api", "schedules", url.PathEscape(id), action)
+	if err != nil {
+		return err
+	}
+
+	if http.StatusNoContent != status {
+		return buildResponseError(status, resp)
+	}
+
+	return nil
+}
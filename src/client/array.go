@@ -0,0 +1,128 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+)
+
+// parses the -array flag, in the format START-END[:STEP]
+func parseArrayRange(value string) (*view.JobViewRange, error) {
+	invalid := errors.New("-array must be in the format START-END[:STEP], e.g. 0-15:4")
+
+	bounds, step, hasStep := strings.Cut(value, ":")
+	startValue, endValue, ok := strings.Cut(bounds, "-")
+	if !ok {
+		return nil, invalid
+	}
+
+	arrayRange := &view.JobViewRange{}
+	var err error
+	if arrayRange.Start, err = strconv.Atoi(startValue); err != nil {
+		return nil, invalid
+	}
+	if arrayRange.End, err = strconv.Atoi(endValue); err != nil {
+		return nil, invalid
+	}
+	if hasStep {
+		if arrayRange.Step, err = strconv.Atoi(step); err != nil {
+			return nil, invalid
+		}
+	}
+
+	return arrayRange, nil
+}
+
+// reads the -array-args file, each non-empty line is a set of arguments separated by whitespace
+func readArrayArgs(path string) ([][]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	args := [][]string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if fields := strings.Fields(line); len(fields) != 0 {
+			args = append(args, fields)
+		}
+	}
+
+	return args, nil
+}
+
+func arrayListTask(out io.Writer, api *APIClient, commandRest []string) error {
+	if len(commandRest) != 0 {
+		return errors.New("too many args")
+	}
+
+	arrays, err := api.ListJobArrays()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(arrays, func(i, j int) bool {
+		return arrays[i].CreatedAt.Before(arrays[j].CreatedAt)
+	})
+
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tJOBS\tCOUNTS\tCREATED_AT\t")
+	for _, array := range arrays {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", array.ID, array.Status, array.Size, array.CountsString(), array.CreatedAt)
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "--- %d arrays --- \n", len(arrays))
+	return nil
+}
+
+func arrayShowTask(out io.Writer, api *APIClient, commandRest []string) error {
+	if len(commandRest) != 1 {
+		return errors.New("must specify ID")
+	}
+
+	array, err := api.ShowJobArray(commandRest[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, array)
+	return nil
+}
+
+func arrayStopTask(out io.Writer, api *APIClient, commandRest []string) error {
+	if len(commandRest) != 1 {
+		return errors.New("must specify ID")
+	}
+
+	if err := api.StopJobArray(commandRest[0]); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "OK")
+	return nil
+}
+
+func arrayTask(out io.Writer, api *APIClient, commandRest []string) error {
+	if len(commandRest) < 1 {
+		return errors.New("must specify array command")
+	}
+
+	argsRest := commandRest[1:]
+	switch task := commandRest[0]; task {
+	case "list":
+		return arrayListTask(out, api, argsRest)
+	case "show":
+		return arrayShowTask(out, api, argsRest)
+	case "stop":
+		return arrayStopTask(out, api, argsRest)
+	default:
+		return errors.New("unknown array command " + task)
+	}
+}
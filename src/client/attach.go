@@ -0,0 +1,148 @@
+package client
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+	"github.com/gorilla/websocket"
+	"golang.org/x/term"
+)
+
+// sends 'in' as stdin frames, an empty frame is sent on EOF to close the job's stdin
+func sendStdin(conn *websocket.Conn, in io.Reader) {
+	buffer := make([]byte, 4096)
+
+	for {
+		n, err := in.Read(buffer)
+		if n != 0 {
+			frame := append([]byte{view.AttachStdin}, buffer[:n]...)
+			if conn.WriteMessage(websocket.BinaryMessage, frame) != nil {
+				return
+			}
+		}
+
+		if err != nil {
+			conn.WriteMessage(websocket.BinaryMessage, []byte{view.AttachStdin})
+			return
+		}
+	}
+}
+
+// writes the output frames until the session is closed, returns the status of the job if it ended
+func receiveOutput(conn *websocket.Conn, out, errOut io.Writer) (string, error) {
+	for {
+		messageType, frame, err := conn.ReadMessage()
+		if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code == websocket.CloseNormalClosure {
+			return closeErr.Text, nil
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		if messageType != websocket.BinaryMessage || len(frame) == 0 {
+			continue
+		}
+
+		switch frame[0] {
+		case view.AttachStdout:
+			out.Write(frame[1:])
+		case view.AttachStderr:
+			errOut.Write(frame[1:])
+		}
+	}
+}
+
+// when attaching a TTY job from a terminal, the local terminal is put in raw mode so that the keys are sent as is,
+// and its window size is kept in sync with the job's. Returns a function to restore the terminal.
+func connectTerminal(in io.Reader, api *APIClient, id string) (func(), error) {
+	file, ok := in.(*os.File)
+	if !ok || !term.IsTerminal(int(file.Fd())) {
+		return func() {}, nil
+	}
+
+	job, err := api.ShowJob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !job.TTY {
+		return func() {}, nil
+	}
+
+	fd := int(file.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	resized <- syscall.SIGWINCH // sends the initial size
+
+	go func() {
+		for range resized {
+			if cols, rows, err := term.GetSize(fd); err == nil {
+				api.ResizeJob(id, uint16(rows), uint16(cols))
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(resized)
+		close(resized)
+		term.Restore(fd, state)
+	}, nil
+}
+
+func attachTask(in io.Reader, out, errOut io.Writer, api *APIClient, commandRest []string) error {
+	flags := flag.NewFlagSet("attach", flag.ContinueOnError)
+	flags.SetOutput(out)
+	readOnly := flags.Bool("readonly", false, "only watch the output, without writing the job's stdin, the default when its stdin can't be written")
+
+	if err := flags.Parse(commandRest); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("must specify ID")
+	}
+
+	id := flags.Arg(0)
+	conn, err := api.AttachJob(id, !*readOnly)
+	if errors.Is(err, ErrStdinUnavailable) {
+		// jobs that aren't interactive or that ended can still be watched
+		fmt.Fprintf(errOut, "%s, attaching read-only\n", err)
+		*readOnly = true
+		conn, err = api.AttachJob(id, false)
+	}
+
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if !*readOnly {
+		restore, err := connectTerminal(in, api, id)
+		if err != nil {
+			return err
+		}
+		defer restore()
+
+		go sendStdin(conn, in)
+	}
+
+	status, err := receiveOutput(conn, out, errOut)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(errOut, "Job ended: %s\n", status)
+	return nil
+}
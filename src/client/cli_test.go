@@ -14,6 +14,7 @@ import (
 	"github.com/Ross65536/job-scheduler/src/client"
 	"github.com/Ross65536/job-scheduler/src/core/testutil"
 	"github.com/Ross65536/job-scheduler/src/core/view"
+	"github.com/gorilla/websocket"
 )
 
 const (
@@ -82,7 +83,7 @@ func TestCanShowJob(t *testing.T) {
 	defer server.Close()
 
 	buf := bytes.Buffer{}
-	err := client.Start(&buf, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "show", id})
+	err := client.Start(nil, &buf, &buf, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "show", id})
 	testutil.AssertNotError(t, err)
 
 	output := buf.String()
@@ -99,6 +100,31 @@ STDERR456
 	testutil.AssertEquals(t, string(output), expected)
 }
 
+func TestShowTruncatedOutput(t *testing.T) {
+	id := "123XYZ902"
+	job := view.JobViewFull{
+		JobViewPartial: view.JobViewPartial{
+			JobViewCommand: view.JobViewCommand{
+				Command: []string{"yes"},
+			},
+			ID:        id,
+			Status:    "RUNNING",
+			CreatedAt: time.Date(2020, time.March, 2, 4, 4, 4, 0, time.UTC),
+		},
+		Stdout:     "y\ny\n",
+		StdoutSize: view.JobViewOutputSize{Total: 10, Dropped: 6, Truncated: true},
+	}
+
+	server, uri := setupTestServer(t, 200, encodeModel(t, job), "GET", "/api/jobs/"+id, "user", "pass")
+	defer server.Close()
+
+	buf := bytes.Buffer{}
+	err := client.Start(nil, &buf, &buf, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "show", id})
+	testutil.AssertNotError(t, err)
+
+	testutil.AssertContains(t, buf.String(), "STDOUT (truncated, 6 of 10 bytes dropped):\ny\ny\n\n\nSTDERR:\n")
+}
+
 func TestServerError(t *testing.T) {
 	returnError := client.ErrorType{
 		Status:  401,
@@ -108,8 +134,305 @@ func TestServerError(t *testing.T) {
 	server, uri := setupTestServer(t, 401, encodeModel(t, returnError), "GET", "/api/jobs", "user", "pass")
 	defer server.Close()
 
-	err := client.Start(os.Stdout, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "list"})
+	err := client.Start(nil, os.Stdout, os.Stderr, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "list"})
 	testutil.AssertNotEquals(t, err, nil)
 
 	testutil.AssertEquals(t, err.Error(), "an error occurred (HTTP 401): "+returnError.Message)
 }
+
+func TestCanStreamLogs(t *testing.T) {
+	id := "123XYZ902"
+	logs := "line 1\nline 2\n"
+
+	server, uri := setupTestServer(t, 200, []byte(logs), "GET", "/api/jobs/"+id+"/logs", "user", "pass")
+	defer server.Close()
+
+	buf := bytes.Buffer{}
+	err := client.Start(nil, &buf, &buf, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "logs", "-f", id})
+	testutil.AssertNotError(t, err)
+
+	testutil.AssertEquals(t, buf.String(), logs)
+}
+
+func TestAttachFallsBackToReadOnly(t *testing.T) {
+	id := "123XYZ902"
+	stdinRequests := []string{}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.AssertEquals(t, "/api/jobs/"+id+"/attach", r.URL.Path)
+		stdinRequests = append(stdinRequests, r.URL.Query().Get("stdin"))
+
+		// the job isn't interactive
+		if r.URL.Query().Get("stdin") == "true" {
+			w.Header().Set("Content-Type", jsonMime)
+			w.WriteHeader(http.StatusConflict)
+			w.Write(encodeModel(t, client.ErrorType{Status: 409, Message: "job doesn't have an open stdin"}))
+			return
+		}
+
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		testutil.AssertNotError(t, err)
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.BinaryMessage, append([]byte{view.AttachStdout}, "line 1\n"...))
+		conn.WriteMessage(websocket.BinaryMessage, append([]byte{view.AttachStderr}, "error 1\n"...))
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "FINISHED"), time.Now().Add(time.Second))
+	})
+
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	uri, err := url.ParseRequestURI(server.URL)
+	testutil.AssertNotError(t, err)
+
+	out, errOut := bytes.Buffer{}, bytes.Buffer{}
+	err = client.Start(nil, &out, &errOut, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "attach", id})
+	testutil.AssertNotError(t, err)
+
+	testutil.AssertEquals(t, len(stdinRequests), 2)
+	testutil.AssertEquals(t, stdinRequests[0], "true")
+	testutil.AssertEquals(t, stdinRequests[1], "false")
+	testutil.AssertEquals(t, out.String(), "line 1\n")
+	testutil.AssertContains(t, errOut.String(), "job doesn't have an open stdin, attaching read-only")
+	testutil.AssertContains(t, errOut.String(), "error 1\nJob ended: FINISHED\n")
+}
+
+func TestOnlyUsesRedirectedFileAsStdinWhenAsked(t *testing.T) {
+	contentTypes := []string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentTypes = append(contentTypes, r.Header.Get("Content-Type"))
+
+		w.Header().Set("Content-Type", jsonMime)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(encodeModel(t, view.JobViewPartial{ID: "123XYZ902"}))
+	})
+
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	uri, err := url.ParseRequestURI(server.URL)
+	testutil.AssertNotError(t, err)
+
+	// like a client run inside a loop reading the file
+	in, err := os.CreateTemp(t.TempDir(), "input")
+	testutil.AssertNotError(t, err)
+	defer in.Close()
+	in.WriteString("line 1\n")
+	in.Seek(0, 0)
+
+	buf := bytes.Buffer{}
+	err = client.Start(in, &buf, &buf, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "start", "cat"})
+	testutil.AssertNotError(t, err)
+
+	err = client.Start(in, &buf, &buf, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "start", "-stdin-file=-", "cat"})
+	testutil.AssertNotError(t, err)
+
+	testutil.AssertEquals(t, len(contentTypes), 2)
+	testutil.AssertContains(t, contentTypes[0], jsonMime)
+	testutil.AssertContains(t, contentTypes[1], "multipart/form-data")
+}
+
+func TestCanShowSchedule(t *testing.T) {
+	id := "456ABC123"
+	nextRunAt := time.Date(2020, time.March, 2, 5, 0, 0, 0, time.UTC)
+	schedule := view.ScheduleViewFull{
+		ScheduleViewPartial: view.ScheduleViewPartial{
+			ScheduleViewCommand: view.ScheduleViewCommand{
+				Cron:    "0 * * * *",
+				Overlap: "skip",
+				Job:     view.JobViewCommand{Command: []string{"backup.sh"}},
+			},
+			ID:        id,
+			CreatedAt: time.Date(2020, time.March, 2, 4, 4, 4, 0, time.UTC),
+			NextRunAt: &nextRunAt,
+		},
+		Runs:    []string{"123XYZ902"},
+		Skipped: 2,
+	}
+
+	server, uri := setupTestServer(t, 200, encodeModel(t, schedule), "GET", "/api/schedules/"+id, "user", "pass")
+	defer server.Close()
+
+	buf := bytes.Buffer{}
+	err := client.Start(nil, &buf, &buf, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "schedule", "show", id})
+	testutil.AssertNotError(t, err)
+
+	expected := `'0 * * * *' backup.sh, active, overlap: skip, created_at: 2020-03-02 04:04:04 +0000 UTC
+next_run_at: 2020-03-02 05:00:00 +0000 UTC, last_run_at: -, skipped: 2
+runs:
+  123XYZ902
+`
+
+	testutil.AssertEquals(t, buf.String(), expected)
+}
+
+func TestCanShowJobGraph(t *testing.T) {
+	graph := view.JobViewGraph{
+		Nodes: []view.JobViewGraphNode{
+			{ID: "A1", Status: "FINISHED", Command: []string{"build.sh"}},
+			{ID: "B2", Status: "WAITING", Command: []string{"deploy.sh", "prod"}, DependsOn: &view.JobViewDependencies{Jobs: []string{"A1"}, Condition: "success"}},
+		},
+		Edges: []view.JobViewGraphEdge{{From: "A1", To: "B2"}},
+	}
+
+	server, uri := setupTestServer(t, 200, encodeModel(t, graph), "GET", "/api/jobs/B2/dag", "user", "pass")
+	defer server.Close()
+
+	buf := bytes.Buffer{}
+	err := client.Start(nil, &buf, &buf, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "dag", "B2"})
+	testutil.AssertNotError(t, err)
+
+	expected := `ID   STATUS     COMMAND          DEPENDS_ON   
+A1   FINISHED   build.sh         -
+B2   WAITING    deploy.sh prod   success of A1
+`
+
+	testutil.AssertEquals(t, buf.String(), expected)
+}
+
+func TestCanShowJobArray(t *testing.T) {
+	exitCode := 0
+	array := view.JobArrayViewFull{
+		JobArrayViewPartial: view.JobArrayViewPartial{
+			ID:        "A1",
+			Status:    "ACTIVE",
+			Size:      2,
+			Counts:    map[string]int{"RUNNING": 1, "FINISHED": 1},
+			CreatedAt: time.Date(2020, time.March, 2, 4, 4, 4, 0, time.UTC),
+		},
+		Jobs: []view.JobArrayViewJob{
+			{Index: 0, ID: "J0", Status: "FINISHED", ExitCode: &exitCode},
+			{Index: 1, ID: "J1", Status: "RUNNING"},
+		},
+	}
+
+	server, uri := setupTestServer(t, 200, encodeModel(t, array), "GET", "/api/arrays/A1", "user", "pass")
+	defer server.Close()
+
+	buf := bytes.Buffer{}
+	err := client.Start(nil, &buf, &buf, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "array", "show", "A1"})
+	testutil.AssertNotError(t, err)
+
+	expected := `ACTIVE, 2 jobs, created_at: 2020-03-02 04:04:04 +0000 UTC
+FINISHED: 1, RUNNING: 1
+  0 J0 FINISHED, exit_code: 0
+  1 J1 RUNNING, exit_code: -
+`
+
+	testutil.AssertEquals(t, buf.String(), expected)
+}
+
+func TestCanShowScheduler(t *testing.T) {
+	scheduler := view.SchedulerView{
+		Policy:     "fairshare",
+		MaxRunning: 4,
+		Running:    4,
+		Queued:     10,
+		Users: []view.SchedulerViewUser{
+			{Username: "user1", Shares: 3, Share: 0.75, Running: 1, Queued: 2, CPUSeconds: 12.34, Load: 0.5},
+			{Username: "user2", Shares: 1, Share: 0.25, Running: 3, Queued: 8, Load: 3},
+		},
+	}
+
+	server, uri := setupTestServer(t, 200, encodeModel(t, scheduler), "GET", "/api/admin/scheduler", "admin", "pass")
+	defer server.Close()
+
+	buf := bytes.Buffer{}
+	err := client.Start(nil, &buf, &buf, []string{"client", "-ca=", "-c=https://admin:pass@" + uri.Host, "admin", "scheduler"})
+	testutil.AssertNotError(t, err)
+
+	expected := `policy: fairshare, running: 4 of 4, queued: 10
+USER    SHARES   SHARE   RUNNING   QUEUED   CPU_SECONDS   LOAD   
+user1   3        75.0%   1         2        12.3          0.500
+user2   1        25.0%   3         8        0.0           3.000
+`
+
+	testutil.AssertEquals(t, buf.String(), expected)
+}
+
+func TestCanShowQuota(t *testing.T) {
+	quota := view.QuotaView{
+		RunningJobs:     view.QuotaViewUsage{Used: 2, Limit: 10},
+		Jobs:            view.QuotaViewUsage{Used: 25},
+		OutputBytes:     view.QuotaViewUsage{Used: 1024, Limit: 1048576},
+		CPUSecondsToday: view.QuotaViewUsage{Used: 60, Limit: 3600},
+		DayResetsAt:     time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC),
+	}
+
+	server, uri := setupTestServer(t, 200, encodeModel(t, quota), "GET", "/api/quota", "user", "pass")
+	defer server.Close()
+
+	buf := bytes.Buffer{}
+	err := client.Start(nil, &buf, &buf, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "quota"})
+	testutil.AssertNotError(t, err)
+
+	expected := `running_jobs: 2 of 10
+jobs: 25 (no limit)
+output_bytes: 1024 of 1048576
+cpu_seconds_today: 60 of 3600, resets at 2026-10-18 00:00:00 +0000 UTC
+`
+
+	testutil.AssertEquals(t, buf.String(), expected)
+}
+
+func TestRetriesRateLimitedRequests(t *testing.T) {
+	requests := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		testutil.AssertEquals(t, r.URL.Path, "/api/jobs")
+
+		// the body is sent again with the retry
+		request := view.JobViewCommand{}
+		testutil.AssertNotError(t, json.NewDecoder(r.Body).Decode(&request))
+		testutil.AssertEquals(t, request.Command, []string{"ls", "-l"})
+
+		w.Header().Set("Content-Type", jsonMime)
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write(encodeModel(t, client.ErrorType{Status: 429, Message: "too many requests, retry after 1s"}))
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write(encodeModel(t, view.JobViewPartial{ID: "123XYZ902"}))
+	})
+
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	buf := bytes.Buffer{}
+	err := client.Start(nil, &buf, &buf, []string{"client", "-ca=", "-c=https://user:pass@" + server.Listener.Addr().String(), "start", "ls", "-l"})
+	testutil.AssertNotError(t, err)
+
+	testutil.AssertEquals(t, requests, 2)
+	testutil.AssertEquals(t, buf.String(), "ID: 123XYZ902\n")
+}
+
+func TestDoesntRetryRequestsOverQuota(t *testing.T) {
+	returnError := client.ErrorType{
+		Status:  429,
+		Message: "quota exceeded: 10 jobs haven't ended, of a maximum of 10",
+	}
+
+	server, uri := setupTestServer(t, 429, encodeModel(t, returnError), "GET", "/api/jobs", "user", "pass")
+	defer server.Close()
+
+	err := client.Start(nil, os.Stdout, os.Stderr, []string{"client", "-ca=", "-c=https://user:pass@" + uri.Host, "list"})
+	testutil.AssertNotEquals(t, err, nil)
+
+	testutil.AssertEquals(t, err.Error(), "an error occurred (HTTP 429): "+returnError.Message)
+}
+
+func TestCanReloadUsers(t *testing.T) {
+	reload := view.UsersReloadView{Added: []string{"user3"}, Updated: []string{"user1", "user2"}, Removed: []string{}}
+
+	server, uri := setupTestServer(t, 200, encodeModel(t, reload), "POST", "/api/admin/users/reload", "admin", "pass")
+	defer server.Close()
+
+	buf := bytes.Buffer{}
+	err := client.Start(nil, &buf, &buf, []string{"client", "-ca=", "-c=https://admin:pass@" + uri.Host, "admin", "reload-users"})
+	testutil.AssertNotError(t, err)
+
+	testutil.AssertEquals(t, buf.String(), "added: user3, updated: user1, user2, removed: -\n")
+}
@@ -4,16 +4,25 @@ import (
 	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 const (
-	jsonMime = "application/json"
+	jsonMime   = "application/json"
+	streamMime = "application/octet-stream"
+
+	maxRateLimitRetries = 5                // times a rate limited request is sent again before giving up
+	maxRetryAfter       = 60 * time.Second // longer waits asked by the server aren't done, the 429 is returned instead
 )
 
 type HTTPClient struct {
@@ -101,13 +110,149 @@ func (c *HTTPClient) Delete(pathSegments ...string) (statusCode int, returnBody
 	return c.makeJSONRequest(http.MethodDelete, nil, pathSegments...)
 }
 
+// GetStream makes a GET request without reading the response body, which must be closed by the caller
+func (c *HTTPClient) GetStream(query url.Values, pathSegments ...string) (*http.Response, error) {
+	request, err := c.buildRequest(http.MethodGet, pathSegments, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request.URL.RawQuery = query.Encode()
+	request.Header.Set("Accept", streamMime)
+
+	return c.do(request)
+}
+
+// do sends the request, when the server rate limits it with a 429 and a Retry-After the request is sent again once
+// that time passes
+func (c *HTTPClient) do(request *http.Request) (*http.Response, error) {
+	for retries := 0; ; retries++ {
+		response, err := c.httpClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+
+		wait, ok := retryAfter(response.StatusCode, response.Header)
+		if !ok || retries == maxRateLimitRetries {
+			return response, nil
+		}
+		response.Body.Close()
+
+		if request.GetBody != nil {
+			if request.Body, err = request.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		time.Sleep(wait)
+	}
+}
+
+// how long to wait before sending a rate limited request again, false if the response isn't rate limited. Other
+// 429 responses, like when a quota is exceeded, have no Retry-After
+func retryAfter(statusCode int, header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if statusCode != http.StatusTooManyRequests || value == "" {
+		return 0, false
+	}
+
+	wait := time.Duration(0)
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		wait = time.Until(at)
+	} else {
+		return 0, false
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+
+	return wait, wait <= maxRetryAfter
+}
+
+func (c *HTTPClient) tlsConfig() *tls.Config {
+	transport, ok := c.httpClient.Transport.(*http.Transport)
+	if !ok {
+		transport, ok = http.DefaultTransport.(*http.Transport)
+	}
+
+	if !ok {
+		return nil
+	}
+
+	return transport.TLSClientConfig
+}
+
+// DialWebSocket opens a WebSocket connection, when the server refuses the upgrade the connection is nil
+// and the HTTP response is returned instead
+func (c *HTTPClient) DialWebSocket(query url.Values, pathSegments ...string) (conn *websocket.Conn, statusCode int, returnBody []byte, err error) {
+	uri, err := url.Parse(c.joinPathFragments(pathSegments))
+	if err != nil {
+		return nil, -1, nil, err
+	}
+
+	uri.Scheme = "wss"
+	uri.User = nil
+	uri.RawQuery = query.Encode()
+
+	header := http.Header{}
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.token)))
+
+	dialer := websocket.Dialer{
+		TLSClientConfig:  c.tlsConfig(),
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+	}
+
+	conn, response, err := dialer.Dial(uri.String(), header)
+	for retries := 0; err == websocket.ErrBadHandshake && response != nil && retries < maxRateLimitRetries; retries++ {
+		wait, ok := retryAfter(response.StatusCode, response.Header)
+		if !ok {
+			break
+		}
+
+		response.Body.Close()
+		time.Sleep(wait)
+		conn, response, err = dialer.Dial(uri.String(), header)
+	}
+
+	if err == websocket.ErrBadHandshake && response != nil {
+		resp, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+
+		return nil, response.StatusCode, resp, err
+	}
+
+	if err != nil {
+		return nil, -1, nil, err
+	}
+
+	return conn, http.StatusSwitchingProtocols, nil, nil
+}
+
+// PostMultipart posts a multipart body, 'contentType' must include the multipart boundary
+func (c *HTTPClient) PostMultipart(requestBody []byte, contentType string, pathSegments ...string) (statusCode int, returnBody []byte, err error) {
+	request, err := c.buildRequest(http.MethodPost, pathSegments, requestBody)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	request.Header.Set("Content-Type", contentType)
+
+	return c.doRequest(request)
+}
+
 func (c *HTTPClient) makeJSONRequest(requestMethod string, requestBody []byte, pathSegments ...string) (statusCode int, returnBody []byte, err error) {
 	request, err := c.buildRequest(requestMethod, pathSegments, requestBody)
 	if err != nil {
 		return -1, nil, err
 	}
 
-	response, err := c.httpClient.Do(request)
+	return c.doRequest(request)
+}
+
+func (c *HTTPClient) doRequest(request *http.Request) (statusCode int, returnBody []byte, err error) {
+	response, err := c.do(request)
 	if err != nil {
 		return -1, nil, err
 	}
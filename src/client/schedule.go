@@ -0,0 +1,144 @@
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Ross65536/job-scheduler/src/core/view"
+)
+
+func displayScheduleList(out io.Writer, schedules []*view.ScheduleViewPartial) {
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].CreatedAt.Before(schedules[j].CreatedAt)
+	})
+
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tCRON\tSTATUS\tCOMMAND\tNEXT_RUN_AT\t")
+	for _, schedule := range schedules {
+		status, nextRunAt := "active", "-"
+		if schedule.Paused {
+			status = "paused"
+		}
+		if schedule.NextRunAt != nil {
+			nextRunAt = schedule.NextRunAt.String()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", schedule.ID, schedule.Cron, status, strings.Join(schedule.Job.Command, " "), nextRunAt)
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "--- %d schedules --- \n", len(schedules))
+}
+
+func scheduleCreateTask(in io.Reader, out io.Writer, api *APIClient, commandRest []string) error {
+	flags := flag.NewFlagSet("schedule create", flag.ContinueOnError)
+	flags.SetOutput(out)
+	overlap := flags.String("overlap", "allow", "what to do when the previous run is still going: allow, skip or replace")
+	jobFlags := addJobFlags(flags)
+
+	// parsing stops at the first non-flag argument, which is the cron expression
+	if err := flags.Parse(commandRest); err != nil {
+		return err
+	}
+
+	if flags.NArg() < 2 {
+		return errors.New("must specify the cron expression and the job to run")
+	}
+
+	job, err := jobFlags.request(flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	request := &view.ScheduleViewCommand{
+		Cron:    flags.Arg(0),
+		Overlap: *overlap,
+		Job:     *job,
+	}
+
+	stdin, err := readJobStdin(in, *jobFlags.stdinFile)
+	if err != nil {
+		return err
+	}
+	request.Job.StdinBase64 = base64.StdEncoding.EncodeToString(stdin)
+
+	schedule, err := api.CreateSchedule(request)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "ID: %s\n", schedule.ID)
+	return nil
+}
+
+func scheduleListTask(out io.Writer, api *APIClient, commandRest []string) error {
+	if len(commandRest) != 0 {
+		return errors.New("too many args")
+	}
+
+	schedules, err := api.ListSchedules()
+	if err != nil {
+		return err
+	}
+
+	displayScheduleList(out, schedules)
+	return nil
+}
+
+func scheduleShowTask(out io.Writer, api *APIClient, commandRest []string) error {
+	if len(commandRest) != 1 {
+		return errors.New("must specify ID")
+	}
+
+	schedule, err := api.ShowSchedule(commandRest[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, schedule)
+	return nil
+}
+
+// runs a schedule command that only takes the schedule's ID and prints OK on success
+func scheduleIDTask(out io.Writer, commandRest []string, action func(id string) error) error {
+	if len(commandRest) != 1 {
+		return errors.New("must specify ID")
+	}
+
+	if err := action(commandRest[0]); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "OK")
+	return nil
+}
+
+func scheduleTask(in io.Reader, out io.Writer, api *APIClient, commandRest []string) error {
+	if len(commandRest) < 1 {
+		return errors.New("must specify schedule command")
+	}
+
+	argsRest := commandRest[1:]
+	switch task := commandRest[0]; task {
+	case "create":
+		return scheduleCreateTask(in, out, api, argsRest)
+	case "list":
+		return scheduleListTask(out, api, argsRest)
+	case "show":
+		return scheduleShowTask(out, api, argsRest)
+	case "rm":
+		return scheduleIDTask(out, argsRest, api.DeleteSchedule)
+	case "pause":
+		return scheduleIDTask(out, argsRest, api.PauseSchedule)
+	case "resume":
+		return scheduleIDTask(out, argsRest, api.ResumeSchedule)
+	default:
+		return errors.New("unknown schedule command " + task)
+	}
+}
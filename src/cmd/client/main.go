@@ -9,7 +9,7 @@ import (
 
 func main() {
 	args := os.Args
-	if err := client.Start(os.Stdout, args); err != nil {
+	if err := client.Start(os.Stdin, os.Stdout, os.Stderr, args); err != nil {
 		log.Fatalf("Failed to run because: %v", err)
 	}
 }
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/Ross65536/job-scheduler/src/backend"
 )
@@ -11,37 +16,168 @@ import (
 const (
 	defaultPrivateKeyPath  = "certs/server.key"
 	defaultCertificatePath = "certs/server.crt"
+	defaultUsersFilePath   = "config/users.json"
 )
 
-func parseFlags() (listenPort int, certificatePath string, privateKeyPath string) {
+type serverFlags struct {
+	listenPort      int
+	certificatePath string
+	privateKeyPath  string
+	config          backend.Config
+}
+
+func parseFlags() serverFlags {
+	defaults := backend.DefaultConfig()
 	port := flag.Int("p", 10000, "port to listen on")
 	certificate := flag.String("cert", defaultCertificatePath, "path to the server's public certificate")
 	privateKey := flag.String("privateKey", defaultPrivateKeyPath, "path to the server's private key, matching the certificate")
+	usersFile := flag.String("usersFile", defaultUsersFilePath, "JSON file with the users, the hashes of their tokens and their settings, reloaded on SIGHUP")
+	removedUserJobs := flag.String("removedUserJobs", string(defaults.RemovedUserJobs), "what happens to the jobs of the users removed from the users file: keep, to run them to completion, or stop")
+	cgroupRoot := flag.String("cgroup", "", "cgroup v2 directory under which the job cgroups are created, resource limits are disabled if empty")
+	stopSignal := flag.String("stopSignal", defaults.DefaultStopSignal, "signal sent to stop jobs that don't specify one")
+	maxStdinSize := flag.Int64("maxStdinSize", defaults.MaxStdinSize, "maximum size in bytes of the stdin given when creating a job")
+	workingDir := flag.String("workingDir", defaults.DefaultWorkingDir, "working directory of jobs that don't specify one")
+	allowUnmappedUsers := flag.Bool("allowUnmappedUsers", false, "allow users that aren't mapped to a Unix account to create jobs, which run as the server's account")
+	stopGracePeriod := flag.Duration("stopGracePeriod", defaults.DefaultStopGracePeriod, "time to wait after the stop signal before killing jobs that don't specify one")
+	storeDir := flag.String("storeDir", "", "directory where the job records are persisted to survive restarts, only kept in memory if empty")
+	logDir := flag.String("logDir", "", "directory where the output of the jobs is written, so that memory only holds a recent window, output is only kept in memory if empty")
+	maxOutputSize := flag.Int("maxOutputSize", defaults.MaxOutputSize, "bytes of each stream of a job kept in memory")
+	maxTotalOutputSize := flag.Int64("maxTotalOutputSize", defaults.MaxTotalOutputSize, "bytes of output kept in memory by all the jobs, no maximum if 0")
+	outputRetention := flag.String("outputRetention", string(defaults.OutputRetention), "part of the output kept once a stream is larger than maxOutputSize: head, tail or both")
+	maxTimeout := flag.Duration("maxTimeout", 0, "maximum time a job can run before being stopped, also applied to jobs that don't specify a timeout, no maximum if 0")
+	maxJobAge := flag.Duration("maxJobAge", 0, "time after ending that jobs are removed together with their output, kept until purged if 0")
+	maxJobsPerUser := flag.Int("maxJobsPerUser", 0, "ended jobs kept for each user, the oldest are removed beyond it, no maximum if 0")
+	retentionSweepInterval := flag.Duration("retentionSweepInterval", defaults.RetentionSweepInterval, "how often the ended jobs are checked against maxJobAge and maxJobsPerUser")
+	maxRunningJobs := flag.Int("maxRunningJobs", 0, "jobs running at once on the server, the others are queued until a job ends, no maximum if 0")
+	maxRunningJobsPerUser := flag.Int("maxRunningJobsPerUser", 0, "jobs running at once for each user, the others are queued until a job of the user ends, no maximum if 0")
+	preemption := flag.String("preemption", string(backend.PreemptionOff), "how queued jobs take the slot of running jobs with a lower priority: off, suspend or requeue")
+	schedulingPolicy := flag.String("schedulingPolicy", string(defaults.SchedulingPolicy), "which queued job of the same priority starts first: fifo, or fairshare for the job of the user using the least of their share")
+	fairShareHalfLife := flag.Duration("fairShareHalfLife", defaults.FairShareHalfLife, "time after which the CPU time used by a user counts half as much for the fair share")
+
+	var userReadRateLimit, userCreateRateLimit, ipReadRateLimit, ipCreateRateLimit backend.RateLimit
+	flag.Var((*rateLimitFlag)(&userReadRateLimit), "userReadRateLimit", "requests of each user other than job and schedule creations, in the format rate[:burst] with the rate in requests per second, no limit by default")
+	flag.Var((*rateLimitFlag)(&userCreateRateLimit), "userCreateRateLimit", "job and schedule creations of each user, in the format rate[:burst], no limit by default")
+	flag.Var((*rateLimitFlag)(&ipReadRateLimit), "ipReadRateLimit", "requests from each client IP other than job and schedule creations, in the format rate[:burst], no limit by default")
+	flag.Var((*rateLimitFlag)(&ipCreateRateLimit), "ipCreateRateLimit", "job and schedule creations from each client IP, in the format rate[:burst], no limit by default")
 
 	flag.Parse()
 
-	return *port, *certificate, *privateKey
+	return serverFlags{
+		listenPort:      *port,
+		certificatePath: *certificate,
+		privateKeyPath:  *privateKey,
+		config: backend.Config{
+			CgroupRoot:             *cgroupRoot,
+			DefaultStopSignal:      *stopSignal,
+			DefaultStopGracePeriod: *stopGracePeriod,
+			MaxStdinSize:           *maxStdinSize,
+			BaseEnv:                defaults.BaseEnv,
+			DefaultWorkingDir:      *workingDir,
+			AllowUnmappedUsers:     *allowUnmappedUsers,
+			MaxTimeout:             *maxTimeout,
+			MaxOutputSize:          *maxOutputSize,
+			MaxTotalOutputSize:     *maxTotalOutputSize,
+			OutputRetention:        backend.OutputRetention(*outputRetention),
+			LogDir:                 *logDir,
+			StoreDir:               *storeDir,
+			MaxJobAge:              *maxJobAge,
+			MaxJobsPerUser:         *maxJobsPerUser,
+			RetentionSweepInterval: *retentionSweepInterval,
+			MaxRunningJobs:         *maxRunningJobs,
+			MaxRunningJobsPerUser:  *maxRunningJobsPerUser,
+			Preemption:             backend.PreemptionMode(*preemption),
+			SchedulingPolicy:       backend.SchedulingPolicy(*schedulingPolicy),
+			FairShareHalfLife:      *fairShareHalfLife,
+			UserReadRateLimit:      userReadRateLimit,
+			UserCreateRateLimit:    userCreateRateLimit,
+			IPReadRateLimit:        ipReadRateLimit,
+			IPCreateRateLimit:      ipCreateRateLimit,
+			UsersFile:              *usersFile,
+			RemovedUserJobs:        backend.RemovedUserPolicy(*removedUserJobs),
+		},
+	}
+}
+
+// flag with a rate limit, in the format rate[:burst] with the rate in requests per second, e.g. 10:20
+type rateLimitFlag backend.RateLimit
+
+func (r *rateLimitFlag) String() string {
+	if r == nil || r.Rate == 0 {
+		return ""
+	}
+
+	return strconv.FormatFloat(r.Rate, 'f', -1, 64) + ":" + strconv.Itoa(r.Burst)
+}
+
+func (r *rateLimitFlag) Set(value string) error {
+	rate, burst, hasBurst := strings.Cut(value, ":")
+
+	limit := backend.RateLimit{}
+	var err error
+	if limit.Rate, err = strconv.ParseFloat(rate, 64); err != nil || limit.Rate <= 0 {
+		return errors.New("the rate must be a positive number of requests per second")
+	}
+
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst < 1 {
+			return errors.New("the burst must be a positive integer")
+		}
+	}
+
+	*r = rateLimitFlag(limit)
+	return nil
+}
+
+// reloads the users file every time the server receives SIGHUP, the users are kept as they were if it's invalid
+func reloadUsersOnSIGHUP(state *backend.State) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		if reload, err := state.LoadUsersFile(); err != nil {
+			log.Printf("Failed to reload the users, they're unchanged: %s", err)
+		} else {
+			log.Printf("Reloaded the users on SIGHUP, %s", reload.String())
+		}
+	}
 }
 
 func main() {
-	state := backend.NewState()
-	// TODO: place this into a config file or equivalent
-	state.AddUser("user1", "XlG15tRINdWTAm5oZ/mhikbEiwf75w0LJUVek0ROhY4=")
-	state.AddUser("user2", "oAtCvE6Xcu07f2PmjoOjq8kv6X2XTgh3s37suKzKHLo=")
+	flags := parseFlags()
+	if flags.listenPort < 0 || flags.listenPort > 65535 {
+		log.Fatalf("invalid port value")
+	}
+
+	state, err := backend.NewStateWithConfig(flags.config)
+	if err != nil {
+		log.Fatalf("Failed to create server state %s", err)
+	}
+
+	reload, err := state.LoadUsersFile()
+	if err != nil {
+		log.Fatalf("Failed to load the users %s", err)
+	}
+	log.Printf("Loaded the users from %s, %s", flags.config.UsersFile, reload.String())
+
+	// the jobs are loaded once the users are, the ones of users missing from the users file aren't
+	if err := state.LoadJobs(); err != nil {
+		log.Fatalf("Failed to load the saved jobs %s", err)
+	}
+
+	if err := state.LoadSchedules(); err != nil {
+		log.Fatalf("Failed to load the saved schedules %s", err)
+	}
 
 	server, err := backend.NewServer(state)
 	if err != nil {
 		log.Fatalf("Failed to create server %s", err)
 	}
 
-	port, certificatePath, privateKeyPath := parseFlags()
-	if port < 0 || port > 65535 {
-		log.Fatalf("invalid port value")
-	}
+	go reloadUsersOnSIGHUP(state)
 
-	log.Printf("Starting server on :%d", port)
+	log.Printf("Starting server on :%d", flags.listenPort)
 
-	if err := server.StartWithTls(port, certificatePath, privateKeyPath); err != nil {
+	if err := server.StartWithTls(flags.listenPort, flags.certificatePath, flags.privateKeyPath); err != nil {
 		log.Printf("An error occurred, the server stopped %s", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,56 @@
+package view
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SchedulerView is how the server's job slots are shared between the users
+type SchedulerView struct {
+	Policy            string              `json:"policy"`               // fifo or fairshare
+	MaxRunning        int                 `json:"max_running"`          // jobs running at once on the server, no maximum if 0
+	MaxRunningPerUser int                 `json:"max_running_per_user"` // jobs running at once for each user, no maximum if 0
+	Running           int                 `json:"running"`
+	Queued            int                 `json:"queued"`
+	Users             []SchedulerViewUser `json:"users"` // ordered by username
+}
+
+type SchedulerViewUser struct {
+	Username   string  `json:"username"`
+	Shares     int     `json:"shares"`            // weight of the user for the fair share
+	Share      float64 `json:"share"`             // the user's shares out of the shares of all the users
+	Running    int     `json:"running"`           // jobs using a slot
+	Queued     int     `json:"queued"`            // jobs waiting for a slot
+	CPUSeconds float64 `json:"cpu_seconds"`       // CPU time used recently by the jobs of the user, decayed over time
+	Load       float64 `json:"load"`              // the slots and CPUs used relative to the shares, the user with the lowest goes first
+	Removed    bool    `json:"removed,omitempty"` // removed from the users file, its jobs can still be running
+}
+
+// UsersReloadView is how the users changed when the users file was reloaded, ordered by username
+type UsersReloadView struct {
+	Added   []string `json:"added"` // the users added back after being removed included
+	Updated []string `json:"updated"`
+	Removed []string `json:"removed"`
+}
+
+func (reload *UsersReloadView) String() string {
+	format := func(usernames []string) string {
+		if len(usernames) == 0 {
+			return "-"
+		}
+
+		return strings.Join(usernames, ", ")
+	}
+
+	return fmt.Sprintf("added: %s, updated: %s, removed: %s", format(reload.Added), format(reload.Updated), format(reload.Removed))
+}
+
+func (scheduler *SchedulerView) String() string {
+	maxRunning := "-"
+	if scheduler.MaxRunning != 0 {
+		maxRunning = strconv.Itoa(scheduler.MaxRunning)
+	}
+
+	return fmt.Sprintf("policy: %s, running: %d of %s, queued: %d", scheduler.Policy, scheduler.Running, maxRunning, scheduler.Queued)
+}
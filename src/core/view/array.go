@@ -0,0 +1,67 @@
+package view
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JobViewArray makes a job creation request create a job for each set of arguments, or each index of the range.
+// '{{index}}' in the command and env values is replaced with the index of each job
+type JobViewArray struct {
+	Args  [][]string    `json:"args,omitempty"`  // arguments appended to the command of each job, indexed from 0
+	Range *JobViewRange `json:"range,omitempty"` // alternative to 'args', the indexes of the jobs
+}
+
+type JobViewRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`            // included
+	Step  int `json:"step,omitempty"` // 1 by default
+}
+
+// JobArrayViewPartial is the parent of the jobs created by a job array request, rolled up from them
+type JobArrayViewPartial struct {
+	ID        string         `json:"id"`
+	Status    string         `json:"status"` // ACTIVE while any job hasn't ended, ENDED otherwise
+	Size      int            `json:"size"`   // number of jobs, the ones that were purged aren't counted
+	Counts    map[string]int `json:"counts"` // number of jobs in each status
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+type JobArrayViewJob struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+}
+
+type JobArrayViewFull struct {
+	JobArrayViewPartial
+	Jobs []JobArrayViewJob `json:"jobs"` // ordered by index
+}
+
+func (array *JobArrayViewPartial) CountsString() string {
+	statuses := make([]string, 0, len(array.Counts))
+	for status := range array.Counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	parts := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		parts = append(parts, fmt.Sprintf("%s: %d", status, array.Counts[status]))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func (array *JobArrayViewFull) String() string {
+	text := fmt.Sprintf("%s, %d jobs, created_at: %s\n%s", array.Status, array.Size, array.CreatedAt, array.CountsString())
+
+	for _, job := range array.Jobs {
+		text += fmt.Sprintf("\n  %d %s %s, exit_code: %s", job.Index, job.ID, job.Status, intToStr(job.ExitCode))
+	}
+
+	return text
+}
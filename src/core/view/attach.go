@@ -0,0 +1,9 @@
+package view
+
+// Frames exchanged over an attach WebSocket are binary messages where the first byte identifies the stream
+// and the rest is the payload. An empty stdin frame closes the job's stdin.
+const (
+	AttachStdin  byte = 0
+	AttachStdout byte = 1
+	AttachStderr byte = 2
+)
@@ -2,28 +2,112 @@ package view
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
+type JobViewLimits struct {
+	CPU       float64 `json:"cpu,omitempty"`        // number of CPUs the job can use, fractional values allowed
+	MemoryMax int64   `json:"memory_max,omitempty"` // maximum memory in bytes
+	IOWeight  int     `json:"io_weight,omitempty"`  // IO weight, from 1 to 10000
+}
+
+// JobViewRetry is when a job that failed is run again
+type JobViewRetry struct {
+	MaxAttempts int      `json:"max_attempts"`          // attempts in total including the first
+	Backoff     string   `json:"backoff,omitempty"`     // delay before the first retry, doubled after each attempt, e.g. 1s
+	MaxBackoff  string   `json:"max_backoff,omitempty"` // the delay doesn't grow beyond this, e.g. 5m
+	ExitCodes   []int    `json:"exit_codes,omitempty"`  // exit codes retried, any non-zero one if neither these nor 'statuses' are set
+	Statuses    []string `json:"statuses,omitempty"`    // KILLED and/or TIMED_OUT
+}
+
+// JobViewDependencies are the jobs a job waits for, and what they must end as for it to run
+type JobViewDependencies struct {
+	Jobs      []string `json:"jobs"`                // IDs of jobs of the same user
+	Condition string   `json:"condition,omitempty"` // success (the default), failure or any
+}
+
+func (dependencies *JobViewDependencies) String() string {
+	return dependencies.Condition + " of " + strings.Join(dependencies.Jobs, ", ")
+}
+
 type JobViewCommand struct {
-	Command []string `json:"command"`
+	Command         []string             `json:"command"`
+	StopSignal      string               `json:"stop_signal,omitempty"`       // signal sent first when stopping the job, e.g. SIGINT
+	StopGracePeriod string               `json:"stop_grace_period,omitempty"` // time to wait after the stop signal before sending SIGKILL, e.g. 10s
+	Interactive     bool                 `json:"interactive,omitempty"`       // keep stdin open so that it can be written through an attach session
+	TTY             bool                 `json:"tty,omitempty"`               // run in a pseudo-terminal, stdout has the combined terminal output
+	Stdin           string               `json:"stdin,omitempty"`             // text written to the job's stdin, only used on creation
+	StdinBase64     string               `json:"stdin_base64,omitempty"`      // alternative to 'stdin' for binary content, only used on creation
+	Env             map[string]string    `json:"env,omitempty"`               // environment variables of the job, added to the server's base environment
+	WorkingDir      string               `json:"working_dir,omitempty"`       // absolute path the job runs in
+	Timeout         string               `json:"timeout,omitempty"`           // maximum time the job can run before being stopped, e.g. 1h
+	Priority        int                  `json:"priority,omitempty"`          // jobs with a higher priority start first, at most the user's maximum
+	StartAt         *time.Time           `json:"start_at,omitempty"`          // the job is SCHEDULED until this time, then queued
+	StartAfter      string               `json:"start_after,omitempty"`       // alternative to 'start_at' relative to the creation, e.g. 2h, only used on creation
+	Retry           *JobViewRetry        `json:"retry,omitempty"`             // runs the job again when it fails
+	DependsOn       *JobViewDependencies `json:"depends_on,omitempty"`        // the job is WAITING until these jobs end
+	Array           *JobViewArray        `json:"array,omitempty"`             // creates a job for each element instead, only used on creation
+	JobViewLimits
+}
+
+type JobViewTerminalSize struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
 }
 
 type JobViewPartial struct {
 	JobViewCommand
-	ID        string    `json:"id"`
-	Status    string    `json:"status"`
-	CreatedAt time.Time `json:"created_at"`
+	ID         string    `json:"id"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	ScheduleID string    `json:"schedule_id,omitempty"` // schedule that started the job, unset if started by the user
+	ArrayID    string    `json:"array_id,omitempty"`    // job array the job belongs to, unset if created on its own
+	ArrayIndex *int      `json:"array_index,omitempty"` // index of the job in its array
+}
+
+// JobViewOutputSize is how much of a stream the server kept, once a stream is larger than the server's maximum
+// the bytes in excess are dropped
+type JobViewOutputSize struct {
+	Total     int64 `json:"total"`     // bytes written by the job
+	Dropped   int64 `json:"dropped"`   // bytes that aren't in the output
+	Truncated bool  `json:"truncated"` // whether any bytes were dropped
+}
+
+// JobViewEvent is an entry of the job's history, like a preemption
+type JobViewEvent struct {
+	At      time.Time `json:"at"`
+	Event   string    `json:"event"`
+	Message string    `json:"message,omitempty"`
+}
+
+// JobViewAttempt is a previous run of a retried job
+type JobViewAttempt struct {
+	Attempt    int               `json:"attempt"` // number of the attempt, from 1
+	Status     string            `json:"status"`
+	ExitCode   *int              `json:"exit_code,omitempty"`
+	StartedAt  time.Time         `json:"started_at"`
+	StoppedAt  time.Time         `json:"stopped_at"`
+	Stdout     string            `json:"stdout,omitempty"`
+	Stderr     string            `json:"stderr,omitempty"`
+	StdoutSize JobViewOutputSize `json:"stdout_size"`
+	StderrSize JobViewOutputSize `json:"stderr_size"`
 }
 
 type JobViewFull struct {
 	JobViewPartial
-	Stdout    string     `json:"stdout,omitempty"`
-	Stderr    string     `json:"stderr,omitempty"`
-	ExitCode  *int       `json:"exit_code,omitempty"`
-	StoppedAt *time.Time `json:"stopped_at,omitempty"`
+	Stdout     string            `json:"stdout,omitempty"`
+	Stderr     string            `json:"stderr,omitempty"`
+	StdoutSize JobViewOutputSize `json:"stdout_size"`
+	StderrSize JobViewOutputSize `json:"stderr_size"`
+	ExitCode   *int              `json:"exit_code,omitempty"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"` // when the process started, unset while queued
+	StoppedAt  *time.Time        `json:"stopped_at,omitempty"`
+	History    []JobViewEvent    `json:"history,omitempty"`
+	Attempt    int               `json:"attempt,omitempty"`  // number of the current attempt, set if the job can be retried
+	Attempts   []JobViewAttempt  `json:"attempts,omitempty"` // previous attempts, the first first
 }
 
 func intToStr(num *int) string {
@@ -34,7 +118,119 @@ func intToStr(num *int) string {
 	return strconv.Itoa(*num)
 }
 
+func (limits *JobViewLimits) String() string {
+	parts := []string{}
+	if limits.CPU != 0 {
+		parts = append(parts, "cpu: "+strconv.FormatFloat(limits.CPU, 'f', -1, 64))
+	}
+	if limits.MemoryMax != 0 {
+		parts = append(parts, "memory_max: "+strconv.FormatInt(limits.MemoryMax, 10))
+	}
+	if limits.IOWeight != 0 {
+		parts = append(parts, "io_weight: "+strconv.Itoa(limits.IOWeight))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// marker shown next to the name of a truncated stream, empty if nothing was dropped
+func (size *JobViewOutputSize) String() string {
+	if !size.Truncated {
+		return ""
+	}
+
+	return fmt.Sprintf(" (truncated, %d of %d bytes dropped)", size.Dropped, size.Total)
+}
+
 func (job *JobViewFull) String() string {
-	return fmt.Sprintf("%s, %s, %s -> %s, exit_code: %s\n\nSTDOUT:\n%s\n\nSTDERR:\n%s",
-		strings.Join(job.Command, " "), job.Status, job.CreatedAt, job.StoppedAt, intToStr(job.ExitCode), job.Stdout, job.Stderr)
+	header := fmt.Sprintf("%s, %s, %s -> %s, exit_code: %s",
+		strings.Join(job.Command, " "), job.Status, job.CreatedAt, job.StoppedAt, intToStr(job.ExitCode))
+
+	if job.StartedAt != nil {
+		header += "\nstarted_at: " + job.StartedAt.String()
+	}
+
+	if limits := job.JobViewLimits.String(); limits != "" {
+		header += "\nlimits: " + limits
+	}
+
+	if job.Timeout != "" {
+		header += "\ntimeout: " + job.Timeout
+	}
+
+	if job.Priority != 0 {
+		header += "\npriority: " + strconv.Itoa(job.Priority)
+	}
+
+	if job.StartAt != nil {
+		header += "\nstart_at: " + job.StartAt.String()
+	}
+
+	if job.DependsOn != nil {
+		header += "\ndepends_on: " + job.DependsOn.String()
+	}
+
+	if job.ArrayID != "" {
+		header += fmt.Sprintf("\narray: %s, index: %s", job.ArrayID, intToStr(job.ArrayIndex))
+	}
+
+	if job.WorkingDir != "" {
+		header += "\nworking_dir: " + job.WorkingDir
+	}
+
+	if len(job.Env) != 0 {
+		env := make([]string, 0, len(job.Env))
+		for key, value := range job.Env {
+			env = append(env, key+"="+value)
+		}
+		sort.Strings(env)
+
+		header += "\nenv: " + strings.Join(env, " ")
+	}
+
+	for i, event := range job.History {
+		if i == 0 {
+			header += "\nhistory:"
+		}
+
+		header += fmt.Sprintf("\n  %s %s", event.At, event.Event)
+		if event.Message != "" {
+			header += ", " + event.Message
+		}
+	}
+
+	if job.Attempt != 0 && job.Retry != nil {
+		header += fmt.Sprintf("\nattempt: %d of %d", job.Attempt, job.Retry.MaxAttempts)
+	}
+
+	text := fmt.Sprintf("%s\n\nSTDOUT%s:\n%s\n\nSTDERR%s:\n%s",
+		header, job.StdoutSize.String(), job.Stdout, job.StderrSize.String(), job.Stderr)
+
+	for _, attempt := range job.Attempts {
+		text += fmt.Sprintf("\n\nATTEMPT %d, %s, %s -> %s, exit_code: %s\n\nSTDOUT%s:\n%s\n\nSTDERR%s:\n%s",
+			attempt.Attempt, attempt.Status, attempt.StartedAt, attempt.StoppedAt, intToStr(attempt.ExitCode),
+			attempt.StdoutSize.String(), attempt.Stdout, attempt.StderrSize.String(), attempt.Stderr)
+	}
+
+	return text
+}
+
+type JobViewGraphNode struct {
+	ID        string               `json:"id"`
+	Status    string               `json:"status"`
+	Command   []string             `json:"command"`
+	CreatedAt time.Time            `json:"created_at"`
+	DependsOn *JobViewDependencies `json:"depends_on,omitempty"`
+}
+
+// JobViewGraphEdge goes from a job to a job that depends on it
+type JobViewGraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// JobViewGraph is a DAG of jobs connected through their dependencies
+type JobViewGraph struct {
+	Nodes []JobViewGraphNode `json:"nodes"` // every job comes after the jobs it depends on
+	Edges []JobViewGraphEdge `json:"edges"`
 }
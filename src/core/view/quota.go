@@ -0,0 +1,34 @@
+package view
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// QuotaView is what a user's jobs are using of each limit of the user's quota
+type QuotaView struct {
+	RunningJobs     QuotaViewUsage `json:"running_jobs"`      // jobs that haven't ended
+	Jobs            QuotaViewUsage `json:"jobs"`              // job records kept by the server, until they're purged
+	OutputBytes     QuotaViewUsage `json:"output_bytes"`      // output of the jobs kept by the server
+	CPUSecondsToday QuotaViewUsage `json:"cpu_seconds_today"` // CPU time of the jobs that ended today, and of the running jobs with cgroups
+	DayResetsAt     time.Time      `json:"day_resets_at"`     // when the CPU time used today is reset
+}
+
+type QuotaViewUsage struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit,omitempty"` // no limit if unset
+}
+
+func (usage *QuotaViewUsage) String() string {
+	if usage.Limit == 0 {
+		return strconv.FormatInt(usage.Used, 10) + " (no limit)"
+	}
+
+	return fmt.Sprintf("%d of %d", usage.Used, usage.Limit)
+}
+
+func (quota *QuotaView) String() string {
+	return fmt.Sprintf("running_jobs: %s\njobs: %s\noutput_bytes: %s\ncpu_seconds_today: %s, resets at %s",
+		quota.RunningJobs.String(), quota.Jobs.String(), quota.OutputBytes.String(), quota.CPUSecondsToday.String(), quota.DayResetsAt)
+}
@@ -0,0 +1,62 @@
+package view
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type ScheduleViewCommand struct {
+	Cron    string         `json:"cron"`              // cron expression, in the server's time zone, e.g. '*/5 * * * *'
+	Overlap string         `json:"overlap,omitempty"` // what to do when the previous run is still going: allow, skip or replace
+	Job     JobViewCommand `json:"job"`               // job started by each run
+}
+
+type ScheduleViewPartial struct {
+	ScheduleViewCommand
+	ID        string     `json:"id"`
+	Paused    bool       `json:"paused"`
+	CreatedAt time.Time  `json:"created_at"`
+	NextRunAt *time.Time `json:"next_run_at,omitempty"` // unset while paused
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+}
+
+type ScheduleViewFull struct {
+	ScheduleViewPartial
+	Runs      []string `json:"runs"`                 // IDs of the jobs started by the schedule, the latest last
+	Skipped   int      `json:"skipped"`              // runs skipped because the previous run was still going
+	LastError string   `json:"last_error,omitempty"` // why the last run failed to start
+}
+
+func optionalTimeToStr(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+
+	return t.String()
+}
+
+func (schedule *ScheduleViewFull) String() string {
+	status := "active"
+	if schedule.Paused {
+		status = "paused"
+	}
+
+	text := fmt.Sprintf("'%s' %s, %s, overlap: %s, created_at: %s\nnext_run_at: %s, last_run_at: %s, skipped: %d",
+		schedule.Cron, strings.Join(schedule.Job.Command, " "), status, schedule.Overlap, schedule.CreatedAt,
+		optionalTimeToStr(schedule.NextRunAt), optionalTimeToStr(schedule.LastRunAt), schedule.Skipped)
+
+	if schedule.LastError != "" {
+		text += "\nlast_error: " + schedule.LastError
+	}
+
+	for i, run := range schedule.Runs {
+		if i == 0 {
+			text += "\nruns:"
+		}
+
+		text += "\n  " + run
+	}
+
+	return text
+}
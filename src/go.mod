@@ -1,8 +1,13 @@
 module github.com/Ross65536/job-scheduler/server
 
-go 1.15
+go 1.20
 
 require (
+	github.com/creack/pty v1.1.18
 	github.com/google/uuid v1.2.0
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
+	golang.org/x/term v0.10.0
 )
+
+require golang.org/x/sys v0.10.0 // indirect